@@ -1,17 +1,98 @@
 package main
 
 import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/dollarkillerx/unregistry/pkg/api"
+	"github.com/dollarkillerx/unregistry/pkg/bundle"
+	"github.com/dollarkillerx/unregistry/pkg/compose"
 	"github.com/dollarkillerx/unregistry/pkg/config"
+	"github.com/dollarkillerx/unregistry/pkg/container"
+	"github.com/dollarkillerx/unregistry/pkg/imgarchive"
+	"github.com/dollarkillerx/unregistry/pkg/progress"
+	"github.com/dollarkillerx/unregistry/pkg/registry"
+	"github.com/dollarkillerx/unregistry/pkg/sign"
 	"github.com/spf13/cobra"
 )
 
+var (
+	filePushForce     bool
+	filePushExtract   bool
+	filePushNoClobber bool
+	filePushIfVersion string
+	filePullParallel  int
+	filePullExpect    string
+	filePullForce     bool
+	filePullArchive   string
+
+	fileRecursive   bool
+	fileInclude     []string
+	fileExclude     []string
+	fileConcurrency int
+	syncDelete      bool
+	syncDryRun      bool
+
+	fileRelocateForce bool
+
+	fileShareExpires      time.Duration
+	fileShareMaxDownloads int
+
+	imgRuntime    string
+	imgPushKey    string
+	imgPullVerify bool
+	imgPullPubKey string
+	imgSignKey    string
+	imgPruneDry   bool
+
+	imgPushFromFile string
+	imgPushFromOCI  string
+	imgPullToFile   string
+	imgPullToOCI    string
+	imgSignFromFile string
+
+	imgPushPlatform   string
+	imgPullPlatform   string
+	imgSignPlatform   string
+	imgDeletePlatform string
+
+	imgDiffJSON     bool
+	imgDiffPlatform string
+
+	imgComposeConcurrency int
+
+	imgCopyPlatform string
+	imgCopyUser     string
+	imgCopyPassword string
+	imgCopyInsecure bool
+
+	bundleImages []string
+	bundleFiles  []string
+	bundleOutput string
+
+	namespaceFlag string
+	promoteFrom   string
+	promoteTo     string
+)
+
 var rootCmd = &cobra.Command{
 	Use:   "unrg",
 	Short: "Unregistry client - A private file/image storage system",
@@ -29,21 +110,21 @@ var setTokenCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		token := args[0]
-		
+
 		cfg, err := config.LoadConfig()
 		if err != nil {
 			fmt.Printf("Error loading config: %v\n", err)
 			os.Exit(1)
 		}
-		
+
 		cfg.Token = token
-		
+
 		err = cfg.Save()
 		if err != nil {
 			fmt.Printf("Error saving config: %v\n", err)
 			os.Exit(1)
 		}
-		
+
 		fmt.Println("Token saved successfully")
 	},
 }
@@ -54,333 +135,2297 @@ var setURLCmd = &cobra.Command{
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		url := args[0]
-		
+
 		cfg, err := config.LoadConfig()
 		if err != nil {
 			fmt.Printf("Error loading config: %v\n", err)
 			os.Exit(1)
 		}
-		
+
 		cfg.BaseURL = url
-		
+
 		err = cfg.Save()
 		if err != nil {
 			fmt.Printf("Error saving config: %v\n", err)
 			os.Exit(1)
 		}
-		
+
 		fmt.Printf("Base URL set to: %s\n", url)
 	},
 }
 
-// File commands
-var fileCmd = &cobra.Command{
-	Use:   "file",
-	Short: "File operations",
+var setRuntimeCmd = &cobra.Command{
+	Use:   "set-runtime <docker|podman|nerdctl|file> [dir]",
+	Short: "Set the container runtime used by img push/pull",
+	Args:  cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		var dir string
+		if len(args) > 1 {
+			dir = args[1]
+		}
+
+		if _, err := container.New(args[0], dir); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		cfg, err := config.LoadConfig()
+		if err != nil {
+			fmt.Printf("Error loading config: %v\n", err)
+			os.Exit(1)
+		}
+
+		cfg.Runtime = args[0]
+		cfg.RuntimeDir = dir
+
+		err = cfg.Save()
+		if err != nil {
+			fmt.Printf("Error saving config: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Runtime set to: %s\n", args[0])
+	},
+}
+
+// File commands
+var fileCmd = &cobra.Command{
+	Use:   "file",
+	Short: "File operations",
+}
+
+var filePushCmd = &cobra.Command{
+	Use:   "push <filepath|-> [name]",
+	Short: "Upload a file",
+	Long: `Upload a file, under its base name unless a name is given. A filepath
+of - uploads standard input, which needs a name.
+
+With -r, upload every file under a directory, keeping their relative paths
+below the remote directory given as name:
+
+  unrg file push -r ./dist releases/1.2/
+
+With --extract, upload a zip or tar.gz and have the server unpack it into
+the remote directory given as name, replacing everything stored there:
+
+  unrg file push --extract site.zip docs/v2/
+
+--no-clobber refuses to replace a file that exists on the server, and
+--if-version only replaces the file while it has the given digest, so two
+jobs pushing the same name cannot silently overwrite each other. Pushing
+content the server already has is still skipped without an error:
+
+  unrg file push --no-clobber app-1.0.tar.gz releases/app-1.0.tar.gz
+  unrg file push --if-version sha256:9f86d08... latest.json
+
+An upload that is cut off, even by the client being killed, is resumed by
+running the same push again: unfinished uploads are recorded in
+~/.unrg/uploads, and only the part the server does not hold yet is sent.`,
+	Args: cobra.RangeArgs(1, 2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if filePushIfVersion != "" && (fileRecursive || filePushNoClobber) {
+			fmt.Println("Error: --if-version applies to a single file and cannot be combined with -r or --no-clobber")
+			os.Exit(1)
+		}
+		if filePushExtract {
+			if filePushNoClobber || filePushIfVersion != "" {
+				fmt.Println("Error: --extract cannot be combined with --no-clobber or --if-version")
+				os.Exit(1)
+			}
+			if fileRecursive || args[0] == "-" || len(args) < 2 {
+				fmt.Println("Error: --extract needs an archive file and a remote directory: file push --extract <archive> <dir>/")
+				os.Exit(1)
+			}
+			client, err := getClient()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			if err := client.UploadArchiveExtract(args[0], args[1], true); err != nil {
+				fmt.Printf("Upload failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("\n%s extracted into %s\n", args[0], displayPrefix(treePrefix(args[1])))
+			return
+		}
+
+		if fileRecursive {
+			if err := checkTreePatterns(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			client, err := getClient()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			var prefix string
+			if len(args) > 1 {
+				prefix = args[1]
+			}
+			pushTree(client, args[0], prefix)
+			return
+		}
+
+		filePath := args[0]
+		name := filepath.Base(filePath)
+		if len(args) > 1 {
+			name = args[1]
+		}
+		if filePath == "-" && len(args) < 2 {
+			fmt.Println("Error: pushing standard input needs a name: file push - <name>")
+			os.Exit(1)
+		}
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		cond := api.UploadCondition{NoClobber: filePushNoClobber, IfVersion: filePushIfVersion}
+		switch {
+		case filePath == "-":
+			progressReader := progress.NewReader(os.Stdin, -1, "Uploading "+name)
+			err = client.UploadFileStreamConditional(context.Background(), name, progressReader, cond)
+			progressReader.Close()
+		case filePushForce:
+			err = client.UploadFileConditional(filePath, name, cond, true)
+		default:
+			var uploaded bool
+			uploaded, err = client.UploadFileIfChangedConditional(filePath, name, cond, true)
+			if err == nil && !uploaded {
+				fmt.Printf("File %s is unchanged on the server, skipped\n", name)
+				return
+			}
+		}
+		if err != nil {
+			fmt.Printf("Upload failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("\nFile %s uploaded successfully\n", name)
+	},
+}
+
+var filePullCmd = &cobra.Command{
+	Use:   "pull <filename> [dest|-]",
+	Short: "Download a file",
+	Long: `Download a file, to dest or its own name. A dest of - writes the file
+to standard output.
+
+With -r, download every file under a remote directory into dest (default:
+the current directory), keeping their relative paths:
+
+  unrg file pull -r releases/1.2/ ./out
+
+With --archive, download any number of files and directories (ending in
+/) as a single zip or tar.gz, which the server builds on the fly:
+
+  unrg file pull --archive out.zip releases/1.2/ README.md`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if filePullArchive != "" {
+			return cobra.MinimumNArgs(1)(cmd, args)
+		}
+		return cobra.RangeArgs(1, 2)(cmd, args)
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if filePullArchive != "" {
+			if fileRecursive {
+				fmt.Println("Error: --archive cannot be combined with -r")
+				os.Exit(1)
+			}
+			pullArchive(args, filePullArchive)
+			return
+		}
+
+		if fileRecursive {
+			if err := checkTreePatterns(); err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			client, err := getClient()
+			if err != nil {
+				fmt.Printf("Error: %v\n", err)
+				os.Exit(1)
+			}
+			dir := "."
+			if len(args) > 1 {
+				dir = args[1]
+			}
+			client.Parallel = filePullParallel
+			pullTree(client, args[0], dir)
+			return
+		}
+
+		filename := args[0]
+		var dest string
+		if len(args) > 1 {
+			dest = args[1]
+		}
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if dest == "-" {
+			// Standard output carries the content, so messages go to stderr
+			if err := client.StreamFile(context.Background(), filename, os.Stdout, filePullExpect); err != nil {
+				fmt.Fprintf(os.Stderr, "Download failed: %v\n", err)
+				os.Exit(1)
+			}
+			return
+		}
+
+		client.Parallel = filePullParallel
+		if dest == "" {
+			dest = filename
+		}
+		if filePullForce {
+			err = client.DownloadFileVerified(filename, dest, filePullExpect, true)
+		} else {
+			var downloaded bool
+			downloaded, err = client.DownloadFileIfChanged(filename, dest, filePullExpect, true)
+			if err == nil && !downloaded {
+				fmt.Printf("%s is up to date, skipped\n", dest)
+				return
+			}
+		}
+		if err != nil {
+			fmt.Printf("Download failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("\nFile downloaded to: %s\n", dest)
+	},
+}
+
+// pullArchive downloads names, where those ending in / are directories,
+// as one archive at dest.
+func pullArchive(names []string, dest string) {
+	var files, prefixes []string
+	for _, name := range names {
+		if strings.HasSuffix(name, "/") {
+			prefixes = append(prefixes, treePrefix(name))
+		} else {
+			files = append(files, name)
+		}
+	}
+
+	client, err := getClient()
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	if err := client.DownloadArchive(files, prefixes, dest, true); err != nil {
+		fmt.Printf("Download failed: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("\nArchive downloaded to: %s\n", dest)
+}
+
+// treeFile is one file of a recursive transfer.
+type treeFile struct {
+	// name on the server
+	name string
+	// local path
+	local string
+}
+
+// treePrefix turns a remote directory argument into a name prefix:
+// "releases/1.2" and "releases/1.2/" both become "releases/1.2/".
+func treePrefix(prefix string) string {
+	prefix = strings.Trim(prefix, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+	return prefix
+}
+
+// treeSelected reports whether the file at rel, a slash-separated path
+// inside a recursive transfer, passes --include and --exclude. Patterns
+// are path.Match globs tried against the whole path and the file name.
+func treeSelected(rel string) bool {
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, rel); ok {
+				return true
+			}
+			if ok, _ := path.Match(pattern, path.Base(rel)); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(fileInclude) > 0 && !matches(fileInclude) {
+		return false
+	}
+	return !matches(fileExclude)
+}
+
+// checkTreePatterns rejects malformed --include and --exclude globs before
+// anything is transferred.
+func checkTreePatterns() error {
+	for _, pattern := range append(append([]string{}, fileInclude...), fileExclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// localTree returns the selected files under dir, named prefix plus their
+// slash-separated path relative to dir.
+func localTree(dir, prefix string) ([]treeFile, error) {
+	var files []treeFile
+	err := filepath.WalkDir(dir, func(local string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		// Follow links to files, skip anything else that is not one
+		if info, err := os.Stat(local); err != nil || !info.Mode().IsRegular() {
+			return nil
+		}
+
+		rel, err := filepath.Rel(dir, local)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if treeSelected(rel) {
+			files = append(files, treeFile{name: prefix + rel, local: local})
+		}
+		return nil
+	})
+	return files, err
+}
+
+// pushTree uploads every selected file under dir, keeping its path
+// relative to dir below the remote prefix.
+func pushTree(client *api.Client, dir, prefix string) {
+	prefix = treePrefix(prefix)
+
+	files, err := localTree(dir, prefix)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(files) == 0 {
+		fmt.Println("No files to transfer")
+		return
+	}
+
+	fmt.Printf("Pushing %d files from %s to %s\n", len(files), dir, displayPrefix(prefix))
+	cond := api.UploadCondition{NoClobber: filePushNoClobber}
+	result := transferTree(files, func(file treeFile) (int64, bool, error) {
+		info, err := os.Stat(file.local)
+		if err != nil {
+			return 0, false, err
+		}
+		if filePushForce {
+			return info.Size(), true, client.UploadFileConditional(file.local, file.name, cond, false)
+		}
+		uploaded, err := client.UploadFileIfChangedConditional(file.local, file.name, cond, false)
+		return info.Size(), uploaded, err
+	})
+	result.report("pushed")
+}
+
+// pullTree downloads every selected file under the remote prefix into dir,
+// keeping its path relative to the prefix.
+func pullTree(client *api.Client, prefix, dir string) {
+	prefix = treePrefix(prefix)
+
+	names, err := client.ListFilesPrefix(prefix)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	var files []treeFile
+	for _, name := range names {
+		rel := strings.TrimPrefix(name, prefix)
+		if !filepath.IsLocal(filepath.FromSlash(rel)) {
+			fmt.Printf("  skipping %s: not a relative path\n", name)
+			continue
+		}
+		if treeSelected(rel) {
+			files = append(files, treeFile{name: name, local: filepath.Join(dir, filepath.FromSlash(rel))})
+		}
+	}
+
+	if len(files) == 0 {
+		fmt.Println("No files to transfer")
+		return
+	}
+
+	fmt.Printf("Pulling %d files from %s to %s\n", len(files), displayPrefix(prefix), dir)
+	result := transferTree(files, func(file treeFile) (int64, bool, error) {
+		if err := os.MkdirAll(filepath.Dir(file.local), 0755); err != nil {
+			return 0, false, err
+		}
+
+		downloaded := true
+		var err error
+		if filePullForce {
+			err = client.DownloadFileVerified(file.name, file.local, "", false)
+		} else {
+			downloaded, err = client.DownloadFileIfChanged(file.name, file.local, "", false)
+		}
+		if err != nil {
+			return 0, false, err
+		}
+
+		info, err := os.Stat(file.local)
+		if err != nil {
+			return 0, false, err
+		}
+		return info.Size(), downloaded, nil
+	})
+	result.report("pulled")
+}
+
+func displayPrefix(prefix string) string {
+	if prefix == "" {
+		return "the top level"
+	}
+	return prefix
+}
+
+// treeResult sums up a recursive transfer.
+type treeResult struct {
+	transferred int
+	unchanged   int
+	bytes       int64
+	failed      []string
+	elapsed     time.Duration
+}
+
+// report prints the summary line for files transferred with verb and exits
+// non-zero if any failed.
+func (r treeResult) report(verb string) {
+	total := r.transferred + r.unchanged + len(r.failed)
+	fmt.Printf("%d of %d files %s (%d unchanged), %s transferred in %s\n", r.transferred+r.unchanged, total, verb, r.unchanged, progress.FormatBytes(r.bytes), r.elapsed.Round(time.Millisecond))
+	r.exitOnFailure()
+}
+
+func (r treeResult) exitOnFailure() {
+	if len(r.failed) > 0 {
+		sort.Strings(r.failed)
+		fmt.Printf("Failed: %s\n", strings.Join(r.failed, ", "))
+		os.Exit(1)
+	}
+}
+
+// transferTree runs transfer for every file, at most --concurrency at a
+// time. transfer returns the file size and whether anything had to be
+// sent. Failures are reported as they happen, everything else is left to
+// the summary.
+func transferTree(files []treeFile, transfer func(file treeFile) (int64, bool, error)) treeResult {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	start := time.Now()
+
+	// treeSent is what transfer reports for one file
+	type treeSent struct {
+		size    int64
+		changed bool
+	}
+	var result treeResult
+	runParallel(ctx, fileConcurrency, files, func(ctx context.Context, file treeFile) (treeSent, error) {
+		size, changed, err := transfer(file)
+		return treeSent{size, changed}, err
+	}, func(file treeFile, sent treeSent, err error) {
+		if err != nil {
+			result.failed = append(result.failed, file.name)
+			fmt.Printf("  %s failed: %s\n", file.name, strings.TrimSpace(err.Error()))
+			return
+		}
+		if sent.changed {
+			result.transferred++
+			result.bytes += sent.size
+		} else {
+			result.unchanged++
+		}
+	})
+
+	result.elapsed = time.Since(start)
+	return result
+}
+
+// runParallel calls fn for every item, at most n at a time, and hands each
+// result to done. Calls to done never overlap, so it may add up results and
+// print. Items that have not started when ctx is cancelled, and those that
+// fail because of it, end with an "interrupted" error.
+func runParallel[T, R any](ctx context.Context, n int, items []T, fn func(ctx context.Context, item T) (R, error), done func(item T, result R, err error)) {
+	if n < 1 {
+		n = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, n)
+	for _, item := range items {
+		wg.Add(1)
+		go func(item T) {
+			defer wg.Done()
+			slots <- struct{}{}
+			defer func() { <-slots }()
+
+			var result R
+			err := ctx.Err()
+			if err == nil {
+				result, err = fn(ctx, item)
+			}
+			if err != nil && ctx.Err() != nil {
+				err = errors.New("interrupted")
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+			done(item, result, err)
+		}(item)
+	}
+	wg.Wait()
+}
+
+var fileSyncCmd = &cobra.Command{
+	Use:   "sync <localdir> <remote-dir>",
+	Short: "Make a remote directory match a local one, or the reverse",
+	Long: `Transfer only the files that differ between a local directory and a
+remote directory, comparing sizes and then digests. The remote side may be
+written as unrg://<remote-dir>; putting it first syncs in the other
+direction:
+
+  unrg file sync ./assets assets/
+  unrg file sync unrg://assets/ ./assets
+
+--delete also removes files on the receiving side that the sending side
+does not have, and --dry-run only prints the plan.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := checkTreePatterns(); err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if remote, ok := strings.CutPrefix(args[0], "unrg://"); ok {
+			syncDown(client, treePrefix(remote), args[1])
+			return
+		}
+		syncUp(client, args[0], treePrefix(strings.TrimPrefix(args[1], "unrg://")))
+	},
+}
+
+// syncPlan is what a sync has to do.
+type syncPlan struct {
+	copy      []treeFile
+	delete    []treeFile
+	unchanged int
+}
+
+// print lists the plan, with verb naming the copies.
+func (p *syncPlan) print(verb string) {
+	for _, file := range p.copy {
+		fmt.Printf("  %s %s\n", verb, file.name)
+	}
+	for _, file := range p.delete {
+		fmt.Printf("  delete %s\n", file.name)
+	}
+}
+
+// differs reports whether the local file differs from the remote one
+// described by info: by size, or when the sizes match, by digest.
+func differs(local string, info *api.FileInfo) (bool, error) {
+	stat, err := os.Stat(local)
+	if os.IsNotExist(err) || info == nil {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if stat.Size() != info.Size {
+		return true, nil
+	}
+
+	digest, err := api.FileDigest(local)
+	if err != nil {
+		return false, err
+	}
+	return digest != info.Digest, nil
+}
+
+// syncUp makes the remote prefix match the local directory dir.
+func syncUp(client *api.Client, dir, prefix string) {
+	files, err := localTree(dir, prefix)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	remote, err := client.ListFileInfo(prefix)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	plan := &syncPlan{}
+	local := make(map[string]bool)
+	for _, file := range files {
+		local[file.name] = true
+		changed, err := differs(file.local, remote[file.name])
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if changed {
+			plan.copy = append(plan.copy, file)
+		} else {
+			plan.unchanged++
+		}
+	}
+	if syncDelete {
+		for name := range remote {
+			if !local[name] && treeSelected(strings.TrimPrefix(name, prefix)) {
+				plan.delete = append(plan.delete, treeFile{name: name})
+			}
+		}
+	}
+
+	runSync(plan, "upload", fmt.Sprintf("%s to %s", dir, displayPrefix(prefix)),
+		func(file treeFile) error {
+			return client.UploadFileAs(file.local, file.name, false)
+		},
+		func(file treeFile) error {
+			return client.DeleteFile(file.name)
+		})
+}
+
+// syncDown makes the local directory dir match the remote prefix.
+func syncDown(client *api.Client, prefix, dir string) {
+	remote, err := client.ListFileInfo(prefix)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	plan := &syncPlan{}
+	names := make(map[string]bool)
+	for name, info := range remote {
+		rel := filepath.FromSlash(strings.TrimPrefix(name, prefix))
+		if !filepath.IsLocal(rel) || !treeSelected(filepath.ToSlash(rel)) {
+			continue
+		}
+		names[name] = true
+
+		file := treeFile{name: name, local: filepath.Join(dir, rel)}
+		changed, err := differs(file.local, info)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		if changed {
+			plan.copy = append(plan.copy, file)
+		} else {
+			plan.unchanged++
+		}
+	}
+	if syncDelete {
+		files, err := localTree(dir, prefix)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, file := range files {
+			if !names[file.name] {
+				plan.delete = append(plan.delete, file)
+			}
+		}
+	}
+
+	runSync(plan, "download", fmt.Sprintf("%s to %s", displayPrefix(prefix), dir),
+		func(file treeFile) error {
+			if err := os.MkdirAll(filepath.Dir(file.local), 0755); err != nil {
+				return err
+			}
+			return client.DownloadFileVerified(file.name, file.local, "", false)
+		},
+		func(file treeFile) error {
+			return os.Remove(file.local)
+		})
+}
+
+// runSync prints the plan and, unless --dry-run, carries it out: copies at
+// most --concurrency at a time, then deletions. It ends with one summary
+// and exits non-zero if anything failed.
+func runSync(plan *syncPlan, verb, direction string, copyFile, deleteFile func(file treeFile) error) {
+	sort.Slice(plan.copy, func(i, j int) bool { return plan.copy[i].name < plan.copy[j].name })
+	sort.Slice(plan.delete, func(i, j int) bool { return plan.delete[i].name < plan.delete[j].name })
+
+	fmt.Printf("Syncing %s\n", direction)
+	plan.print(verb)
+	if syncDryRun {
+		fmt.Printf("Dry run: %d to %s, %d to delete, %d unchanged\n", len(plan.copy), verb, len(plan.delete), plan.unchanged)
+		return
+	}
+
+	result := transferTree(plan.copy, func(file treeFile) (int64, bool, error) {
+		if err := copyFile(file); err != nil {
+			return 0, false, err
+		}
+		info, err := os.Stat(file.local)
+		if err != nil {
+			return 0, true, nil
+		}
+		return info.Size(), true, nil
+	})
+
+	deleted := 0
+	for _, file := range plan.delete {
+		if err := deleteFile(file); err != nil {
+			result.failed = append(result.failed, file.name)
+			fmt.Printf("  %s failed: %s\n", file.name, strings.TrimSpace(err.Error()))
+			continue
+		}
+		deleted++
+	}
+
+	fmt.Printf("%d %sed (%s), %d unchanged, %d deleted in %s\n", result.transferred, verb, progress.FormatBytes(result.bytes), plan.unchanged, deleted, result.elapsed.Round(time.Millisecond))
+	result.exitOnFailure()
+}
+
+var fileListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all files",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		files, err := client.ListFiles()
+		if err != nil {
+			fmt.Printf("List failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		if len(files) == 0 {
+			fmt.Println("No files found")
+			return
+		}
+
+		fmt.Println("Files:")
+		for _, file := range files {
+			fmt.Printf("  %s\n", file)
+		}
+	},
+}
+
+var fileShareCmd = &cobra.Command{
+	Use:   "share <filename>",
+	Short: "Create a link that downloads a file without a token",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		share, err := client.ShareFile(args[0], fileShareExpires, fileShareMaxDownloads)
+		if err != nil {
+			fmt.Printf("Share failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		limit := "unlimited downloads"
+		if share.MaxDownloads > 0 {
+			limit = fmt.Sprintf("%d downloads", share.MaxDownloads)
+		}
+		fmt.Println(share.URL)
+		fmt.Printf("Link %s expires %s, %s\n", share.ID, share.Expires.Local().Format(time.RFC1123), limit)
+	},
+}
+
+var fileSharesCmd = &cobra.Command{
+	Use:   "shares",
+	Short: "List share links that still work",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		shares, err := client.ListShares()
+		if err != nil {
+			fmt.Printf("List failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		if len(shares) == 0 {
+			fmt.Println("No share links")
+			return
+		}
+
+		fmt.Println("Share links:")
+		for _, share := range shares {
+			downloads := fmt.Sprintf("%d", share.Downloads)
+			if share.MaxDownloads > 0 {
+				downloads = fmt.Sprintf("%d/%d", share.Downloads, share.MaxDownloads)
+			}
+			fmt.Printf("  %s  %s  expires %s, %s downloads\n", share.ID, share.Name, share.Expires.Local().Format(time.RFC1123), downloads)
+		}
+	},
+}
+
+var fileUnshareCmd = &cobra.Command{
+	Use:   "unshare <link-id>",
+	Short: "Revoke a share link",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := client.RevokeShare(args[0]); err != nil {
+			fmt.Printf("Revoke failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Share link %s revoked\n", args[0])
+	},
+}
+
+var fileDeleteCmd = &cobra.Command{
+	Use:   "delete <filename>",
+	Short: "Delete a file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		filename := args[0]
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		err = client.DeleteFile(filename)
+		if err != nil {
+			fmt.Printf("Delete failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("File %s deleted successfully\n", filename)
+	},
+}
+
+var fileCopyCmd = &cobra.Command{
+	Use:   "cp <src> <dst>",
+	Short: "Copy a file on the server",
+	Long: `Copy a file on the server, without downloading it. A dst ending in /
+is a directory to copy into. An existing dst is only replaced with --force.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		src, dst := args[0], relocateTarget(args[0], args[1])
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := client.CopyFile(src, dst, fileRelocateForce); err != nil {
+			fmt.Printf("Copy failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("File %s copied to %s\n", src, dst)
+	},
+}
+
+var fileMoveCmd = &cobra.Command{
+	Use:   "mv <src> <dst>",
+	Short: "Move or rename a file on the server",
+	Long: `Move or rename a file on the server. A dst ending in / is a directory
+to move into. An existing dst is only replaced with --force.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		src, dst := args[0], relocateTarget(args[0], args[1])
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if err := client.MoveFile(src, dst, fileRelocateForce); err != nil {
+			fmt.Printf("Move failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("File %s moved to %s\n", src, dst)
+	},
+}
+
+// relocateTarget resolves the dst of cp and mv: a directory, written with
+// a trailing /, receives src under its base name.
+func relocateTarget(src, dst string) string {
+	if strings.HasSuffix(dst, "/") {
+		return treePrefix(dst) + path.Base(src)
+	}
+	return dst
+}
+
+// Image commands
+var imgCmd = &cobra.Command{
+	Use:   "img",
+	Short: "Docker image operations",
+}
+
+var imgPushCmd = &cobra.Command{
+	Use:   "push <docker_image>",
+	Short: "Push a Docker image",
+	Long: `Push an image from the container runtime, a docker save tarball or an
+OCI layout.
+
+A push that is cut off, even by the client being killed, is resumed by
+running the same push again: unfinished uploads are recorded in
+~/.unrg/uploads, and the image is read again but only the part the server
+does not hold yet is sent. The digest checked at the end catches an image
+that changed in between; that push fails and the next one starts over.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dockerImage := args[0]
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		source, from, err := pushSource(dockerImage)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		var key ed25519.PrivateKey
+		if imgPushKey != "" {
+			key, err = sign.LoadPrivateKey(imgPushKey)
+			if err != nil {
+				fmt.Printf("Failed to load signing key: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		fmt.Printf("Pushing image from %s...\n", from)
+		_, err = pushImage(ctx, client, dockerImage, imgPushPlatform, source, key, true)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = errors.New("interrupted")
+			}
+			stop()
+			fmt.Printf("\nPush failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("\nImage %s pushed successfully\n", dockerImage)
+	},
+}
+
+var imgPullCmd = &cobra.Command{
+	Use:   "pull <docker_image>",
+	Short: "Pull a Docker image",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dockerImage := args[0]
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		sink, err := pullSink(dockerImage)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		var pub ed25519.PublicKey
+		if imgPullVerify {
+			if imgPullPubKey == "" {
+				fmt.Println("--verify requires --pubkey")
+				os.Exit(1)
+			}
+			pub, err = sign.LoadPublicKey(imgPullPubKey)
+			if err != nil {
+				fmt.Printf("Failed to load public key: %v\n", err)
+				os.Exit(1)
+			}
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		_, err = pullImage(ctx, client, dockerImage, imgPullPlatform, sink, pub, true)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = errors.New("interrupted")
+			}
+			stop()
+			fmt.Printf("\nPull failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("\nImage %s pulled successfully\n", dockerImage)
+	},
+}
+
+var imgPushComposeCmd = &cobra.Command{
+	Use:   "push-compose <compose-file>",
+	Short: "Push every image referenced by a docker compose file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		rt, err := getRuntime()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		transferCompose(args[0], "push", func(ctx context.Context, dockerImage string) (int64, error) {
+			source := func(ctx context.Context, w io.Writer) error {
+				return rt.Save(ctx, dockerImage, w)
+			}
+			return pushImage(ctx, client, dockerImage, "", source, nil, false)
+		})
+	},
+}
+
+var imgPullComposeCmd = &cobra.Command{
+	Use:   "pull-compose <compose-file>",
+	Short: "Pull and load every image referenced by a docker compose file",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		rt, err := getRuntime()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		transferCompose(args[0], "pull", func(ctx context.Context, dockerImage string) (int64, error) {
+			sink := func(ctx context.Context, r io.Reader) error {
+				return rt.Load(ctx, dockerImage, r)
+			}
+			return pullImage(ctx, client, dockerImage, defaultPlatform(), sink, nil, false)
+		})
+	},
+}
+
+// transferCompose runs transfer for every image of a compose file, at most
+// --concurrency at a time, reports each image as it finishes and ends with
+// a summary. It exits non-zero if any image failed.
+func transferCompose(composeFile, verb string, transfer func(ctx context.Context, dockerImage string) (int64, error)) {
+	file, err := compose.Load(composeFile)
+	if err != nil {
+		fmt.Printf("Error: %v\n", err)
+		os.Exit(1)
+	}
+	images := file.Images()
+	if len(images) == 0 {
+		fmt.Printf("No images referenced by %s\n", composeFile)
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	concurrency := imgComposeConcurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	// verb is "push" or "pull"
+	fmt.Printf("%sing %d images (%d at a time)...\n", strings.ToUpper(verb[:1])+verb[1:], len(images), concurrency)
+	start := time.Now()
+
+	var total int64
+	var failed []string
+	runParallel(ctx, concurrency, images, transfer, func(dockerImage string, size int64, err error) {
+		if err != nil {
+			failed = append(failed, dockerImage)
+			fmt.Printf("  %s failed: %s\n", dockerImage, strings.TrimSpace(err.Error()))
+			return
+		}
+		total += size
+		fmt.Printf("  %s (%s)\n", dockerImage, progress.FormatBytes(size))
+	})
+
+	fmt.Printf("\n%d of %d images %sed, %s transferred in %s\n", len(images)-len(failed), len(images), verb, progress.FormatBytes(total), time.Since(start).Round(time.Second))
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		fmt.Printf("Failed: %s\n", strings.Join(failed, ", "))
+		os.Exit(1)
+	}
+}
+
+// imageSource writes an image as an uncompressed docker-save archive.
+type imageSource func(ctx context.Context, w io.Writer) error
+
+// imageSink consumes an uncompressed docker-save archive.
+type imageSink func(ctx context.Context, r io.Reader) error
+
+// pushSource picks where img push reads the image from: a local archive,
+// an OCI layout or the container runtime. Archives are validated up front.
+func pushSource(dockerImage string) (imageSource, string, error) {
+	switch {
+	case imgPushFromFile != "" && imgPushFromOCI != "":
+		return nil, "", errors.New("--from-file and --from-oci-layout are mutually exclusive")
+
+	case imgPushFromFile != "":
+		source, err := archiveSource(imgPushFromFile)
+		return source, imgPushFromFile, err
+
+	case imgPushFromOCI != "":
+		if _, _, err := imgarchive.LoadOCILayout(imgPushFromOCI, dockerImage, imgPushPlatform); err != nil {
+			return nil, "", fmt.Errorf("invalid OCI layout: %w", err)
+		}
+		source := func(ctx context.Context, w io.Writer) error {
+			return imgarchive.FromOCILayout(imgPushFromOCI, dockerImage, imgPushPlatform, w)
+		}
+		return source, imgPushFromOCI, nil
+	}
+
+	rt, err := getRuntime()
+	if err != nil {
+		return nil, "", err
+	}
+	source := func(ctx context.Context, w io.Writer) error {
+		return rt.Save(ctx, dockerImage, w)
+	}
+	return source, rt.Name(), nil
+}
+
+// archiveSource reads an image from a docker save tarball, gzipped or not,
+// after checking that it is one.
+func archiveSource(path string) (imageSource, error) {
+	if err := validateArchiveFile(path); err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, w io.Writer) error {
+		archive, err := openArchiveFile(path)
+		if err != nil {
+			return err
+		}
+		defer archive.Close()
+
+		_, err = io.Copy(w, archive)
+		return err
+	}, nil
+}
+
+// pullSink picks where img pull puts the image: a local archive, an OCI
+// layout or the container runtime.
+func pullSink(dockerImage string) (imageSink, error) {
+	switch {
+	case imgPullToFile != "" && imgPullToOCI != "":
+		return nil, errors.New("--to-file and --to-oci-layout are mutually exclusive")
+
+	case imgPullToFile != "":
+		return func(ctx context.Context, r io.Reader) error {
+			return writeFileAtomic(imgPullToFile, r)
+		}, nil
+
+	case imgPullToOCI != "":
+		entries, err := os.ReadDir(imgPullToOCI)
+		if err == nil && len(entries) > 0 {
+			return nil, fmt.Errorf("%s is not empty", imgPullToOCI)
+		}
+		return func(ctx context.Context, r io.Reader) error {
+			if err := os.MkdirAll(imgPullToOCI, 0755); err != nil {
+				return err
+			}
+			return imgarchive.ToOCILayout(r, imgPullToOCI)
+		}, nil
+	}
+
+	rt, err := getRuntime()
+	if err != nil {
+		return nil, err
+	}
+	return func(ctx context.Context, r io.Reader) error {
+		return rt.Load(ctx, dockerImage, r)
+	}, nil
+}
+
+// openArchiveFile opens a docker-save tarball, decompressing it if it is
+// gzipped.
+func openArchiveFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	br := bufio.NewReader(file)
+	magic, _ := br.Peek(2)
+	if len(magic) < 2 || magic[0] != 0x1f || magic[1] != 0x8b {
+		return struct {
+			io.Reader
+			io.Closer
+		}{br, file}, nil
+	}
+
+	gz, err := gzip.NewReader(br)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("decompress %s: %w", path, err)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{gz, file}, nil
+}
+
+func validateArchiveFile(path string) error {
+	archive, err := openArchiveFile(path)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	a, err := imgarchive.Read(archive)
+	if err != nil {
+		return fmt.Errorf("invalid image archive %s: %w", path, err)
+	}
+	if err := a.Validate(); err != nil {
+		return fmt.Errorf("invalid image archive %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes r to path through a temp file in the same
+// directory, so a failed transfer never leaves a truncated file behind.
+func writeFileAtomic(path string, r io.Reader) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	if _, err := io.Copy(tmp, r); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// pushImage streams the saved image through gzip straight into the
+// upload, without touching the disk, and returns the number of bytes sent.
+func pushImage(ctx context.Context, client *api.Client, dockerImage, platform string, source imageSource, key ed25519.PrivateKey, showProgress bool) (int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	pipeReader, pipeWriter := io.Pipe()
+	saveDone := make(chan error, 1)
+	go func() {
+		err := compressImage(ctx, source, pipeWriter)
+		saveDone <- err
+		pipeWriter.CloseWithError(err)
+	}()
+
+	counter := &countingReader{Reader: pipeReader}
+	err := client.UploadImageStream(ctx, imageName(dockerImage), platform, counter, key, showProgress)
+
+	select {
+	case saveErr := <-saveDone:
+		if saveErr != nil {
+			return 0, fmt.Errorf("save image: %w", saveErr)
+		}
+	default:
+		// The upload gave up first: stop the runtime and wait for it to exit
+		cancel()
+		pipeReader.Close()
+		<-saveDone
+	}
+	return counter.n, err
+}
+
+// compressImage writes the image from source gzipped, the way it is
+// stored on the server. img sign relies on it producing the same bytes a
+// push of the same image did.
+func compressImage(ctx context.Context, source imageSource, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	if err := source(ctx, gz); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// pullImage streams the download through gunzip into the sink and returns
+// the number of bytes transferred. With a public key the archive is spooled
+// to a private temp file first so the signature is verified before
+// anything is loaded.
+func pullImage(ctx context.Context, client *api.Client, dockerImage, platform string, sink imageSink, pub ed25519.PublicKey, showProgress bool) (int64, error) {
+	name := imageName(dockerImage)
+
+	var sig *sign.Signature
+	if pub != nil {
+		var err error
+		sig, err = client.GetImageSignature(name, platform)
+		if err != nil {
+			return 0, fmt.Errorf("verify: %w", err)
+		}
+	}
+
+	body, size, err := client.OpenImage(ctx, name, platform)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	var src io.Reader = body
+	if showProgress {
+		progressReader := progress.NewReader(body, size, "Downloading "+dockerImage)
+		defer progressReader.Close()
+		src = progressReader
+	}
+
+	if pub != nil {
+		spool, err := os.CreateTemp("", "unrg-pull-*.tar.gz")
+		if err != nil {
+			return 0, fmt.Errorf("create temp file: %w", err)
+		}
+		defer os.Remove(spool.Name())
+		defer spool.Close()
+
+		hash := sha256.New()
+		if _, err := io.Copy(io.MultiWriter(spool, hash), src); err != nil {
+			return 0, fmt.Errorf("download image: %w", err)
+		}
+
+		if err := sign.Verify(pub, "sha256:"+hex.EncodeToString(hash.Sum(nil)), sig); err != nil {
+			return 0, fmt.Errorf("verify: %w", err)
+		}
+		fmt.Printf("\nSignature verified (key %s)\n", sign.KeyID(pub))
+
+		if _, err := spool.Seek(0, io.SeekStart); err != nil {
+			return 0, fmt.Errorf("rewind image: %w", err)
+		}
+		src = spool
+	}
+
+	gz, err := gzip.NewReader(src)
+	if err != nil {
+		return 0, fmt.Errorf("decompress image: %w", err)
+	}
+	defer gz.Close()
+
+	if err := sink(ctx, gz); err != nil {
+		return 0, err
+	}
+	return size, nil
+}
+
+var imgListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List all images",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		images, platforms, err := client.ListImagePlatforms()
+		if err != nil {
+			fmt.Printf("List failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		if len(images) == 0 {
+			fmt.Println("No images found")
+			return
+		}
+
+		fmt.Println("Images:")
+		for _, image := range images {
+			if len(platforms[image]) > 0 {
+				fmt.Printf("  %s [%s]\n", image, strings.Join(platforms[image], ", "))
+				continue
+			}
+			fmt.Printf("  %s\n", image)
+		}
+	},
+}
+
+var imgDeleteCmd = &cobra.Command{
+	Use:   "delete <name>",
+	Short: "Delete an image",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		imageName := args[0]
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		if imgDeletePlatform != "" {
+			err = client.DeleteImageVariant(imageName, imgDeletePlatform)
+		} else {
+			err = client.DeleteImage(imageName)
+		}
+		if err != nil {
+			fmt.Printf("Delete failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Image %s deleted successfully\n", imageName)
+	},
+}
+
+var imgPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete images according to the server retention policy",
+	Run: func(cmd *cobra.Command, args []string) {
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		deleted, err := client.PruneImages(imgPruneDry)
+		if err != nil {
+			fmt.Printf("Prune failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		if len(deleted) == 0 {
+			fmt.Println("Nothing to prune")
+			return
+		}
+
+		if imgPruneDry {
+			fmt.Println("Would delete:")
+		} else {
+			fmt.Println("Deleted:")
+		}
+		for _, name := range deleted {
+			fmt.Printf("  %s\n", name)
+		}
+	},
+}
+
+var imgSignCmd = &cobra.Command{
+	Use:   "sign <docker_image>",
+	Short: "Sign an image stored on the server",
+	Long: `Sign an image already on the server. The signature covers the image as
+you have it, read from the container runtime or from --from-file, not what
+the server reports: the image is hashed locally and only signed when the
+server stores exactly the same content. An image pushed from an OCI
+layout can only be signed while pushing (img push --key).`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		dockerImage := args[0]
+		name := imageName(dockerImage)
+
+		if imgSignKey == "" {
+			fmt.Println("--key is required")
+			os.Exit(1)
+		}
+
+		priv, err := sign.LoadPrivateKey(imgSignKey)
+		if err != nil {
+			fmt.Printf("Failed to load signing key: %v\n", err)
+			os.Exit(1)
+		}
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		source, from, err := signSource(dockerImage)
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
+			os.Exit(1)
+		}
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		fmt.Printf("Hashing image from %s...\n", from)
+		hash := sha256.New()
+		if err := compressImage(ctx, source, hash); err != nil {
+			fmt.Printf("Sign failed: read image: %v\n", err)
+			os.Exit(1)
+		}
+		digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+
+		info, err := client.GetImageInfo(name, imgSignPlatform)
+		if err != nil {
+			fmt.Printf("Sign failed: %v\n", err)
+			os.Exit(1)
+		}
+		if info.Digest != digest {
+			fmt.Printf("Sign failed: the server stores %s, but the image from %s is %s\n", info.Digest, from, digest)
+			os.Exit(1)
+		}
+
+		err = client.PutImageSignature(name, imgSignPlatform, sign.Sign(priv, digest))
+		if err != nil {
+			fmt.Printf("Sign failed: %v\n", err)
+			os.Exit(1)
+		}
+
+		fmt.Printf("Image %s (%s) signed successfully\n", name, digest)
+	},
+}
+
+// signSource picks where img sign reads the image it vouches for: a local
+// archive or the container runtime.
+func signSource(dockerImage string) (imageSource, string, error) {
+	if imgSignFromFile != "" {
+		source, err := archiveSource(imgSignFromFile)
+		return source, imgSignFromFile, err
+	}
+
+	rt, err := getRuntime()
+	if err != nil {
+		return nil, "", err
+	}
+	source := func(ctx context.Context, w io.Writer) error {
+		return rt.Save(ctx, dockerImage, w)
+	}
+	return source, rt.Name(), nil
 }
 
-var filePushCmd = &cobra.Command{
-	Use:   "push <filepath>",
-	Short: "Upload a file",
-	Args:  cobra.ExactArgs(1),
+var imgDiffCmd = &cobra.Command{
+	Use:   "diff <image-a> <image-b>",
+	Short: "Show what changed between two images stored on the server",
+	Args:  cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		filePath := args[0]
-		
 		client, err := getClient()
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		err = client.UploadFileWithProgress(filePath, true)
+
+		diff, err := client.DiffImages(imageName(args[0]), imageName(args[1]), imgDiffPlatform)
 		if err != nil {
-			fmt.Printf("Upload failed: %v\n", err)
+			fmt.Printf("Diff failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		fmt.Printf("\nFile %s uploaded successfully\n", filepath.Base(filePath))
+
+		if imgDiffJSON {
+			encoder := json.NewEncoder(os.Stdout)
+			encoder.SetIndent("", "  ")
+			encoder.Encode(diff)
+			return
+		}
+
+		printImageDiff(diff)
 	},
 }
 
-var filePullCmd = &cobra.Command{
-	Use:   "pull <filename> [dest]",
-	Short: "Download a file",
-	Args:  cobra.RangeArgs(1, 2),
-	Run: func(cmd *cobra.Command, args []string) {
-		filename := args[0]
-		var dest string
-		if len(args) > 1 {
-			dest = args[1]
+// printImageDiff prints a diff as "+" added, "-" removed and "~" changed lines.
+func printImageDiff(diff *imgarchive.Diff) {
+	if diff.Empty() {
+		fmt.Println("Images are identical")
+		return
+	}
+
+	if len(diff.Config) > 0 {
+		fmt.Println("Config:")
+		for _, change := range diff.Config {
+			switch {
+			case change.Old == "":
+				fmt.Printf("  + %s: %s\n", change.Field, change.New)
+			case change.New == "":
+				fmt.Printf("  - %s: %s\n", change.Field, change.Old)
+			default:
+				fmt.Printf("  ~ %s: %s -> %s\n", change.Field, change.Old, change.New)
+			}
 		}
-		
-		client, err := getClient()
-		if err != nil {
-			fmt.Printf("Error: %v\n", err)
-			os.Exit(1)
+	}
+
+	if len(diff.LayersAdded) > 0 || len(diff.LayersRemoved) > 0 {
+		fmt.Println("Layers:")
+		for _, layer := range diff.LayersRemoved {
+			fmt.Printf("  - %s\n", layer)
 		}
-		
-		err = client.DownloadFileWithProgress(filename, dest, true)
-		if err != nil {
-			fmt.Printf("Download failed: %v\n", err)
-			os.Exit(1)
+		for _, layer := range diff.LayersAdded {
+			fmt.Printf("  + %s\n", layer)
 		}
-		
-		if dest == "" {
-			dest = filename
+	}
+
+	if len(diff.FilesAdded) > 0 || len(diff.FilesRemoved) > 0 || len(diff.FilesModified) > 0 {
+		fmt.Printf("Files (%d added, %d removed, %d modified):\n", len(diff.FilesAdded), len(diff.FilesRemoved), len(diff.FilesModified))
+		for _, name := range diff.FilesRemoved {
+			fmt.Printf("  - %s\n", name)
 		}
-		fmt.Printf("\nFile downloaded to: %s\n", dest)
-	},
+		for _, name := range diff.FilesAdded {
+			fmt.Printf("  + %s\n", name)
+		}
+		for _, name := range diff.FilesModified {
+			fmt.Printf("  ~ %s\n", name)
+		}
+	}
 }
 
-var fileListCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List all files",
+var imgCopyCmd = &cobra.Command{
+	Use:   "copy <src> <dst>",
+	Short: "Copy an image between unregistry and an OCI registry",
+	Long: `Copy an image between this server and a registry speaking the OCI
+distribution (registry v2) API, in either direction:
+
+  unrg img copy unrg://api:1.4 registry://localhost:5000/api:1.4
+  unrg img copy registry://ghcr.io/acme/api:1.4 unrg://api:1.4
+
+Credentials for the registry come from --registry-user and
+--registry-password (or UNRG_REGISTRY_USER / UNRG_REGISTRY_PASSWORD).
+Registries on localhost are spoken to over plain HTTP, others only with
+--insecure.`,
+	Args: cobra.ExactArgs(2),
 	Run: func(cmd *cobra.Command, args []string) {
-		client, err := getClient()
+		srcKind, src, err := parseCopyLocation(args[0])
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		files, err := client.ListFiles()
+		dstKind, dst, err := parseCopyLocation(args[1])
 		if err != nil {
-			fmt.Printf("List failed: %v\n", err)
+			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		if len(files) == 0 {
-			fmt.Println("No files found")
-			return
-		}
-		
-		fmt.Println("Files:")
-		for _, file := range files {
-			fmt.Printf("  %s\n", file)
+		if srcKind == dstKind {
+			fmt.Println("Error: copy goes from unrg:// to registry:// or back")
+			os.Exit(1)
 		}
-	},
-}
 
-var fileDeleteCmd = &cobra.Command{
-	Use:   "delete <filename>",
-	Short: "Delete a file",
-	Args:  cobra.ExactArgs(1),
-	Run: func(cmd *cobra.Command, args []string) {
-		filename := args[0]
-		
 		client, err := getClient()
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		err = client.DeleteFile(filename)
+
+		user := imgCopyUser
+		if user == "" {
+			user = os.Getenv("UNRG_REGISTRY_USER")
+		}
+		password := imgCopyPassword
+		if password == "" {
+			password = os.Getenv("UNRG_REGISTRY_PASSWORD")
+		}
+		reg := registry.NewClient(user, password, imgCopyInsecure)
+
+		ctx := context.Background()
+		start := time.Now()
+		if srcKind == "unrg" {
+			digest, n, err := copyToRegistry(ctx, client, reg, src, dst)
+			if err != nil {
+				fmt.Printf("Copy failed: %v\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("Copied %s to %s (%s, %s) in %s\n", args[0], args[1], digest, progress.FormatBytes(n), time.Since(start).Round(time.Millisecond))
+			return
+		}
+
+		platform, n, err := copyFromRegistry(ctx, client, reg, src, dst)
 		if err != nil {
-			fmt.Printf("Delete failed: %v\n", err)
+			fmt.Printf("Copy failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		fmt.Printf("File %s deleted successfully\n", filename)
+		if platform != "" {
+			fmt.Printf("Copied %s (%s) to %s (%s) in %s\n", args[0], platform, args[1], progress.FormatBytes(n), time.Since(start).Round(time.Millisecond))
+		} else {
+			fmt.Printf("Copied %s to %s (%s) in %s\n", args[0], args[1], progress.FormatBytes(n), time.Since(start).Round(time.Millisecond))
+		}
 	},
 }
 
-// Image commands
-var imgCmd = &cobra.Command{
-	Use:   "img",
-	Short: "Docker image operations",
+// parseCopyLocation splits an img copy argument into its scheme ("unrg" or
+// "registry") and image reference.
+func parseCopyLocation(location string) (string, string, error) {
+	kind, ref, ok := strings.Cut(location, "://")
+	if !ok || (kind != "unrg" && kind != "registry") || ref == "" {
+		return "", "", fmt.Errorf("%q is neither unrg://<image> nor registry://<host>/<image>", location)
+	}
+	return kind, ref, nil
 }
 
-var imgPushCmd = &cobra.Command{
-	Use:   "push <docker_image>",
-	Short: "Push a Docker image",
+// copyToRegistry downloads an image from the server and pushes it to a
+// registry. The archive is extracted to a temp directory since layers are
+// uploaded one blob at a time.
+func copyToRegistry(ctx context.Context, client *api.Client, reg *registry.Client, image, target string) (string, int64, error) {
+	ref, err := registry.ParseReference(target)
+	if err != nil {
+		return "", 0, err
+	}
+
+	dir, err := os.MkdirTemp("", "unrg-copy-*")
+	if err != nil {
+		return "", 0, fmt.Errorf("create temp dir: %w", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var digest string
+	n, err := pullImage(ctx, client, image, imgCopyPlatform, func(ctx context.Context, r io.Reader) error {
+		digest, err = reg.PushArchive(ctx, ref, r, dir)
+		return err
+	}, nil, false)
+	return digest, n, err
+}
+
+// copyFromRegistry streams an image from a registry into the server
+// without touching the disk. A build picked from a multi-platform index is
+// stored as that platform's variant.
+func copyFromRegistry(ctx context.Context, client *api.Client, reg *registry.Client, source, image string) (string, int64, error) {
+	ref, err := registry.ParseReference(source)
+	if err != nil {
+		return "", 0, err
+	}
+
+	img, err := reg.Resolve(ctx, ref, imgCopyPlatform)
+	if err != nil {
+		return "", 0, err
+	}
+
+	n, err := pushImage(ctx, client, image, img.Platform, func(ctx context.Context, w io.Writer) error {
+		return reg.WriteArchive(ctx, ref, img, image, w)
+	}, nil, false)
+	return img.Platform, n, err
+}
+
+var imgKeygenCmd = &cobra.Command{
+	Use:   "keygen <name>",
+	Short: "Generate an ed25519 signing key pair (<name>.key, <name>.pub)",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		dockerImage := args[0]
-		
-		client, err := getClient()
+		privPath := args[0] + ".key"
+		pubPath := args[0] + ".pub"
+
+		err := sign.GenerateKey(privPath, pubPath)
 		if err != nil {
-			fmt.Printf("Error: %v\n", err)
+			fmt.Printf("Keygen failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		// Create temporary file for docker save
-		tempFile := fmt.Sprintf("/tmp/%s.tar.gz", strings.ReplaceAll(dockerImage, "/", "_"))
-		defer os.Remove(tempFile)
-		
-		fmt.Println("Preparing Docker image...")
-		saveCmd := exec.Command("docker", "save", dockerImage)
-		gzipCmd := exec.Command("gzip")
-		
-		// Pipe docker save output to gzip
-		gzipCmd.Stdin, _ = saveCmd.StdoutPipe()
-		
-		// Create output file
-		outFile, err := os.Create(tempFile)
-		if err != nil {
-			fmt.Printf("Failed to create temp file: %v\n", err)
+
+		fmt.Printf("Private key written to %s\nPublic key written to %s\n", privPath, pubPath)
+	},
+}
+
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Move images and files between servers through a single archive",
+}
+
+var bundleCreateCmd = &cobra.Command{
+	Use:   "create",
+	Short: "Download images and files into a bundle",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(bundleImages) == 0 && len(bundleFiles) == 0 {
+			fmt.Println("Nothing to bundle: pass --images and/or --files")
 			os.Exit(1)
 		}
-		defer outFile.Close()
-		
-		gzipCmd.Stdout = outFile
-		
-		// Start gzip first, then docker save
-		if err := gzipCmd.Start(); err != nil {
-			fmt.Printf("Failed to start gzip: %v\n", err)
+		if bundleOutput == "" {
+			fmt.Println("--output is required")
 			os.Exit(1)
 		}
-		
-		if err := saveCmd.Run(); err != nil {
-			fmt.Printf("Docker save failed: %v\n", err)
+
+		client, err := getClient()
+		if err != nil {
+			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		if err := gzipCmd.Wait(); err != nil {
-			fmt.Printf("Gzip failed: %v\n", err)
+
+		manifest, err := bundleManifest(client, bundleImages, bundleFiles)
+		if err != nil {
+			fmt.Printf("Bundle failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		err = client.UploadImageWithProgress(tempFile, true)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		err = writeBundle(ctx, client, manifest, bundleOutput)
 		if err != nil {
-			fmt.Printf("Upload failed: %v\n", err)
+			if ctx.Err() != nil {
+				err = errors.New("interrupted")
+			}
+			stop()
+			fmt.Printf("Bundle failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		fmt.Printf("\nImage %s pushed successfully\n", dockerImage)
+
+		var total int64
+		for _, entry := range manifest.Entries {
+			total += entry.Size
+		}
+		fmt.Printf("Bundle %s written: %d entries, %s\n", bundleOutput, len(manifest.Entries), progress.FormatBytes(total))
 	},
 }
 
-var imgPullCmd = &cobra.Command{
-	Use:   "pull <docker_image>",
-	Short: "Pull a Docker image",
+var bundleImportCmd = &cobra.Command{
+	Use:   "import <bundle>",
+	Short: "Upload the images and files of a bundle",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		dockerImage := args[0]
-		
 		client, err := getClient()
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		// Create temporary file
-		tempFile := fmt.Sprintf("/tmp/%s.tar.gz", strings.ReplaceAll(dockerImage, "/", "_"))
-		defer os.Remove(tempFile)
-		
-		err = client.DownloadImageWithProgress(dockerImage, tempFile, true)
+
+		file, err := os.Open(args[0])
 		if err != nil {
-			fmt.Printf("Download failed: %v\n", err)
+			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		fmt.Println("Loading Docker image...")
-		loadCmd := exec.Command("docker", "load")
-		
-		// Open compressed file and decompress
-		gzipCmd := exec.Command("gunzip", "-c", tempFile)
-		loadCmd.Stdin, _ = gzipCmd.StdoutPipe()
-		
-		if err := loadCmd.Start(); err != nil {
-			fmt.Printf("Failed to start docker load: %v\n", err)
+		defer file.Close()
+
+		// Check the whole bundle first so a damaged one uploads nothing
+		manifest, err := bundle.Verify(file)
+		if err != nil {
+			fmt.Printf("Bundle verification failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		if err := gzipCmd.Run(); err != nil {
-			fmt.Printf("Gunzip failed: %v\n", err)
+		fmt.Printf("Verified %d entries\n", len(manifest.Entries))
+
+		if _, err := file.Seek(0, io.SeekStart); err != nil {
+			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		if err := loadCmd.Wait(); err != nil {
-			fmt.Printf("Docker load failed: %v\n", err)
+
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+
+		imported, skipped, err := importBundle(ctx, client, file)
+		if err != nil {
+			if ctx.Err() != nil {
+				err = errors.New("interrupted")
+			}
+			stop()
+			fmt.Printf("Import failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		fmt.Printf("\nImage %s pulled successfully\n", dockerImage)
+
+		fmt.Printf("Imported %d entries, skipped %d already present\n", imported, skipped)
 	},
 }
 
-var imgListCmd = &cobra.Command{
-	Use:   "list",
-	Short: "List all images",
+// bundleManifest looks up the digest and size of everything to bundle.
+// Multi-platform images contribute one entry per platform.
+func bundleManifest(client *api.Client, images, files []string) (*bundle.Manifest, error) {
+	manifest := &bundle.Manifest{Version: 1, Created: time.Now().UTC()}
+
+	if len(images) > 0 {
+		_, platforms, err := client.ListImagePlatforms()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, dockerImage := range images {
+			name := imageName(dockerImage)
+			builds := platforms[name]
+			if len(builds) == 0 {
+				builds = []string{""}
+			}
+
+			for _, platform := range builds {
+				info, err := client.GetImageInfo(name, platform)
+				if err != nil {
+					return nil, fmt.Errorf("image %s: %w", dockerImage, err)
+				}
+
+				entry := bundle.Entry{
+					Kind:     bundle.KindImage,
+					Name:     name,
+					Platform: platform,
+					Path:     bundle.EntryPath(bundle.KindImage, name, platform),
+					Digest:   info.Digest,
+					Size:     info.Size,
+				}
+				if info.Signed {
+					entry.Signature, err = client.GetImageSignature(name, platform)
+					if err != nil {
+						return nil, fmt.Errorf("image %s: %w", dockerImage, err)
+					}
+				}
+				manifest.Entries = append(manifest.Entries, entry)
+			}
+		}
+	}
+
+	for _, filename := range files {
+		info, err := client.GetFileInfo(filename)
+		if err != nil {
+			return nil, fmt.Errorf("file %s: %w", filename, err)
+		}
+
+		manifest.Entries = append(manifest.Entries, bundle.Entry{
+			Kind:   bundle.KindFile,
+			Name:   filename,
+			Path:   bundle.EntryPath(bundle.KindFile, filename, ""),
+			Digest: info.Digest,
+			Size:   info.Size,
+		})
+	}
+
+	return manifest, nil
+}
+
+// writeBundle downloads every manifest entry into the bundle at path. The
+// bundle only appears once everything has been downloaded and verified.
+func writeBundle(ctx context.Context, client *api.Client, manifest *bundle.Manifest, path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	writer, err := bundle.NewWriter(tmp, manifest)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range manifest.Entries {
+		var body io.ReadCloser
+		if entry.Kind == bundle.KindImage {
+			body, _, err = client.OpenImage(ctx, entry.Name, entry.Platform)
+		} else {
+			body, _, err = client.OpenFile(ctx, entry.Name)
+		}
+		if err != nil {
+			return fmt.Errorf("%s %s: %w", entry.Kind, entry.Name, err)
+		}
+
+		err = writer.Add(body)
+		body.Close()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("  %s\n", describeEntry(&entry))
+	}
+
+	if err := writer.Close(); err != nil {
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// importBundle uploads the entries of a bundle, skipping those the server
+// already has with the same digest.
+func importBundle(ctx context.Context, client *api.Client, r io.Reader) (int, int, error) {
+	reader, err := bundle.NewReader(r)
+	if err != nil {
+		return 0, 0, err
+	}
+
+	imported, skipped := 0, 0
+	for {
+		entry, content, err := reader.Next()
+		if err == io.EOF {
+			return imported, skipped, nil
+		}
+		if err != nil {
+			return imported, skipped, err
+		}
+
+		var digest string
+		if entry.Kind == bundle.KindImage {
+			if info, err := client.GetImageInfo(entry.Name, entry.Platform); err == nil {
+				digest = info.Digest
+			}
+		} else {
+			if info, err := client.GetFileInfo(entry.Name); err == nil {
+				digest = info.Digest
+			}
+		}
+		if digest == entry.Digest {
+			skipped++
+			fmt.Printf("  %s: already present\n", describeEntry(entry))
+			continue
+		}
+
+		switch entry.Kind {
+		case bundle.KindImage:
+			err = client.UploadImageStreamWithSignature(ctx, entry.Name, entry.Platform, content, entry.Signature)
+		case bundle.KindFile:
+			err = client.UploadFileStream(ctx, entry.Name, content)
+		default:
+			err = fmt.Errorf("unknown entry kind %q", entry.Kind)
+		}
+		if err != nil {
+			return imported, skipped, fmt.Errorf("%s %s: %w", entry.Kind, entry.Name, err)
+		}
+		imported++
+		fmt.Printf("  %s: imported\n", describeEntry(entry))
+	}
+}
+
+func describeEntry(entry *bundle.Entry) string {
+	name := entry.Name
+	if entry.Platform != "" {
+		name += " [" + entry.Platform + "]"
+	}
+	return fmt.Sprintf("%s %s (%s)", entry.Kind, name, progress.FormatBytes(entry.Size))
+}
+
+var promoteCmd = &cobra.Command{
+	Use:   "promote",
+	Short: "Copy images and files between namespaces on the server",
+}
+
+var promoteImgCmd = &cobra.Command{
+	Use:   "img <name>",
+	Short: "Promote an image with all its platform builds",
+	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		client, err := getClient()
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		images, err := client.ListImages()
+
+		promoted, err := client.PromoteImage(imageName(args[0]), promoteFrom, promoteTo)
 		if err != nil {
-			fmt.Printf("List failed: %v\n", err)
+			fmt.Printf("Promote failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		if len(images) == 0 {
-			fmt.Println("No images found")
-			return
-		}
-		
-		fmt.Println("Images:")
-		for _, image := range images {
-			fmt.Printf("  %s\n", image)
-		}
+
+		fmt.Printf("Image %s promoted from %s to %s by %s\n", args[0], namespaceLabel(promoted.From), namespaceLabel(promoteTo), promoted.By)
 	},
 }
 
-var imgDeleteCmd = &cobra.Command{
-	Use:   "delete <name>",
-	Short: "Delete an image",
+var promoteFileCmd = &cobra.Command{
+	Use:   "file <filename>",
+	Short: "Promote a file",
 	Args:  cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
-		imageName := args[0]
-		
 		client, err := getClient()
 		if err != nil {
 			fmt.Printf("Error: %v\n", err)
 			os.Exit(1)
 		}
-		
-		err = client.DeleteImage(imageName)
+
+		promoted, err := client.PromoteFile(args[0], promoteFrom, promoteTo)
 		if err != nil {
-			fmt.Printf("Delete failed: %v\n", err)
+			fmt.Printf("Promote failed: %v\n", err)
 			os.Exit(1)
 		}
-		
-		fmt.Printf("Image %s deleted successfully\n", imageName)
+
+		fmt.Printf("File %s promoted from %s to %s by %s\n", args[0], namespaceLabel(promoted.From), namespaceLabel(promoteTo), promoted.By)
 	},
 }
 
+// namespaceLabel names a namespace for messages.
+func namespaceLabel(namespace string) string {
+	if namespace == "" {
+		return "the default namespace"
+	}
+	return namespace
+}
+
+// defaultPlatform is the platform containers run as on this host. Images
+// are linux images even where docker runs in a VM (macOS, Windows).
+func defaultPlatform() string {
+	return "linux/" + runtime.GOARCH
+}
+
+// imageName maps a docker image reference to the name it is stored under.
+func imageName(dockerImage string) string {
+	return strings.ReplaceAll(dockerImage, "/", "_")
+}
+
+// getRuntime returns the image runtime chosen with --runtime, falling back
+// to the configured runtime and then docker.
+func getRuntime() (container.ImageRuntime, error) {
+	cfg, err := config.LoadConfig()
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+
+	name := cfg.Runtime
+	if imgRuntime != "" {
+		name = imgRuntime
+	}
+
+	return container.New(name, cfg.RuntimeDir)
+}
+
 func getClient() (*api.Client, error) {
 	cfg, err := config.LoadConfig()
 	if err != nil {
 		return nil, fmt.Errorf("load config: %w", err)
 	}
-	
+
 	if cfg.Token == "" {
 		return nil, fmt.Errorf("no token configured. Use 'unrg config set-token <token>' first")
 	}
-	
-	return api.NewClient(cfg.BaseURL, cfg.Token), nil
+
+	client := api.NewClient(cfg.BaseURL, cfg.Token)
+	client.Namespace = namespaceFlag
+	client.Logf = func(format string, args ...interface{}) {
+		fmt.Fprintf(os.Stderr, "\n"+format+"\n", args...)
+	}
+	if dir, err := config.GetUploadStateDir(); err == nil {
+		client.UploadStateDir = dir
+	}
+	return client, nil
 }
 
 func init() {
 	// Config commands
 	configCmd.AddCommand(setTokenCmd)
 	configCmd.AddCommand(setURLCmd)
+	configCmd.AddCommand(setRuntimeCmd)
 	rootCmd.AddCommand(configCmd)
-	
+
 	// File commands
 	fileCmd.AddCommand(filePushCmd)
 	fileCmd.AddCommand(filePullCmd)
+	fileCmd.AddCommand(fileSyncCmd)
 	fileCmd.AddCommand(fileListCmd)
 	fileCmd.AddCommand(fileDeleteCmd)
+	fileCmd.AddCommand(fileCopyCmd)
+	fileCmd.AddCommand(fileMoveCmd)
+	fileCmd.AddCommand(fileShareCmd)
+	fileCmd.AddCommand(fileSharesCmd)
+	fileCmd.AddCommand(fileUnshareCmd)
 	rootCmd.AddCommand(fileCmd)
-	
+	filePushCmd.Flags().BoolVar(&filePushForce, "force", false, "Upload even when the server already has identical content")
+	filePushCmd.Flags().BoolVar(&filePushExtract, "extract", false, "Unpack a zip or tar.gz into the remote directory, replacing its contents")
+	filePushCmd.Flags().BoolVar(&filePushNoClobber, "no-clobber", false, "Fail instead of replacing a file that exists on the server")
+	filePushCmd.Flags().StringVar(&filePushIfVersion, "if-version", "", "Only replace the file while it has this SHA-256 digest")
+	filePullCmd.Flags().IntVar(&filePullParallel, "parallel", 1, "Download large files in this many parallel ranges")
+	filePullCmd.Flags().StringVar(&filePullExpect, "expect-sha256", "", "Fail unless the file has this SHA-256 digest")
+	filePullCmd.Flags().BoolVar(&filePullForce, "force", false, "Download even when the local file already matches")
+	filePullCmd.Flags().StringVar(&filePullArchive, "archive", "", "Download the files as one .zip or .tar.gz archive at this path")
+	for _, cmd := range []*cobra.Command{fileCopyCmd, fileMoveCmd} {
+		cmd.Flags().BoolVar(&fileRelocateForce, "force", false, "Replace the destination if it already exists")
+	}
+	for _, cmd := range []*cobra.Command{filePushCmd, filePullCmd} {
+		cmd.Flags().BoolVarP(&fileRecursive, "recursive", "r", false, "Transfer a whole directory")
+	}
+	for _, cmd := range []*cobra.Command{filePushCmd, filePullCmd, fileSyncCmd} {
+		cmd.Flags().StringSliceVar(&fileInclude, "include", nil, "Only transfer files matching these globs (with -r or sync)")
+		cmd.Flags().StringSliceVar(&fileExclude, "exclude", nil, "Skip files matching these globs (with -r or sync)")
+		cmd.Flags().IntVar(&fileConcurrency, "concurrency", 4, "Number of files transferred at once (with -r or sync)")
+	}
+	fileSyncCmd.Flags().BoolVar(&syncDelete, "delete", false, "Delete files on the receiving side that the sending side does not have")
+	fileShareCmd.Flags().DurationVar(&fileShareExpires, "expires", 24*time.Hour, "How long the link works")
+	fileShareCmd.Flags().IntVar(&fileShareMaxDownloads, "max-downloads", 0, "Number of downloads the link allows (0 for unlimited)")
+	fileSyncCmd.Flags().BoolVar(&syncDryRun, "dry-run", false, "Print what would be transferred and deleted without doing it")
+
 	// Image commands
 	imgCmd.AddCommand(imgPushCmd)
 	imgCmd.AddCommand(imgPullCmd)
 	imgCmd.AddCommand(imgListCmd)
 	imgCmd.AddCommand(imgDeleteCmd)
+	imgCmd.AddCommand(imgPruneCmd)
+	imgCmd.AddCommand(imgSignCmd)
+	imgCmd.AddCommand(imgKeygenCmd)
+	imgCmd.AddCommand(imgDiffCmd)
+	imgCmd.AddCommand(imgPushComposeCmd)
+	imgCmd.AddCommand(imgPullComposeCmd)
+	imgCmd.AddCommand(imgCopyCmd)
 	rootCmd.AddCommand(imgCmd)
+
+	// Bundle commands
+	bundleCmd.AddCommand(bundleCreateCmd)
+	bundleCmd.AddCommand(bundleImportCmd)
+	rootCmd.AddCommand(bundleCmd)
+
+	bundleCreateCmd.Flags().StringSliceVar(&bundleImages, "images", nil, "Images to bundle (comma separated)")
+	bundleCreateCmd.Flags().StringSliceVar(&bundleFiles, "files", nil, "Files to bundle (comma separated)")
+	bundleCreateCmd.Flags().StringVarP(&bundleOutput, "output", "o", "", "Bundle file to write")
+
+	// Promote commands
+	promoteCmd.AddCommand(promoteImgCmd)
+	promoteCmd.AddCommand(promoteFileCmd)
+	rootCmd.AddCommand(promoteCmd)
+
+	rootCmd.PersistentFlags().StringVarP(&namespaceFlag, "namespace", "n", "", "Server namespace to work in (default namespace if empty)")
+	promoteCmd.PersistentFlags().StringVar(&promoteFrom, "from", "", "Namespace to promote from (default namespace if empty)")
+	promoteCmd.PersistentFlags().StringVar(&promoteTo, "to", "", "Namespace to promote to")
+	promoteCmd.MarkPersistentFlagRequired("to")
+
+	imgCmd.PersistentFlags().StringVar(&imgRuntime, "runtime", "", "Container runtime: docker, podman, nerdctl or file (default from config, then docker)")
+	imgPushCmd.Flags().StringVar(&imgPushKey, "key", "", "Sign the pushed image with this ed25519 private key")
+	imgPushCmd.Flags().StringVar(&imgPushFromFile, "from-file", "", "Push a docker save tarball (optionally gzipped) instead of asking the runtime")
+	imgPushCmd.Flags().StringVar(&imgPushFromOCI, "from-oci-layout", "", "Push an image from an OCI image layout directory")
+	imgPullCmd.Flags().StringVar(&imgPullToFile, "to-file", "", "Write the image to a docker save tarball instead of loading it")
+	imgPullCmd.Flags().StringVar(&imgPullToOCI, "to-oci-layout", "", "Write the image to an OCI image layout directory")
+	imgPushCmd.Flags().StringVar(&imgPushPlatform, "platform", "", "Record the image as the build for this platform (os/arch[/variant])")
+	imgPullCmd.Flags().StringVar(&imgPullPlatform, "platform", defaultPlatform(), "Platform to pull (os/arch[/variant])")
+	imgSignCmd.Flags().StringVar(&imgSignPlatform, "platform", "", "Sign the build for this platform")
+	imgDeleteCmd.Flags().StringVar(&imgDeletePlatform, "platform", "", "Only delete the build for this platform")
+	imgPullCmd.Flags().BoolVar(&imgPullVerify, "verify", false, "Refuse to load the image unless its signature verifies")
+	imgPullCmd.Flags().StringVar(&imgPullPubKey, "pubkey", "", "Public key used by --verify")
+	imgSignCmd.Flags().StringVar(&imgSignKey, "key", "", "ed25519 private key to sign with")
+	imgSignCmd.Flags().StringVar(&imgSignFromFile, "from-file", "", "Hash the image from this docker save tarball instead of asking the runtime")
+	imgPruneCmd.Flags().BoolVar(&imgPruneDry, "dry-run", false, "Only show what would be deleted")
+	imgPushComposeCmd.Flags().IntVar(&imgComposeConcurrency, "concurrency", 4, "Number of images transferred at once")
+	imgPullComposeCmd.Flags().IntVar(&imgComposeConcurrency, "concurrency", 4, "Number of images transferred at once")
+	imgDiffCmd.Flags().BoolVar(&imgDiffJSON, "json", false, "Print the diff as JSON")
+	imgDiffCmd.Flags().StringVar(&imgDiffPlatform, "platform", "", "Compare the builds for this platform")
+	imgCopyCmd.Flags().StringVar(&imgCopyPlatform, "platform", defaultPlatform(), "Platform to copy from multi-platform images (os/arch[/variant])")
+	imgCopyCmd.Flags().StringVar(&imgCopyUser, "registry-user", "", "Registry username (default $UNRG_REGISTRY_USER)")
+	imgCopyCmd.Flags().StringVar(&imgCopyPassword, "registry-password", "", "Registry password or token (default $UNRG_REGISTRY_PASSWORD)")
+	imgCopyCmd.Flags().BoolVar(&imgCopyInsecure, "insecure", false, "Use plain HTTP for the registry")
 }
 
 func main() {
@@ -388,4 +2433,4 @@ func main() {
 		fmt.Printf("Error: %v\n", err)
 		os.Exit(1)
 	}
-}
\ No newline at end of file
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/internal/handler"
+	"github.com/dollarkillerx/unregistry/internal/storage"
+	"github.com/dollarkillerx/unregistry/pkg/api"
+	"github.com/dollarkillerx/unregistry/pkg/auth"
+	"github.com/dollarkillerx/unregistry/pkg/container"
+	"github.com/dollarkillerx/unregistry/pkg/sign"
+	"github.com/gorilla/mux"
+)
+
+// fakeRuntime keeps images in memory in place of a container runtime.
+type fakeRuntime struct {
+	mu     sync.Mutex
+	images map[string][]byte
+}
+
+var _ container.ImageRuntime = (*fakeRuntime)(nil)
+
+func (f *fakeRuntime) Name() string {
+	return "fake"
+}
+
+func (f *fakeRuntime) Save(ctx context.Context, image string, w io.Writer) error {
+	f.mu.Lock()
+	data, ok := f.images[image]
+	f.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("no such image: %s", image)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+func (f *fakeRuntime) Load(ctx context.Context, image string, r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.images[image] = data
+	return nil
+}
+
+// testImage builds a minimal docker-save archive with one layer.
+func testImage(t *testing.T) []byte {
+	t.Helper()
+
+	var layer bytes.Buffer
+	lw := tar.NewWriter(&layer)
+	content := []byte("hello\n")
+	lw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(content))})
+	lw.Write(content)
+	lw.Close()
+	diffID := sha256.Sum256(layer.Bytes())
+
+	config, _ := json.Marshal(map[string]interface{}{
+		"architecture": "amd64",
+		"os":           "linux",
+		"rootfs":       map[string]interface{}{"type": "layers", "diff_ids": []string{"sha256:" + hex.EncodeToString(diffID[:])}},
+	})
+	configSum := sha256.Sum256(config)
+	configName := hex.EncodeToString(configSum[:]) + ".json"
+
+	manifest, _ := json.Marshal([]map[string]interface{}{{
+		"Config":   configName,
+		"RepoTags": []string{"app:1"},
+		"Layers":   []string{"layer/layer.tar"},
+	}})
+
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{
+		{configName, config},
+		{"layer/layer.tar", layer.Bytes()},
+		{"manifest.json", manifest},
+	} {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.data))}); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(entry.data)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return archive.Bytes()
+}
+
+// testServer serves the image and upload routes of a fresh data directory.
+func testServer(t *testing.T, signing *sign.Policy) *api.Client {
+	t.Helper()
+
+	store := storage.New(t.TempDir())
+	images := handler.NewImageHandler(store, signing, nil)
+	uploads := handler.NewUploadHandler(store, signing, time.Hour, storage.DefaultExtractLimits)
+
+	r := mux.NewRouter()
+	a := r.PathPrefix("/api").Subrouter()
+	a.Use(auth.AuthMiddleware("test-token"))
+	a.HandleFunc("/img/download/{name}", images.Download).Methods("GET", "HEAD")
+	a.HandleFunc("/img/signature/{name}", images.GetSignature).Methods("GET")
+	a.HandleFunc("/upload", uploads.Create).Methods("POST")
+	a.HandleFunc("/upload/{id}", uploads.Status).Methods("GET")
+	a.HandleFunc("/upload/{id}", uploads.Chunk).Methods("PUT")
+	a.HandleFunc("/upload/{id}", uploads.Cancel).Methods("DELETE")
+	a.HandleFunc("/upload/{id}/finish", uploads.Finish).Methods("POST")
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return api.NewClient(server.URL, "test-token")
+}
+
+func runtimeSource(rt container.ImageRuntime, image string) imageSource {
+	return func(ctx context.Context, w io.Writer) error {
+		return rt.Save(ctx, image, w)
+	}
+}
+
+func runtimeSink(rt container.ImageRuntime, image string) imageSink {
+	return func(ctx context.Context, r io.Reader) error {
+		return rt.Load(ctx, image, r)
+	}
+}
+
+func TestPushPullFakeRuntime(t *testing.T) {
+	client := testServer(t, &sign.Policy{})
+	image := testImage(t)
+	local := &fakeRuntime{images: map[string][]byte{"app:1": image}}
+	ctx := context.Background()
+
+	if _, err := pushImage(ctx, client, "app:1", "", runtimeSource(local, "app:1"), nil, false); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+
+	other := &fakeRuntime{images: map[string][]byte{}}
+	if _, err := pullImage(ctx, client, "app:1", "", runtimeSink(other, "app:1"), nil, false); err != nil {
+		t.Fatalf("pull: %v", err)
+	}
+	if !bytes.Equal(other.images["app:1"], image) {
+		t.Fatal("pulled image differs from the pushed one")
+	}
+}
+
+func TestPushSignedPullVerified(t *testing.T) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := testServer(t, &sign.Policy{Keys: []ed25519.PublicKey{pub}, Repos: []string{"app"}})
+	local := &fakeRuntime{images: map[string][]byte{"app:1": testImage(t)}}
+	ctx := context.Background()
+
+	if _, err := pushImage(ctx, client, "app:1", "", runtimeSource(local, "app:1"), nil, false); err == nil {
+		t.Fatal("unsigned push to a signed repository succeeded")
+	}
+	if _, err := pushImage(ctx, client, "app:1", "", runtimeSource(local, "app:1"), priv, false); err != nil {
+		t.Fatalf("signed push: %v", err)
+	}
+
+	other := &fakeRuntime{images: map[string][]byte{}}
+	if _, err := pullImage(ctx, client, "app:1", "", runtimeSink(other, "app:1"), pub, false); err != nil {
+		t.Fatalf("verified pull: %v", err)
+	}
+
+	stranger, _, _ := ed25519.GenerateKey(rand.Reader)
+	if _, err := pullImage(ctx, client, "app:1", "", runtimeSink(other, "app:2"), stranger, false); err == nil {
+		t.Fatal("pull verified against the wrong key")
+	}
+}
+
+func TestPushFailedSave(t *testing.T) {
+	client := testServer(t, &sign.Policy{})
+	local := &fakeRuntime{images: map[string][]byte{}}
+
+	if _, err := pushImage(context.Background(), client, "missing:1", "", runtimeSource(local, "missing:1"), nil, false); err == nil {
+		t.Fatal("push of an image the runtime cannot save succeeded")
+	}
+	other := &fakeRuntime{images: map[string][]byte{}}
+	if _, err := pullImage(context.Background(), client, "missing:1", "", runtimeSink(other, "missing:1"), nil, false); err == nil {
+		t.Fatal("a failed push stored an image")
+	}
+}
@@ -4,10 +4,15 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/dollarkillerx/unregistry/internal/handler"
+	"github.com/dollarkillerx/unregistry/internal/retention"
 	"github.com/dollarkillerx/unregistry/internal/storage"
 	"github.com/dollarkillerx/unregistry/pkg/auth"
+	"github.com/dollarkillerx/unregistry/pkg/sign"
 	"github.com/gorilla/mux"
 )
 
@@ -29,32 +34,138 @@ func main() {
 		listenAddr = "0.0.0.0:8080"
 	}
 
+	// Scoped tokens: TOKENS_FILE lists extra tokens limited to namespaces
+	var scopedTokens []auth.Token
+	if tokensPath := os.Getenv("TOKENS_FILE"); tokensPath != "" {
+		var err error
+		scopedTokens, err = auth.LoadTokens(tokensPath)
+		if err != nil {
+			log.Fatal("Failed to load tokens:", err)
+		}
+	}
+
+	// Image signing: SIGNING_KEYS lists trusted public keys, SIGNED_REPOS the
+	// repository patterns that only accept signed pushes
+	signing, err := sign.LoadPolicy(splitList(os.Getenv("SIGNING_KEYS")), splitList(os.Getenv("SIGNED_REPOS")))
+	if err != nil {
+		log.Fatal("Failed to load signing policy:", err)
+	}
+
+	// Uploads with extract=true: EXTRACT_MAX_FILES and EXTRACT_MAX_BYTES
+	// bound what one archive may expand to
+	extractLimits := storage.DefaultExtractLimits
+	if value := os.Getenv("EXTRACT_MAX_FILES"); value != "" {
+		extractLimits.MaxFiles, err = strconv.Atoi(value)
+		if err != nil {
+			log.Fatal("Invalid EXTRACT_MAX_FILES:", err)
+		}
+	}
+	if value := os.Getenv("EXTRACT_MAX_BYTES"); value != "" {
+		extractLimits.MaxBytes, err = strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			log.Fatal("Invalid EXTRACT_MAX_BYTES:", err)
+		}
+	}
+
 	// Initialize storage
 	storage := storage.New(dataPath)
 
+	// Image retention: RETENTION_CONFIG points at the rules, RETENTION_INTERVAL
+	// enables scheduled enforcement (e.g. "1h")
+	var retentionPolicy *retention.Policy
+	if policyPath := os.Getenv("RETENTION_CONFIG"); policyPath != "" {
+		retentionPolicy, err = retention.LoadPolicy(policyPath)
+		if err != nil {
+			log.Fatal("Failed to load retention policy:", err)
+		}
+
+		if value := os.Getenv("RETENTION_INTERVAL"); value != "" {
+			interval, err := time.ParseDuration(value)
+			if err != nil {
+				log.Fatal("Invalid RETENTION_INTERVAL:", err)
+			}
+			go retentionPolicy.Run(storage, interval)
+			log.Printf("Retention enforced in every namespace every %s", interval)
+		}
+	}
+
+	// Resumable uploads: UPLOAD_SESSION_TTL is how long a session survives
+	// without receiving data
+	sessionTTL := 24 * time.Hour
+	if value := os.Getenv("UPLOAD_SESSION_TTL"); value != "" {
+		sessionTTL, err = time.ParseDuration(value)
+		if err != nil {
+			log.Fatal("Invalid UPLOAD_SESSION_TTL:", err)
+		}
+	}
+	go func() {
+		for range time.Tick(time.Minute) {
+			if removed := storage.ExpireSessions(); removed > 0 {
+				log.Printf("Expired %d upload sessions", removed)
+			}
+		}
+	}()
+
+	// Share links: SHARE_SECRET signs them; without it a key is generated
+	// and kept in the data directory. Changing the key revokes every link.
+	shareKey := []byte(os.Getenv("SHARE_SECRET"))
+	if len(shareKey) == 0 {
+		shareKey, err = storage.ShareKey()
+		if err != nil {
+			log.Fatal("Failed to load share key:", err)
+		}
+	}
+
 	// Initialize handlers
-	fileHandler := handler.NewFileHandler(storage)
-	imageHandler := handler.NewImageHandler(storage)
+	fileHandler := handler.NewFileHandler(storage, shareKey)
+	imageHandler := handler.NewImageHandler(storage, signing, retentionPolicy)
+	uploadHandler := handler.NewUploadHandler(storage, signing, sessionTTL, extractLimits)
 
 	// Setup router
 	r := mux.NewRouter()
 
+	// Share links carry a signature instead of a token, so they are matched
+	// before the authenticated routes
+	r.HandleFunc("/api/file/download/{filename:.+}", fileHandler.Download).Methods("GET", "HEAD").Queries("sig", "{sig}")
+
 	// API routes with authentication
 	api := r.PathPrefix("/api").Subrouter()
-	api.Use(auth.AuthMiddleware(token))
+	api.Use(auth.AuthMiddleware(token, scopedTokens...))
 
 	// File routes
 	api.HandleFunc("/file/upload", fileHandler.Upload).Methods("POST")
-	api.HandleFunc("/file/download/{filename}", fileHandler.Download).Methods("GET")
+	api.HandleFunc("/file/download/{filename:.+}", fileHandler.Download).Methods("GET", "HEAD")
 	api.HandleFunc("/file/list", fileHandler.List).Methods("GET")
-	api.HandleFunc("/file/{filename}", fileHandler.Delete).Methods("DELETE")
+	api.HandleFunc("/file/info/{filename:.+}", fileHandler.Info).Methods("GET")
+	api.HandleFunc("/file/promote", fileHandler.Promote).Methods("POST")
+	api.HandleFunc("/file/copy", fileHandler.Copy).Methods("POST")
+	api.HandleFunc("/file/move", fileHandler.Move).Methods("POST")
+	api.HandleFunc("/file/archive", fileHandler.Archive).Methods("POST")
+	api.HandleFunc("/file/share", fileHandler.Share).Methods("POST")
+	api.HandleFunc("/file/shares", fileHandler.Shares).Methods("GET")
+	api.HandleFunc("/file/shares/{id:[0-9a-f]{32}}", fileHandler.Unshare).Methods("DELETE")
+	api.HandleFunc("/file/{filename:.+}", fileHandler.Put).Methods("PUT")
+	api.HandleFunc("/file/{filename:.+}", fileHandler.Delete).Methods("DELETE")
 
 	// Image routes
 	api.HandleFunc("/img/upload", imageHandler.Upload).Methods("POST")
-	api.HandleFunc("/img/download/{name}", imageHandler.Download).Methods("GET")
+	api.HandleFunc("/img/download/{name}", imageHandler.Download).Methods("GET", "HEAD")
 	api.HandleFunc("/img/list", imageHandler.List).Methods("GET")
+	api.HandleFunc("/img/prune", imageHandler.Prune).Methods("POST")
+	api.HandleFunc("/img/promote", imageHandler.Promote).Methods("POST")
+	api.HandleFunc("/img/diff", imageHandler.Diff).Methods("GET")
+	api.HandleFunc("/img/digest/{name}", imageHandler.Digest).Methods("GET")
+	api.HandleFunc("/img/signature/{name}", imageHandler.GetSignature).Methods("GET")
+	api.HandleFunc("/img/signature/{name}", imageHandler.PutSignature).Methods("PUT")
 	api.HandleFunc("/img/{name}", imageHandler.Delete).Methods("DELETE")
 
+	// Resumable upload routes
+	api.HandleFunc("/upload", uploadHandler.Create).Methods("POST")
+	api.HandleFunc("/upload/{id}", uploadHandler.Status).Methods("GET")
+	api.HandleFunc("/upload/{id}", uploadHandler.Chunk).Methods("PUT")
+	api.HandleFunc("/upload/{id}", uploadHandler.Cancel).Methods("DELETE")
+	api.HandleFunc("/upload/{id}/finish", uploadHandler.Finish).Methods("POST")
+
 	// Health check endpoint (no auth required)
 	r.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
@@ -63,8 +174,19 @@ func main() {
 
 	log.Printf("Server starting on %s", listenAddr)
 	log.Printf("Data path: %s", dataPath)
-	
+
 	if err := http.ListenAndServe(listenAddr, r); err != nil {
 		log.Fatal("Server failed to start:", err)
 	}
-}
\ No newline at end of file
+}
+
+// splitList splits a comma separated environment value, dropping empty items.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,187 @@
+package handler
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/dollarkillerx/unregistry/internal/storage"
+)
+
+// archiveRequest selects the files of an archive download.
+type archiveRequest struct {
+	// Format is "zip" or "tar.gz"
+	Format   string   `json:"format"`
+	Names    []string `json:"names"`
+	Prefixes []string `json:"prefixes"`
+}
+
+// Archive streams many files as one zip or tar.gz, built while it is sent:
+// POST /api/file/archive {"format": "zip", "names": [...], "prefixes": [...]}
+// Entries keep their full names. Every file is looked up before the
+// response starts, so a missing name is still a 404.
+func (h *FileHandler) Archive(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	var req archiveRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Invalid archive request", http.StatusBadRequest)
+		return
+	}
+	if req.Format != "zip" && req.Format != "tar.gz" {
+		http.Error(w, fmt.Sprintf("Unsupported archive format %q", req.Format), http.StatusBadRequest)
+		return
+	}
+
+	names, status, err := archiveNames(store, req)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	w.Header().Set("Content-Disposition", "attachment; filename=files."+req.Format)
+	if req.Format == "zip" {
+		w.Header().Set("Content-Type", "application/zip")
+		err = writeZip(w, store, names)
+	} else {
+		w.Header().Set("Content-Type", "application/gzip")
+		err = writeTarGz(w, store, names)
+	}
+	if err != nil {
+		// The archive is half sent: break the connection so the client
+		// cannot mistake it for a complete one
+		panic(http.ErrAbortHandler)
+	}
+}
+
+// archiveNames resolves the names and prefixes of req to the files to
+// send, sorted and without duplicates.
+func archiveNames(store *storage.Storage, req archiveRequest) ([]string, int, error) {
+	selected := make(map[string]bool)
+	for _, name := range req.Names {
+		if !validFileName(name) {
+			return nil, http.StatusBadRequest, fmt.Errorf("Invalid file name %q", name)
+		}
+		if !storedFile(store, name) {
+			return nil, http.StatusNotFound, fmt.Errorf("File not found: %s", name)
+		}
+		selected[name] = true
+	}
+
+	if len(req.Prefixes) > 0 {
+		files, err := store.ListFiles()
+		if err != nil {
+			return nil, http.StatusInternalServerError, fmt.Errorf("Failed to list files")
+		}
+		for _, prefix := range req.Prefixes {
+			matched := false
+			for _, name := range files {
+				if strings.HasPrefix(name, prefix) {
+					selected[name] = true
+					matched = true
+				}
+			}
+			if !matched {
+				return nil, http.StatusNotFound, fmt.Errorf("No files under %s", prefix)
+			}
+		}
+	}
+
+	if len(selected) == 0 {
+		return nil, http.StatusBadRequest, fmt.Errorf("No files selected")
+	}
+
+	names := make([]string, 0, len(selected))
+	for name := range selected {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, http.StatusOK, nil
+}
+
+// storedFile reports whether name is a file, not a directory of nested
+// names.
+func storedFile(store *storage.Storage, name string) bool {
+	file, err := store.GetFile(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	return err == nil && info.Mode().IsRegular()
+}
+
+func writeZip(w io.Writer, store *storage.Storage, names []string) error {
+	zw := zip.NewWriter(w)
+	for _, name := range names {
+		err := copyArchiveEntry(store, name, func(info os.FileInfo) (io.Writer, error) {
+			header, err := zip.FileInfoHeader(info)
+			if err != nil {
+				return nil, err
+			}
+			header.Name = name
+			header.Method = zip.Deflate
+			return zw.CreateHeader(header)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+func writeTarGz(w io.Writer, store *storage.Storage, names []string) error {
+	gw := gzip.NewWriter(w)
+	tw := tar.NewWriter(gw)
+	for _, name := range names {
+		err := copyArchiveEntry(store, name, func(info os.FileInfo) (io.Writer, error) {
+			header, err := tar.FileInfoHeader(info, "")
+			if err != nil {
+				return nil, err
+			}
+			header.Name = name
+			if err := tw.WriteHeader(header); err != nil {
+				return nil, err
+			}
+			return tw, nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gw.Close()
+}
+
+// copyArchiveEntry copies one stored file into the entry create starts.
+func copyArchiveEntry(store *storage.Storage, name string, create func(info os.FileInfo) (io.Writer, error)) error {
+	file, err := store.GetFile(name)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	entry, err := create(info)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(entry, file)
+	return err
+}
@@ -0,0 +1,75 @@
+package handler
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/dollarkillerx/unregistry/internal/storage"
+	"github.com/dollarkillerx/unregistry/pkg/auth"
+	"github.com/gorilla/mux"
+)
+
+func TestPutConditional(t *testing.T) {
+	sum := sha256.Sum256([]byte("v1"))
+	stored := "sha256:" + hex.EncodeToString(sum[:])
+	tests := []struct {
+		name   string
+		stored bool
+		header map[string]string
+		status int
+	}{
+		{"unconditional", true, nil, http.StatusCreated},
+		{"If-Match", true, map[string]string{"If-Match": `"` + stored + `"`}, http.StatusCreated},
+		{"weak If-Match", true, map[string]string{"If-Match": `W/"` + stored + `"`}, http.StatusCreated},
+		{"If-Match another version", true, map[string]string{"If-Match": `"sha256:0000"`}, http.StatusPreconditionFailed},
+		{"If-Match with nothing stored", false, map[string]string{"If-Match": `"` + stored + `"`}, http.StatusPreconditionFailed},
+		{"If-Match any with nothing stored", false, map[string]string{"If-Match": "*"}, http.StatusPreconditionFailed},
+		{"If-None-Match any", true, map[string]string{"If-None-Match": "*"}, http.StatusPreconditionFailed},
+		{"If-None-Match any with nothing stored", false, map[string]string{"If-None-Match": "*"}, http.StatusCreated},
+		{"If-None-Match the stored version", true, map[string]string{"If-None-Match": `"sha256:0000", "` + stored + `"`}, http.StatusPreconditionFailed},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			store := storage.New(t.TempDir())
+			if test.stored {
+				if err := store.SaveFile("a.txt", strings.NewReader("v1")); err != nil {
+					t.Fatal(err)
+				}
+			}
+			h := NewFileHandler(store, []byte("test-key"))
+			r := mux.NewRouter()
+			r.Use(auth.AuthMiddleware("test-token"))
+			r.HandleFunc("/api/file/{filename:.+}", h.Put).Methods("PUT")
+
+			req := httptest.NewRequest("PUT", "/api/file/a.txt", strings.NewReader("v2"))
+			req.Header.Set("Authorization", "Bearer test-token")
+			for key, value := range test.header {
+				req.Header.Set(key, value)
+			}
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, req)
+
+			if rec.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, test.status, rec.Body)
+			}
+			meta, err := store.FileMeta("a.txt")
+			switch {
+			case test.status == http.StatusCreated:
+				if err != nil || meta.Digest == stored {
+					t.Fatalf("upload was not stored: %v", err)
+				}
+			case test.stored:
+				if err != nil || meta.Digest != stored {
+					t.Fatalf("rejected upload replaced the file: %v", err)
+				}
+			case err == nil:
+				t.Fatal("rejected upload stored the file")
+			}
+		})
+	}
+}
@@ -2,9 +2,13 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path"
+	"strings"
 
 	"github.com/dollarkillerx/unregistry/internal/storage"
 	"github.com/gorilla/mux"
@@ -12,13 +16,23 @@ import (
 
 type FileHandler struct {
 	storage *storage.Storage
+	// shareKey signs share links
+	shareKey []byte
 }
 
-func NewFileHandler(storage *storage.Storage) *FileHandler {
-	return &FileHandler{storage: storage}
+func NewFileHandler(storage *storage.Storage, shareKey []byte) *FileHandler {
+	return &FileHandler{storage: storage, shareKey: shareKey}
 }
 
 func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+	if !extractUnsupported(w, r) {
+		return
+	}
+
 	file, header, err := r.FormFile("file")
 	if err != nil {
 		http.Error(w, "Failed to get file from request", http.StatusBadRequest)
@@ -26,11 +40,32 @@ func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	}
 	defer file.Close()
 
-	err = h.storage.SaveFile(header.Filename, file)
+	condition := uploadCondition(r)
+	if !checkCondition(w, store, header.Filename, condition) {
+		return
+	}
+
+	pending, err := store.CreateFile(header.Filename)
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
 		return
 	}
+	if _, err := io.Copy(pending, file); err != nil {
+		pending.Abort()
+		http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	// The optional digest form value is checked before anything is replaced
+	if !verifyDigest(w, pending, r.FormValue("digest")) {
+		return
+	}
+
+	pending.Condition = condition
+	if err := pending.Commit(); err != nil {
+		commitFailed(w, err)
+		return
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]string{
@@ -39,53 +74,190 @@ func (h *FileHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// extractUnsupported answers 400 to a direct upload asking to be
+// extracted: only upload sessions unpack archives, under the server's
+// extraction limits.
+func extractUnsupported(w http.ResponseWriter, r *http.Request) bool {
+	if r.URL.Query().Get("extract") == "true" {
+		http.Error(w, "Extraction is only supported for upload sessions (POST /api/upload/{id}/finish?extract=true)", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+// Put stores the raw request body as a file: PUT /api/file/{filename}.
+// The body may be sent with Content-Length or chunked; an optional
+// ?digest=sha256:... is checked before the previous version is replaced.
+// If-None-Match: * only creates the file, If-Match only replaces the
+// version it names; otherwise the answer is 412.
+func (h *FileHandler) Put(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	filename, ok := fileName(w, r)
+	if !ok {
+		return
+	}
+	if !extractUnsupported(w, r) {
+		return
+	}
+
+	condition := uploadCondition(r)
+	if !checkCondition(w, store, filename, condition) {
+		return
+	}
+
+	pending, err := store.CreateFile(filename)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if _, err := io.Copy(pending, r.Body); err != nil {
+		pending.Abort()
+		http.Error(w, fmt.Sprintf("Failed to read upload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	if !verifyDigest(w, pending, r.URL.Query().Get("digest")) {
+		return
+	}
+
+	pending.Condition = condition
+	if err := pending.Commit(); err != nil {
+		commitFailed(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "File uploaded successfully",
+		"filename": filename,
+		"digest":   pending.Meta.Digest,
+		"size":     pending.Meta.Size,
+	})
+}
+
+// validFileName reports whether name can be stored as a file: a relative
+// slash-separated path without "." or ".." elements.
+func validFileName(name string) bool {
+	if name == "" || strings.HasPrefix(name, "/") || strings.Contains(name, "\\") {
+		return false
+	}
+	for _, element := range strings.Split(name, "/") {
+		if element == "" || element == "." || element == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// fileName returns the file name in the URL, answering 400 when it is not
+// a valid one.
+func fileName(w http.ResponseWriter, r *http.Request) (string, bool) {
+	filename := mux.Vars(r)["filename"]
+	if !validFileName(filename) {
+		http.Error(w, fmt.Sprintf("Invalid file name %q", filename), http.StatusBadRequest)
+		return "", false
+	}
+	return filename, true
+}
+
+// Download serves a file to a caller with a token, or to anyone holding a
+// share link for it (?share=...&sig=...).
 func (h *FileHandler) Download(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	filename := vars["filename"]
+	filename, ok := fileName(w, r)
+	if !ok {
+		return
+	}
 
-	file, err := h.storage.GetFile(filename)
+	var store *storage.Storage
+	var shareID string
+	if r.URL.Query().Has("sig") {
+		store, shareID, ok = h.sharedStore(w, r, filename)
+	} else {
+		store, ok = namespace(w, r, h.storage)
+	}
+	if !ok {
+		return
+	}
+
+	file, err := store.GetFile(filename)
 	if err != nil {
 		http.Error(w, "File not found", http.StatusNotFound)
 		return
 	}
 	defer file.Close()
 
-	// Get file info to set Content-Length
-	fileInfo, err := file.Stat()
+	meta, err := store.FileMeta(filename)
 	if err != nil {
 		http.Error(w, "Failed to get file info", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
-
-	_, err = io.Copy(w, file)
-	if err != nil {
-		http.Error(w, "Failed to download file", http.StatusInternalServerError)
+	if shareID != "" && !useShare(w, r, store, shareID, filename, file, meta) {
 		return
 	}
+
+	serveObject(w, r, path.Base(filename), file, meta)
 }
 
 func (h *FileHandler) List(w http.ResponseWriter, r *http.Request) {
-	files, err := h.storage.ListFiles()
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	files, err := store.ListFiles()
 	if err != nil {
 		http.Error(w, "Failed to list files", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	// ?prefix= narrows the list to the files under a directory
+	if prefix := r.URL.Query().Get("prefix"); prefix != "" {
+		matched := []string{}
+		for _, name := range files {
+			if strings.HasPrefix(name, prefix) {
+				matched = append(matched, name)
+			}
+		}
+		files = matched
+	}
+
+	result := map[string]interface{}{
 		"files": files,
-	})
+	}
+	// ?meta=true adds the digest and size of every file, for clients that
+	// compare them against local copies
+	if r.URL.Query().Get("meta") == "true" {
+		metas := make(map[string]*storage.Meta, len(files))
+		for _, name := range files {
+			if meta, err := store.FileMeta(name); err == nil {
+				metas[name] = meta
+			}
+		}
+		result["meta"] = metas
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
 }
 
 func (h *FileHandler) Delete(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	filename := vars["filename"]
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	filename, ok := fileName(w, r)
+	if !ok {
+		return
+	}
 
-	err := h.storage.DeleteFile(filename)
+	err := store.DeleteFile(filename)
 	if err != nil {
 		http.Error(w, "Failed to delete file", http.StatusInternalServerError)
 		return
@@ -95,4 +267,119 @@ func (h *FileHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "File deleted successfully",
 	})
-}
\ No newline at end of file
+}
+
+func (h *FileHandler) Info(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	filename, ok := fileName(w, r)
+	if !ok {
+		return
+	}
+
+	meta, err := store.FileMeta(filename)
+	if err != nil {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":     filename,
+		"digest":   meta.Digest,
+		"size":     meta.Size,
+		"promoted": meta.Promoted,
+	})
+}
+
+// Promote copies a file between namespaces:
+// POST /file/promote?name=app.tar&from=dev&to=prod
+func (h *FileHandler) Promote(w http.ResponseWriter, r *http.Request) {
+	source, target, promoted, ok := promotion(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	filename := r.URL.Query().Get("name")
+	if !validFileName(filename) {
+		http.Error(w, fmt.Sprintf("Invalid file name %q", filename), http.StatusBadRequest)
+		return
+	}
+	err := source.PromoteFile(filename, target, promoted)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to promote file: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "File promoted successfully",
+		"filename": filename,
+		"promoted": promoted,
+	})
+}
+
+// Copy stores a copy of a file under another name without sending it
+// through the client: POST /api/file/copy?from=a&to=b&overwrite=true
+func (h *FileHandler) Copy(w http.ResponseWriter, r *http.Request) {
+	h.relocate(w, r, "copy", "copied", (*storage.Storage).CopyFile)
+}
+
+// Move renames a file: POST /api/file/move?from=a&to=b&overwrite=true
+func (h *FileHandler) Move(w http.ResponseWriter, r *http.Request) {
+	h.relocate(w, r, "move", "moved", (*storage.Storage).MoveFile)
+}
+
+// relocate runs a copy or move. Replacing an existing file needs
+// overwrite=true, otherwise it is a 409.
+func (h *FileHandler) relocate(w http.ResponseWriter, r *http.Request, verb, done string, op func(s *storage.Storage, src, dst string, overwrite bool) error) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	for _, name := range []string{from, to} {
+		if !validFileName(name) {
+			http.Error(w, fmt.Sprintf("Invalid file name %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+	if from == to {
+		http.Error(w, "Source and destination are the same file", http.StatusBadRequest)
+		return
+	}
+	if !storedFile(store, from) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+
+	err := op(store, from, to, query.Get("overwrite") == "true")
+	if errors.Is(err, storage.ErrFileExists) {
+		http.Error(w, fmt.Sprintf("Destination exists: %v", err), http.StatusConflict)
+		return
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to %s file: %v", verb, err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "File " + done + " successfully",
+		"from":    from,
+		"to":      to,
+	})
+}
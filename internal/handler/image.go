@@ -2,23 +2,38 @@ package handler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 
+	"github.com/dollarkillerx/unregistry/internal/retention"
 	"github.com/dollarkillerx/unregistry/internal/storage"
+	"github.com/dollarkillerx/unregistry/pkg/imgarchive"
+	"github.com/dollarkillerx/unregistry/pkg/sign"
 	"github.com/gorilla/mux"
 )
 
 type ImageHandler struct {
-	storage *storage.Storage
+	storage   *storage.Storage
+	signing   *sign.Policy
+	retention *retention.Policy
 }
 
-func NewImageHandler(storage *storage.Storage) *ImageHandler {
-	return &ImageHandler{storage: storage}
+func NewImageHandler(storage *storage.Storage, signing *sign.Policy, retention *retention.Policy) *ImageHandler {
+	return &ImageHandler{storage: storage, signing: signing, retention: retention}
 }
 
 func (h *ImageHandler) Upload(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
 	file, header, err := r.FormFile("image")
 	if err != nil {
 		http.Error(w, "Failed to get image file from request", http.StatusBadRequest)
@@ -32,7 +47,71 @@ func (h *ImageHandler) Upload(w http.ResponseWriter, r *http.Request) {
 		imageName = imageName[:len(imageName)-7]
 	}
 
-	err = h.storage.SaveImage(imageName, file)
+	var sig *sign.Signature
+	if value := r.FormValue("signature"); value != "" {
+		sig = &sign.Signature{}
+		if err := json.Unmarshal([]byte(value), sig); err != nil {
+			http.Error(w, "Invalid signature", http.StatusBadRequest)
+			return
+		}
+	}
+	if sig == nil && h.signing.Required(imageName) {
+		http.Error(w, fmt.Sprintf("Image %s requires a signed push", imageName), http.StatusForbidden)
+		return
+	}
+
+	var pending *storage.Pending
+	platform := r.FormValue("platform")
+	if platform != "" {
+		pending, err = store.CreateImageVariant(imageName, platform)
+	} else {
+		pending, err = store.CreateImage(imageName)
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save image: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	// Validate while storing, so a bad upload never replaces the image.
+	// FormFile has already received the whole body by now, so this only
+	// saves a second pass over it, not the transfer of a bad upload
+	pipeReader, pipeWriter := io.Pipe()
+	validated := make(chan error, 1)
+	go func() {
+		err := imgarchive.ValidateStream(pipeReader)
+		pipeReader.CloseWithError(err)
+		validated <- err
+	}()
+
+	_, err = io.Copy(io.MultiWriter(pending, pipeWriter), file)
+	pipeWriter.CloseWithError(err)
+	invalid := <-validated
+	// A failed validation stops the copy with its own error
+	if err != nil && err != invalid {
+		pending.Abort()
+		http.Error(w, fmt.Sprintf("Failed to save image: %v", err), http.StatusInternalServerError)
+		return
+	}
+	if invalid != nil {
+		pending.Abort()
+		http.Error(w, fmt.Sprintf("Invalid image archive: %v", invalid), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if !verifyDigest(w, pending, r.FormValue("digest")) {
+		return
+	}
+
+	if sig != nil {
+		if err := h.signing.Trusted(pending.Digest(), sig); err != nil {
+			pending.Abort()
+			http.Error(w, fmt.Sprintf("Signature rejected: %v", err), http.StatusForbidden)
+			return
+		}
+		pending.Meta.Signature = sig
+	}
+
+	err = pending.Commit()
 	if err != nil {
 		http.Error(w, fmt.Sprintf("Failed to save image: %v", err), http.StatusInternalServerError)
 		return
@@ -42,56 +121,97 @@ func (h *ImageHandler) Upload(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{
 		"message":    "Image uploaded successfully",
 		"image_name": imageName,
+		"platform":   platform,
 	})
 }
 
+// resolve maps the image name in the URL and the optional ?platform= to the
+// namespace storage and the key the matching build is stored under.
+func (h *ImageHandler) resolve(w http.ResponseWriter, r *http.Request) (*storage.Storage, string, bool) {
+	vars := mux.Vars(r)
+	imageName := vars["name"]
+
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return nil, "", false
+	}
+
+	key, err := store.ResolveImage(imageName, r.URL.Query().Get("platform"))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Image not found: %v", err), http.StatusNotFound)
+		return nil, "", false
+	}
+	return store, key, true
+}
+
 func (h *ImageHandler) Download(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	imageName := vars["name"]
 
-	file, err := h.storage.GetImage(imageName)
+	store, key, ok := h.resolve(w, r)
+	if !ok {
+		return
+	}
+
+	file, err := store.GetImage(key)
 	if err != nil {
 		http.Error(w, "Image not found", http.StatusNotFound)
 		return
 	}
 	defer file.Close()
 
-	// Get file info to set Content-Length
-	fileInfo, err := file.Stat()
+	meta, err := store.ImageMeta(key)
 	if err != nil {
 		http.Error(w, "Failed to get image info", http.StatusInternalServerError)
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s.tar.gz", imageName))
-	w.Header().Set("Content-Length", fmt.Sprintf("%d", fileInfo.Size()))
+	serveObject(w, r, imageName+".tar.gz", file, meta)
+}
 
-	_, err = io.Copy(w, file)
-	if err != nil {
-		http.Error(w, "Failed to download image", http.StatusInternalServerError)
+func (h *ImageHandler) List(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
 		return
 	}
-}
 
-func (h *ImageHandler) List(w http.ResponseWriter, r *http.Request) {
-	images, err := h.storage.ListImages()
+	infos, err := store.ListImageInfo()
 	if err != nil {
 		http.Error(w, "Failed to list images", http.StatusInternalServerError)
 		return
 	}
 
+	images := []string{}
+	platforms := make(map[string][]string)
+	for _, info := range infos {
+		images = append(images, info.Name)
+		if len(info.Platforms) > 0 {
+			platforms[info.Name] = info.Platforms
+		}
+	}
+
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]interface{}{
-		"images": images,
+		"images":    images,
+		"platforms": platforms,
 	})
 }
 
 func (h *ImageHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
 	vars := mux.Vars(r)
 	imageName := vars["name"]
 
-	err := h.storage.DeleteImage(imageName)
+	var err error
+	if platform := r.URL.Query().Get("platform"); platform != "" {
+		err = store.DeleteImageVariant(imageName, platform)
+	} else {
+		err = store.DeleteImage(imageName)
+	}
 	if err != nil {
 		http.Error(w, "Failed to delete image", http.StatusInternalServerError)
 		return
@@ -101,4 +221,204 @@ func (h *ImageHandler) Delete(w http.ResponseWriter, r *http.Request) {
 	json.NewEncoder(w).Encode(map[string]string{
 		"message": "Image deleted successfully",
 	})
-}
\ No newline at end of file
+}
+
+func (h *ImageHandler) Digest(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	imageName := vars["name"]
+
+	store, key, ok := h.resolve(w, r)
+	if !ok {
+		return
+	}
+
+	meta, err := store.ImageMeta(key)
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"name":     imageName,
+		"digest":   meta.Digest,
+		"size":     meta.Size,
+		"signed":   meta.Signature != nil,
+		"promoted": meta.Promoted,
+	})
+}
+
+func (h *ImageHandler) GetSignature(w http.ResponseWriter, r *http.Request) {
+	store, key, ok := h.resolve(w, r)
+	if !ok {
+		return
+	}
+
+	meta, err := store.ImageMeta(key)
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+	if meta.Signature == nil {
+		http.Error(w, "Image is not signed", http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(meta.Signature)
+}
+
+func (h *ImageHandler) PutSignature(w http.ResponseWriter, r *http.Request) {
+	store, key, ok := h.resolve(w, r)
+	if !ok {
+		return
+	}
+
+	sig := &sign.Signature{}
+	if err := json.NewDecoder(r.Body).Decode(sig); err != nil {
+		http.Error(w, "Invalid signature", http.StatusBadRequest)
+		return
+	}
+
+	meta, err := store.ImageMeta(key)
+	if err != nil {
+		http.Error(w, "Image not found", http.StatusNotFound)
+		return
+	}
+
+	if err := h.signing.Trusted(meta.Digest, sig); err != nil {
+		http.Error(w, fmt.Sprintf("Signature rejected: %v", err), http.StatusForbidden)
+		return
+	}
+
+	err = store.SetImageSignature(key, sig)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to save signature: %v", err), http.StatusConflict)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Image signed successfully",
+		"digest":  sig.Digest,
+	})
+}
+
+func (h *ImageHandler) Prune(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	if h.retention == nil {
+		http.Error(w, "No retention policy configured", http.StatusBadRequest)
+		return
+	}
+
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+
+	deleted, err := h.retention.Enforce(store, dryRun)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to prune images: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"deleted": deleted,
+		"dry_run": dryRun,
+	})
+}
+
+// validImageName reports whether name can be an image of this storage.
+// Names from the query string are not limited like mux path variables, so
+// anything that could leave the images directory or collide with a
+// platform variant ("@") is refused.
+func validImageName(name string) bool {
+	return name != "" && !strings.ContainsAny(name, "/\\@") && !strings.Contains(name, "..")
+}
+
+// Diff compares two stored images: GET /img/diff?a=api:1.3&b=api:1.4
+func (h *ImageHandler) Diff(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	nameA, nameB := query.Get("a"), query.Get("b")
+	if nameA == "" || nameB == "" {
+		http.Error(w, "Both a and b image names are required", http.StatusBadRequest)
+		return
+	}
+	for _, name := range []string{nameA, nameB} {
+		if !validImageName(name) {
+			http.Error(w, fmt.Sprintf("Invalid image name %q", name), http.StatusBadRequest)
+			return
+		}
+	}
+
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	dir, err := os.MkdirTemp(store.TempDir, "diff-")
+	if err != nil {
+		http.Error(w, "Failed to diff images", http.StatusInternalServerError)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	var snaps []*imgarchive.Snapshot
+	for i, name := range []string{nameA, nameB} {
+		key, err := store.ResolveImage(name, query.Get("platform"))
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Image not found: %v", err), http.StatusNotFound)
+			return
+		}
+
+		file, err := store.GetImage(key)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Image %s not found", name), http.StatusNotFound)
+			return
+		}
+		snap, err := imgarchive.LoadSnapshot(file, filepath.Join(dir, strconv.Itoa(i)))
+		file.Close()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to read image %s: %v", name, err), http.StatusUnprocessableEntity)
+			return
+		}
+		snaps = append(snaps, snap)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(imgarchive.Compare(snaps[0], snaps[1]))
+}
+
+// Promote copies an image with all its platform builds between namespaces:
+// POST /img/promote?name=api:1.4&from=dev&to=prod
+func (h *ImageHandler) Promote(w http.ResponseWriter, r *http.Request) {
+	imageName := r.URL.Query().Get("name")
+	if !validImageName(imageName) {
+		http.Error(w, fmt.Sprintf("Invalid image name %q", imageName), http.StatusBadRequest)
+		return
+	}
+
+	source, target, promoted, ok := promotion(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	err := source.PromoteImage(imageName, target, promoted)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, fmt.Sprintf("Image %s not found", imageName), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to promote image: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":    "Image promoted successfully",
+		"image_name": imageName,
+		"promoted":   promoted,
+	})
+}
@@ -0,0 +1,64 @@
+package handler
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/internal/storage"
+	"github.com/dollarkillerx/unregistry/pkg/auth"
+)
+
+// namespace returns the storage of the namespace named by ?namespace=,
+// making sure the caller's token covers it.
+func namespace(w http.ResponseWriter, r *http.Request, s *storage.Storage) (*storage.Storage, bool) {
+	name := r.URL.Query().Get("namespace")
+	if !auth.FromContext(r.Context()).Allows(name) {
+		http.Error(w, fmt.Sprintf("Token is not allowed to access namespace %q", name), http.StatusForbidden)
+		return nil, false
+	}
+
+	store, err := s.Namespace(name)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return store, true
+}
+
+// promotion parses ?from= and ?to= of a promote request and returns the
+// source and target storage. The caller's token must cover both
+// namespaces.
+func promotion(w http.ResponseWriter, r *http.Request, s *storage.Storage) (*storage.Storage, *storage.Storage, *storage.Promotion, bool) {
+	query := r.URL.Query()
+	from, to := query.Get("from"), query.Get("to")
+	if from == to {
+		http.Error(w, "Source and target namespace are the same", http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+
+	// Promoting reads the source and writes the target, so a token needs
+	// both: otherwise it could copy out of a namespace it cannot read
+	id := auth.FromContext(r.Context())
+	if !id.Allows(from) {
+		http.Error(w, fmt.Sprintf("Token is not allowed to promote from namespace %q", from), http.StatusForbidden)
+		return nil, nil, nil, false
+	}
+	if !id.Allows(to) {
+		http.Error(w, fmt.Sprintf("Token is not allowed to promote into namespace %q", to), http.StatusForbidden)
+		return nil, nil, nil, false
+	}
+
+	source, err := s.Namespace(from)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+	target, err := s.Namespace(to)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, nil, nil, false
+	}
+
+	return source, target, &storage.Promotion{From: from, By: id.Name, At: time.Now().UTC()}, true
+}
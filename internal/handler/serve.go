@@ -0,0 +1,113 @@
+package handler
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/internal/storage"
+)
+
+// serveObject sends a stored file or image. The digest is the ETag, so
+// Range requests with If-Range resume a download only while the object is
+// unchanged, and is sent as a Digest header for clients to verify what
+// they received. With the modification time as Last-Modified, clients that
+// already hold the object get a 304 for If-None-Match or If-Modified-Since.
+func serveObject(w http.ResponseWriter, r *http.Request, filename string, file *os.File, meta *storage.Meta) {
+	var modTime time.Time
+	if info, err := file.Stat(); err == nil {
+		modTime = info.ModTime()
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", filename))
+	w.Header().Set("ETag", `"`+meta.Digest+`"`)
+	if value := digestHeader(meta.Digest); value != "" {
+		w.Header().Set("Digest", value)
+	}
+
+	http.ServeContent(w, r, filename, modTime, file)
+}
+
+// digestHeader formats a "sha256:<hex>" digest as a Digest header value.
+func digestHeader(digest string) string {
+	sum, err := hex.DecodeString(strings.TrimPrefix(digest, "sha256:"))
+	if err != nil || !strings.HasPrefix(digest, "sha256:") {
+		return ""
+	}
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum)
+}
+
+// verifyDigest aborts pending and answers 422 when the client sent a digest
+// that the received content does not match. It accepts bare hex or
+// "sha256:<hex>"; an empty digest skips the check.
+func verifyDigest(w http.ResponseWriter, pending *storage.Pending, digest string) bool {
+	if digest == "" {
+		return true
+	}
+	if !strings.HasPrefix(digest, "sha256:") {
+		digest = "sha256:" + digest
+	}
+	if pending.Digest() != strings.ToLower(digest) {
+		pending.Abort()
+		http.Error(w, fmt.Sprintf("Digest mismatch: received %s, expected %s", pending.Digest(), digest), http.StatusUnprocessableEntity)
+		return false
+	}
+	return true
+}
+
+// uploadCondition reads If-Match and If-None-Match from an upload. Their
+// ETags are the digests downloads carry, or "*"; nil means the upload
+// replaces whatever is stored.
+func uploadCondition(r *http.Request) *storage.Condition {
+	match := etagList(r.Header.Get("If-Match"))
+	noneMatch := etagList(r.Header.Get("If-None-Match"))
+	if len(match) == 0 && len(noneMatch) == 0 {
+		return nil
+	}
+	return &storage.Condition{Match: match, NoneMatch: noneMatch}
+}
+
+func etagList(header string) []string {
+	var etags []string
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.Trim(strings.TrimPrefix(strings.TrimSpace(etag), "W/"), `"`)
+		if etag != "" {
+			etags = append(etags, etag)
+		}
+	}
+	return etags
+}
+
+// checkCondition answers 412 when the stored file already rules out an
+// upload under condition, before its content is received.
+func checkCondition(w http.ResponseWriter, store *storage.Storage, filename string, condition *storage.Condition) bool {
+	if condition == nil {
+		return true
+	}
+	err := store.CheckFile(filename, condition)
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return false
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to check file: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// commitFailed reports a Pending.Commit that did not go through: 412 when
+// the stored object no longer satisfies the upload's condition.
+func commitFailed(w http.ResponseWriter, err error) {
+	if errors.Is(err, storage.ErrPreconditionFailed) {
+		http.Error(w, err.Error(), http.StatusPreconditionFailed)
+		return
+	}
+	http.Error(w, fmt.Sprintf("Failed to save file: %v", err), http.StatusInternalServerError)
+}
@@ -0,0 +1,294 @@
+package handler
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/internal/storage"
+	"github.com/dollarkillerx/unregistry/pkg/auth"
+	"github.com/gorilla/mux"
+)
+
+// shareSignature signs what a share link grants, so none of it can be
+// changed without the server noticing.
+func (h *FileHandler) shareSignature(id, namespace, filename string, expires int64) string {
+	mac := hmac.New(sha256.New, h.shareKey)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%d", id, namespace, filename, expires)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// shareURL is the path and query of the download a share link points at.
+func (h *FileHandler) shareURL(namespace string, share *storage.Share) string {
+	query := url.Values{
+		"share":   {share.ID},
+		"expires": {strconv.FormatInt(share.Expires.Unix(), 10)},
+		"sig":     {h.shareSignature(share.ID, namespace, share.Name, share.Expires.Unix())},
+	}
+	if namespace != "" {
+		query.Set("namespace", namespace)
+	}
+	path := &url.URL{Path: "/api/file/download/" + share.Name}
+	return path.EscapedPath() + "?" + query.Encode()
+}
+
+// sharedStore checks the signed share link of a download made without a
+// token and returns the storage of its namespace with the link's id. The
+// download is counted later, by useShare, once it is known what is sent.
+func (h *FileHandler) sharedStore(w http.ResponseWriter, r *http.Request, filename string) (*storage.Storage, string, bool) {
+	query := r.URL.Query()
+	id, ns := query.Get("share"), query.Get("namespace")
+	expires, err := strconv.ParseInt(query.Get("expires"), 10, 64)
+	if err != nil || !hmac.Equal([]byte(query.Get("sig")), []byte(h.shareSignature(id, ns, filename, expires))) {
+		http.Error(w, "Invalid share link", http.StatusForbidden)
+		return nil, "", false
+	}
+	if time.Now().Unix() > expires {
+		http.Error(w, "Share link expired", http.StatusGone)
+		return nil, "", false
+	}
+
+	store, err := h.storage.Namespace(ns)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return nil, "", false
+	}
+
+	_, err = store.CheckShare(id, filename)
+	if !shareUsable(w, err) {
+		return nil, "", false
+	}
+	return store, id, true
+}
+
+// useShare counts a download through the share link id when the response
+// sends the file's first byte: a GET of the whole file, or of ranges of
+// which any covers byte 0. HEAD requests, revalidations answered with 304
+// and ranges resuming a download are free, so a download is counted once
+// however the client fetches it, and nobody gets the whole file for free.
+func useShare(w http.ResponseWriter, r *http.Request, store *storage.Storage, id, filename string, file *os.File, meta *storage.Meta) bool {
+	var modTime time.Time
+	size := meta.Size
+	if info, err := file.Stat(); err == nil {
+		modTime, size = info.ModTime(), info.Size()
+	}
+	if r.Method != http.MethodGet || notModified(r, meta.Digest, modTime) || !fromStart(r, meta.Digest, modTime, size) {
+		return true
+	}
+
+	_, err := store.UseShare(id, filename)
+	return shareUsable(w, err)
+}
+
+// shareUsable answers the request and returns false when err means the
+// share link cannot be used.
+func shareUsable(w http.ResponseWriter, err error) bool {
+	switch {
+	case errors.Is(err, storage.ErrShareNotFound) || errors.Is(err, storage.ErrShareExpired) || errors.Is(err, storage.ErrShareUsedUp):
+		http.Error(w, fmt.Sprintf("Share link is no longer valid: %v", err), http.StatusGone)
+		return false
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Failed to check share link: %v", err), http.StatusInternalServerError)
+		return false
+	}
+	return true
+}
+
+// notModified reports whether http.ServeContent will answer r with 304
+// for content with digest, last modified at modTime.
+func notModified(r *http.Request, digest string, modTime time.Time) bool {
+	if header := r.Header.Get("If-None-Match"); header != "" {
+		for _, etag := range etagList(header) {
+			if etag == "*" || etag == digest {
+				return true
+			}
+		}
+		return false
+	}
+
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modTime.IsZero() && !modTime.Truncate(time.Second).After(since)
+}
+
+// fromStart reports whether http.ServeContent may send r the first byte of
+// content size bytes long: there is no range, a range covers byte 0, or
+// If-Range no longer matches and the whole content is sent instead.
+func fromStart(r *http.Request, digest string, modTime time.Time, size int64) bool {
+	ranges := r.Header.Get("Range")
+	if ranges == "" {
+		return true
+	}
+
+	ifRange := r.Header.Get("If-Range")
+	switch {
+	case ifRange == "":
+	case strings.HasPrefix(ifRange, `"`):
+		if strings.Trim(ifRange, `"`) != digest {
+			return true
+		}
+	default:
+		if at, err := http.ParseTime(ifRange); err != nil || !modTime.Truncate(time.Second).Equal(at) {
+			return true
+		}
+	}
+	return rangesFromStart(ranges, size)
+}
+
+// rangesFromStart reports whether the Range header ranges, read the way
+// http.ServeContent reads it, asks for byte 0 of content size bytes long.
+// That includes suffix ranges longer than the content and ranges adding up
+// to more than the content, which is then sent whole. A header that does
+// not parse counts as asking for byte 0.
+func rangesFromStart(ranges string, size int64) bool {
+	spec, ok := strings.CutPrefix(ranges, "bytes=")
+	if !ok {
+		return true
+	}
+
+	var total int64
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		first, last, ok := strings.Cut(part, "-")
+		if !ok {
+			return true
+		}
+		first, last = strings.TrimSpace(first), strings.TrimSpace(last)
+
+		var start, length int64
+		if first == "" {
+			// The last n bytes
+			n, err := strconv.ParseInt(last, 10, 64)
+			if err != nil || n < 0 {
+				return true
+			}
+			start = size - min(n, size)
+			length = size - start
+		} else {
+			var err error
+			start, err = strconv.ParseInt(first, 10, 64)
+			if err != nil || start < 0 {
+				return true
+			}
+			if start >= size {
+				// Not satisfiable, and left out of the response
+				continue
+			}
+			end := size - 1
+			if last != "" {
+				if end, err = strconv.ParseInt(last, 10, 64); err != nil || end < start {
+					return true
+				}
+				end = min(end, size-1)
+			}
+			length = end - start + 1
+		}
+
+		if start == 0 && length > 0 {
+			return true
+		}
+		total += length
+	}
+	return total > size
+}
+
+// Share creates a link that downloads a file without a token:
+// POST /api/file/share?name=report.pdf&expires=24h&max_downloads=3
+func (h *FileHandler) Share(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	filename := query.Get("name")
+	if !validFileName(filename) {
+		http.Error(w, fmt.Sprintf("Invalid file name %q", filename), http.StatusBadRequest)
+		return
+	}
+
+	ttl, err := time.ParseDuration(query.Get("expires"))
+	if err != nil || ttl <= 0 {
+		http.Error(w, "Invalid expires duration", http.StatusBadRequest)
+		return
+	}
+
+	maxDownloads := 0
+	if value := query.Get("max_downloads"); value != "" {
+		maxDownloads, err = strconv.Atoi(value)
+		if err != nil || maxDownloads < 0 {
+			http.Error(w, "Invalid max_downloads", http.StatusBadRequest)
+			return
+		}
+	}
+
+	share, err := store.CreateShare(filename, ttl, maxDownloads, auth.FromContext(r.Context()).Name)
+	if errors.Is(err, os.ErrNotExist) {
+		http.Error(w, "File not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create share link: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"share": share,
+		"url":   h.shareURL(query.Get("namespace"), share),
+	})
+}
+
+// Shares lists the live share links: GET /api/file/shares
+func (h *FileHandler) Shares(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	shares, err := store.ListShares()
+	if err != nil {
+		http.Error(w, "Failed to list share links", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"shares": shares,
+	})
+}
+
+// Unshare revokes a share link: DELETE /api/file/shares/{id}
+func (h *FileHandler) Unshare(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	err := store.RevokeShare(mux.Vars(r)["id"])
+	if errors.Is(err, storage.ErrShareNotFound) || errors.Is(err, storage.ErrShareExpired) {
+		http.Error(w, "Share link not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to revoke share link: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Share link revoked",
+	})
+}
@@ -0,0 +1,207 @@
+package handler
+
+import (
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/internal/storage"
+	"github.com/gorilla/mux"
+)
+
+const shareContent = "0123456789"
+
+// shareServer serves share link downloads of a file holding shareContent.
+func shareServer(t *testing.T) (*FileHandler, *storage.Storage, *mux.Router) {
+	t.Helper()
+
+	store := storage.New(t.TempDir())
+	if err := store.SaveFile("docs/report.txt", strings.NewReader(shareContent)); err != nil {
+		t.Fatal(err)
+	}
+	h := NewFileHandler(store, []byte("test-key"))
+
+	r := mux.NewRouter()
+	r.HandleFunc("/api/file/download/{filename:.+}", h.Download).Methods("GET", "HEAD").Queries("sig", "{sig}")
+	return h, store, r
+}
+
+func shareRequest(r *mux.Router, method, url string, header map[string]string) *http.Response {
+	req := httptest.NewRequest(method, url, nil)
+	for key, value := range header {
+		req.Header.Set(key, value)
+	}
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	return rec.Result()
+}
+
+// sentFirstByte reports whether resp carries byte 0 of the file.
+func sentFirstByte(t *testing.T, method string, resp *http.Response) bool {
+	t.Helper()
+
+	if method == http.MethodHead {
+		return false
+	}
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true
+	case http.StatusPartialContent:
+	default:
+		return false
+	}
+
+	mediaType, params, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if mediaType != "multipart/byteranges" {
+		return strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes 0-")
+	}
+	parts := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := parts.NextPart()
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			t.Fatalf("read multipart response: %v", err)
+		}
+		if strings.HasPrefix(part.Header.Get("Content-Range"), "bytes 0-") {
+			return true
+		}
+	}
+}
+
+func TestShareDownloadCounting(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		header  map[string]string
+		counted bool
+	}{
+		{"whole file", "GET", nil, true},
+		{"range from 0", "GET", map[string]string{"Range": "bytes=0-"}, true},
+		{"first byte", "GET", map[string]string{"Range": "bytes=0-0"}, true},
+		{"resumed", "GET", map[string]string{"Range": "bytes=5-"}, false},
+		{"middle", "GET", map[string]string{"Range": "bytes=5-6"}, false},
+		{"short suffix", "GET", map[string]string{"Range": "bytes=-3"}, false},
+		{"suffix of the whole file", "GET", map[string]string{"Range": "bytes=-10"}, true},
+		{"suffix longer than the file", "GET", map[string]string{"Range": "bytes=-99999999999"}, true},
+		{"multi-range covering 0", "GET", map[string]string{"Range": "bytes=1-,0-0"}, true},
+		{"multi-range past 0", "GET", map[string]string{"Range": "bytes=5-6,2-3"}, false},
+		{"multi-range larger than the file", "GET", map[string]string{"Range": "bytes=1-,1-"}, true},
+		{"spaces", "GET", map[string]string{"Range": "bytes= 4-5, 0-1"}, true},
+		{"unsatisfiable", "GET", map[string]string{"Range": "bytes=20-"}, false},
+		{"malformed", "GET", map[string]string{"Range": "bytes=x-"}, true},
+		{"stale If-Range", "GET", map[string]string{"Range": "bytes=5-", "If-Range": `"sha256:0000"`}, true},
+		{"HEAD", "HEAD", nil, false},
+		{"revalidation", "GET", map[string]string{"If-None-Match": "*"}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, store, r := shareServer(t)
+			share, err := store.CreateShare("docs/report.txt", time.Hour, 0, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := shareRequest(r, test.method, h.shareURL("", share), test.header)
+			sent := sentFirstByte(t, test.method, resp)
+
+			share, err = store.GetShare(share.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if counted := share.Downloads == 1; counted != test.counted {
+				t.Fatalf("status %d, counted %v, want %v", resp.StatusCode, counted, test.counted)
+			}
+			if sent && share.Downloads == 0 {
+				t.Fatalf("status %d sent byte 0 without counting a download", resp.StatusCode)
+			}
+		})
+	}
+}
+
+func TestShareMatchingIfRange(t *testing.T) {
+	h, store, r := shareServer(t)
+	share, err := store.CreateShare("docs/report.txt", time.Hour, 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := h.shareURL("", share)
+
+	resp := shareRequest(r, "GET", url, nil)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("first download: status %d", resp.StatusCode)
+	}
+
+	// Resuming that download is free, even with the link used up
+	resp = shareRequest(r, "GET", url, map[string]string{"Range": "bytes=5-", "If-Range": resp.Header.Get("ETag")})
+	if resp.StatusCode != http.StatusPartialContent {
+		t.Fatalf("resumed download: status %d", resp.StatusCode)
+	}
+	if resp := shareRequest(r, "GET", url, nil); resp.StatusCode != http.StatusGone {
+		t.Fatalf("download past the limit: status %d", resp.StatusCode)
+	}
+}
+
+func TestShareLinkRejected(t *testing.T) {
+	tests := []struct {
+		name   string
+		url    func(h *FileHandler, store *storage.Storage, share *storage.Share) string
+		status int
+	}{
+		{"valid", func(h *FileHandler, store *storage.Storage, share *storage.Share) string {
+			return h.shareURL("", share)
+		}, http.StatusOK},
+		{"bad signature", func(h *FileHandler, store *storage.Storage, share *storage.Share) string {
+			return strings.Replace(h.shareURL("", share), "sig=", "sig=x", 1)
+		}, http.StatusForbidden},
+		{"other file", func(h *FileHandler, store *storage.Storage, share *storage.Share) string {
+			store.SaveFile("docs/other.txt", strings.NewReader("other"))
+			return strings.Replace(h.shareURL("", share), "report.txt", "other.txt", 1)
+		}, http.StatusForbidden},
+		{"extended expiry", func(h *FileHandler, store *storage.Storage, share *storage.Share) string {
+			expires := strconv.FormatInt(share.Expires.Unix(), 10)
+			later := strconv.FormatInt(share.Expires.Add(time.Hour).Unix(), 10)
+			return strings.Replace(h.shareURL("", share), "expires="+expires, "expires="+later, 1)
+		}, http.StatusForbidden},
+		{"expired", func(h *FileHandler, store *storage.Storage, share *storage.Share) string {
+			share.Expires = time.Now().Add(-time.Minute).Truncate(time.Second)
+			return h.shareURL("", share)
+		}, http.StatusGone},
+		{"revoked", func(h *FileHandler, store *storage.Storage, share *storage.Share) string {
+			store.RevokeShare(share.ID)
+			return h.shareURL("", share)
+		}, http.StatusGone},
+		{"used up", func(h *FileHandler, store *storage.Storage, share *storage.Share) string {
+			store.UseShare(share.ID, share.Name)
+			return h.shareURL("", share)
+		}, http.StatusGone},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h, store, r := shareServer(t)
+			share, err := store.CreateShare("docs/report.txt", time.Hour, 1, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			resp := shareRequest(r, "GET", test.url(h, store, share), nil)
+			if resp.StatusCode != test.status {
+				t.Fatalf("status %d, want %d", resp.StatusCode, test.status)
+			}
+			if test.status != http.StatusOK {
+				if body, _ := io.ReadAll(resp.Body); strings.Contains(string(body), shareContent) {
+					t.Fatal("rejected request got the file")
+				}
+			}
+		})
+	}
+}
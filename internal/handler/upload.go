@@ -0,0 +1,291 @@
+package handler
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/internal/storage"
+	"github.com/dollarkillerx/unregistry/pkg/imgarchive"
+	"github.com/dollarkillerx/unregistry/pkg/sign"
+	"github.com/gorilla/mux"
+)
+
+// UploadHandler serves resumable uploads: a session is created, chunks are
+// PUT at increasing offsets, and finishing checks the digest of everything
+// received before the file or image is committed.
+type UploadHandler struct {
+	storage *storage.Storage
+	signing *sign.Policy
+	ttl     time.Duration
+	// extract bounds the archives uploaded with extract=true
+	extract storage.ExtractLimits
+}
+
+func NewUploadHandler(storage *storage.Storage, signing *sign.Policy, ttl time.Duration, extract storage.ExtractLimits) *UploadHandler {
+	return &UploadHandler{storage: storage, signing: signing, ttl: ttl, extract: extract}
+}
+
+// Create starts a session: POST /api/upload?kind=file|image&name=...&platform=...
+func (h *UploadHandler) Create(w http.ResponseWriter, r *http.Request) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	name := query.Get("name")
+	kind := query.Get("kind")
+	// Files may be nested under directories, images may not
+	if !validFileName(name) || (kind == storage.SessionImage && !validImageName(name)) {
+		http.Error(w, fmt.Sprintf("Invalid upload name %q", name), http.StatusBadRequest)
+		return
+	}
+
+	// Conditional uploads fail here already when they cannot succeed, and
+	// are checked for good when they finish
+	if kind == storage.SessionFile && !checkCondition(w, store, name, uploadCondition(r)) {
+		return
+	}
+
+	session, err := store.CreateSession(kind, name, query.Get("platform"), h.ttl)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Failed to create upload: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(session)
+}
+
+// session loads the session named in the URL from the caller's namespace.
+func (h *UploadHandler) session(w http.ResponseWriter, r *http.Request) (*storage.Storage, string, bool) {
+	store, ok := namespace(w, r, h.storage)
+	if !ok {
+		return nil, "", false
+	}
+	return store, mux.Vars(r)["id"], true
+}
+
+// sessionError reports a session lookup or write failure.
+func sessionError(w http.ResponseWriter, err error) {
+	var offsetErr *storage.OffsetError
+	switch {
+	case errors.Is(err, storage.ErrSessionNotFound):
+		http.Error(w, "Upload not found or expired", http.StatusNotFound)
+	case errors.Is(err, storage.ErrSessionBusy):
+		http.Error(w, "Upload is receiving data from another request", http.StatusConflict)
+	case errors.As(err, &offsetErr):
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"error":  err.Error(),
+			"offset": offsetErr.Offset,
+		})
+	default:
+		http.Error(w, fmt.Sprintf("Failed to store upload: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// Status reports how much was received: GET /api/upload/{id}
+func (h *UploadHandler) Status(w http.ResponseWriter, r *http.Request) {
+	store, id, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+
+	session, err := store.GetSession(id)
+	if err != nil {
+		sessionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(session)
+}
+
+// Chunk appends the body: PUT /api/upload/{id}?offset=N. The offset must be
+// where the received data ends; a 409 answer carries the right one.
+func (h *UploadHandler) Chunk(w http.ResponseWriter, r *http.Request) {
+	store, id, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		http.Error(w, "Invalid offset", http.StatusBadRequest)
+		return
+	}
+
+	offset, err = store.WriteSession(id, offset, r.Body)
+	if err != nil {
+		sessionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"offset": offset,
+	})
+}
+
+// Finish commits the upload: POST /api/upload/{id}/finish?digest=sha256:...
+// Images are validated like a direct upload and may carry a signature
+// form value. A file uploaded with extract=true must be a zip or tar.gz,
+// which replaces everything under the directory the session names.
+// If-Match and If-None-Match make the commit conditional, with a 412 when
+// the stored object does not satisfy them.
+func (h *UploadHandler) Finish(w http.ResponseWriter, r *http.Request) {
+	store, id, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+
+	digest := r.URL.Query().Get("digest")
+	if digest == "" {
+		http.Error(w, "Missing digest", http.StatusBadRequest)
+		return
+	}
+
+	session, err := store.GetSession(id)
+	if err != nil {
+		sessionError(w, err)
+		return
+	}
+
+	extract := r.URL.Query().Get("extract") == "true"
+	if extract && session.Kind != storage.SessionFile {
+		http.Error(w, "Only file uploads can be extracted", http.StatusBadRequest)
+		return
+	}
+	condition := uploadCondition(r)
+	if extract && condition != nil {
+		http.Error(w, "Extracted uploads cannot be conditional", http.StatusBadRequest)
+		return
+	}
+
+	var sig *sign.Signature
+	if value := r.FormValue("signature"); value != "" {
+		sig = &sign.Signature{}
+		if err := json.Unmarshal([]byte(value), sig); err != nil {
+			http.Error(w, "Invalid signature", http.StatusBadRequest)
+			return
+		}
+	}
+
+	var check func(io.Reader) error
+	if session.Kind == storage.SessionImage {
+		if sig == nil && h.signing.Required(session.Name) {
+			http.Error(w, fmt.Sprintf("Image %s requires a signed push", session.Name), http.StatusForbidden)
+			return
+		}
+		check = imgarchive.ValidateStream
+	}
+
+	pending, err := store.FinishSession(id, check)
+	if err != nil {
+		if errors.Is(err, storage.ErrSessionNotFound) || errors.Is(err, storage.ErrSessionBusy) {
+			sessionError(w, err)
+			return
+		}
+		// Either way the session stays until it is cancelled or expires
+		var checkErr *storage.CheckError
+		if errors.As(err, &checkErr) {
+			http.Error(w, fmt.Sprintf("Invalid image archive: %v", checkErr.Err), http.StatusUnprocessableEntity)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to finish upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	if !verifyDigest(w, pending, digest) {
+		return
+	}
+
+	if sig != nil {
+		if err := h.signing.Trusted(pending.Digest(), sig); err != nil {
+			pending.Abort()
+			http.Error(w, fmt.Sprintf("Signature rejected: %v", err), http.StatusForbidden)
+			return
+		}
+		pending.Meta.Signature = sig
+	}
+
+	if extract {
+		h.extractUpload(w, pending, session.Name)
+		return
+	}
+
+	pending.Condition = condition
+	if err := pending.Commit(); err != nil {
+		if errors.Is(err, storage.ErrPreconditionFailed) {
+			http.Error(w, err.Error(), http.StatusPreconditionFailed)
+			return
+		}
+		http.Error(w, fmt.Sprintf("Failed to save upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message":  "Upload finished",
+		"kind":     session.Kind,
+		"name":     session.Name,
+		"platform": session.Platform,
+		"digest":   pending.Meta.Digest,
+		"size":     pending.Meta.Size,
+	})
+}
+
+// Cancel drops a session and its data: DELETE /api/upload/{id}
+func (h *UploadHandler) Cancel(w http.ResponseWriter, r *http.Request) {
+	store, id, ok := h.session(w, r)
+	if !ok {
+		return
+	}
+
+	if err := store.DeleteSession(id); err != nil {
+		sessionError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"message": "Upload cancelled",
+	})
+}
+
+// extractUpload expands a finished upload into the directory prefix.
+func (h *UploadHandler) extractUpload(w http.ResponseWriter, pending *storage.Pending, prefix string) {
+	extraction, err := pending.Extract(prefix, h.extract)
+	switch {
+	case errors.Is(err, storage.ErrInvalidArchive):
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	case errors.Is(err, storage.ErrExtractLimit):
+		http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+		return
+	case errors.Is(err, storage.ErrExtractTarget):
+		// Not a 409: clients retry those while a session is busy
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Failed to extract upload: %v", err), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"message": "Upload extracted",
+		"kind":    storage.SessionFile,
+		"name":    prefix + "/",
+		"files":   extraction.Files,
+		"size":    extraction.Size,
+	})
+}
@@ -0,0 +1,182 @@
+package retention
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/internal/storage"
+)
+
+// Rule describes what to keep for the repositories matching Repository
+// (a path.Match glob against the image name without its tag).
+type Rule struct {
+	Repository string `json:"repository"`
+	// KeepLast keeps the N most recently pushed tags. Zero keeps all tags.
+	KeepLast int `json:"keep_last"`
+	// KeepTags lists tag patterns (e.g. "v*") that are never deleted.
+	KeepTags []string `json:"keep_tags"`
+	// UntaggedDays deletes images pushed without a tag once they are older
+	// than this many days. Zero keeps them.
+	UntaggedDays int `json:"untagged_days"`
+}
+
+type Policy struct {
+	Rules []Rule `json:"rules"`
+}
+
+func LoadPolicy(policyPath string) (*Policy, error) {
+	data, err := os.ReadFile(policyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read retention policy: %w", err)
+	}
+
+	policy := &Policy{}
+	if err := json.Unmarshal(data, policy); err != nil {
+		return nil, fmt.Errorf("parse retention policy: %w", err)
+	}
+
+	for _, rule := range policy.Rules {
+		if _, err := path.Match(rule.Repository, ""); err != nil {
+			return nil, fmt.Errorf("invalid repository pattern %q: %w", rule.Repository, err)
+		}
+		for _, tag := range rule.KeepTags {
+			if _, err := path.Match(tag, ""); err != nil {
+				return nil, fmt.Errorf("invalid tag pattern %q: %w", tag, err)
+			}
+		}
+	}
+	return policy, nil
+}
+
+// splitName splits "repo:tag" into its parts. Names without a tag return an
+// empty tag.
+func splitName(imageName string) (string, string) {
+	if i := strings.LastIndex(imageName, ":"); i > strings.LastIndex(imageName, "/") {
+		return imageName[:i], imageName[i+1:]
+	}
+	return imageName, ""
+}
+
+func (p *Policy) rule(repo string) *Rule {
+	for i := range p.Rules {
+		if ok, _ := path.Match(p.Rules[i].Repository, repo); ok {
+			return &p.Rules[i]
+		}
+	}
+	return nil
+}
+
+func matchAny(patterns []string, value string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Plan returns the images the policy would delete at time now.
+func (p *Policy) Plan(images []storage.ImageInfo, now time.Time) []storage.ImageInfo {
+	repos := make(map[string][]storage.ImageInfo)
+	for _, image := range images {
+		repo, _ := splitName(image.Name)
+		repos[repo] = append(repos[repo], image)
+	}
+
+	var doomed []storage.ImageInfo
+	for repo, images := range repos {
+		rule := p.rule(repo)
+		if rule == nil {
+			continue
+		}
+
+		// Newest first, so the first KeepLast tags are the ones to keep
+		sort.Slice(images, func(i, j int) bool {
+			return images[i].ModTime.After(images[j].ModTime)
+		})
+
+		kept := 0
+		for _, image := range images {
+			_, tag := splitName(image.Name)
+			if tag == "" {
+				if rule.UntaggedDays > 0 && now.Sub(image.ModTime) > time.Duration(rule.UntaggedDays)*24*time.Hour {
+					doomed = append(doomed, image)
+				}
+				continue
+			}
+
+			if matchAny(rule.KeepTags, tag) {
+				continue
+			}
+			if rule.KeepLast == 0 || kept < rule.KeepLast {
+				kept++
+				continue
+			}
+			doomed = append(doomed, image)
+		}
+	}
+
+	sort.Slice(doomed, func(i, j int) bool {
+		return doomed[i].Name < doomed[j].Name
+	})
+	return doomed
+}
+
+// Enforce deletes the images selected by Plan, or only reports them when
+// dryRun is set. It returns the names of the affected images.
+func (p *Policy) Enforce(s *storage.Storage, dryRun bool) ([]string, error) {
+	images, err := s.ListImageInfo()
+	if err != nil {
+		return nil, fmt.Errorf("list images: %w", err)
+	}
+
+	var deleted []string
+	for _, image := range p.Plan(images, time.Now()) {
+		if !dryRun {
+			if err := s.DeleteImage(image.Name); err != nil {
+				return deleted, fmt.Errorf("delete %s: %w", image.Name, err)
+			}
+		}
+		deleted = append(deleted, image.Name)
+	}
+	return deleted, nil
+}
+
+// Run enforces the policy every interval, in the default namespace and
+// every other one, until the process exits.
+func (p *Policy) Run(s *storage.Storage, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		p.enforceAll(s)
+	}
+}
+
+func (p *Policy) enforceAll(s *storage.Storage) {
+	for _, name := range append([]string{""}, s.Namespaces()...) {
+		ns, err := s.Namespace(name)
+		if err != nil {
+			log.Printf("Retention: %v", err)
+			continue
+		}
+
+		label := name
+		if label == "" {
+			label = "default"
+		}
+		deleted, err := p.Enforce(ns, false)
+		for _, image := range deleted {
+			log.Printf("Retention: deleted image %s in namespace %s", image, label)
+		}
+		if err != nil {
+			log.Printf("Retention: namespace %s: %v", label, err)
+		}
+	}
+}
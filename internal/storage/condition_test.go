@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+func digestOf(content string) string {
+	sum := sha256.Sum256([]byte(content))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+func TestCondition(t *testing.T) {
+	stored, other := digestOf("v1"), digestOf("v2")
+	tests := []struct {
+		name      string
+		stored    bool
+		condition Condition
+		ok        bool
+	}{
+		{"match", true, Condition{Match: []string{stored}}, true},
+		{"match one of", true, Condition{Match: []string{other, stored}}, true},
+		{"match another version", true, Condition{Match: []string{other}}, false},
+		{"match anything", true, Condition{Match: []string{"*"}}, true},
+		{"match with nothing stored", false, Condition{Match: []string{stored}}, false},
+		{"match anything with nothing stored", false, Condition{Match: []string{"*"}}, false},
+		{"none match", true, Condition{NoneMatch: []string{other}}, true},
+		{"none match the stored version", true, Condition{NoneMatch: []string{stored}}, false},
+		{"create only", true, Condition{NoneMatch: []string{"*"}}, false},
+		{"create only with nothing stored", false, Condition{NoneMatch: []string{"*"}}, true},
+		{"both", true, Condition{Match: []string{stored}, NoneMatch: []string{other}}, true},
+		{"both ruled out", true, Condition{Match: []string{stored}, NoneMatch: []string{stored}}, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			if test.stored {
+				if err := s.SaveFile("a.txt", strings.NewReader("v1")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			err := s.CheckFile("a.txt", &test.condition)
+			if test.ok != (err == nil) || (err != nil && !errors.Is(err, ErrPreconditionFailed)) {
+				t.Fatalf("CheckFile: %v", err)
+			}
+
+			pending, err := s.CreateFile("a.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			pending.Write([]byte("v3"))
+			pending.Condition = &test.condition
+			err = pending.Commit()
+			if test.ok != (err == nil) || (err != nil && !errors.Is(err, ErrPreconditionFailed)) {
+				t.Fatalf("Commit: %v", err)
+			}
+
+			want := "v3"
+			if !test.ok {
+				want = "v1"
+				if _, err := os.Stat(pending.file.Name()); !os.IsNotExist(err) {
+					t.Fatal("failed commit left its temp file behind")
+				}
+			}
+			if test.ok || test.stored {
+				if got := readStored(t, s, "a.txt"); got != want {
+					t.Fatalf("stored %q, want %q", got, want)
+				}
+			} else if _, err := s.FileMeta("a.txt"); err == nil {
+				t.Fatal("failed commit stored the file")
+			}
+		})
+	}
+}
+
+// A file that changes after CheckFile still fails the Commit.
+func TestConditionCheckedOnCommit(t *testing.T) {
+	s := New(t.TempDir())
+	condition := &Condition{NoneMatch: []string{"*"}}
+	if err := s.CheckFile("a.txt", condition); err != nil {
+		t.Fatalf("CheckFile: %v", err)
+	}
+
+	pending, err := s.CreateFile("a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending.Write([]byte("mine"))
+
+	if err := s.SaveFile("a.txt", strings.NewReader("theirs")); err != nil {
+		t.Fatal(err)
+	}
+	pending.Condition = condition
+	if err := pending.Commit(); !errors.Is(err, ErrPreconditionFailed) {
+		t.Fatalf("Commit over a file stored in between: %v", err)
+	}
+	if got := readStored(t, s, "a.txt"); got != "theirs" {
+		t.Fatalf("stored %q, want the other writer's content", got)
+	}
+}
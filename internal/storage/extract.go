@@ -0,0 +1,250 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ErrInvalidArchive = errors.New("invalid archive")
+	ErrExtractLimit   = errors.New("archive exceeds the extraction limits")
+	ErrExtractTarget  = errors.New("extraction target is a file")
+)
+
+// ExtractLimits bound what one archive may expand to, so a small upload
+// cannot fill the disk.
+type ExtractLimits struct {
+	MaxFiles int
+	MaxBytes int64
+}
+
+var DefaultExtractLimits = ExtractLimits{
+	MaxFiles: 10000,
+	MaxBytes: 1 << 30,
+}
+
+// Extraction describes the files an archive expanded to.
+type Extraction struct {
+	Files int   `json:"files"`
+	Size  int64 `json:"size"`
+}
+
+// Extract expands the pending zip or tar.gz archive into the directory
+// prefix, in place of everything stored under it before. The archive is
+// unpacked next to the data first and swapped in with renames, so the
+// prefix never holds a mix of old and new files, nor a half-unpacked
+// archive. The archive itself is never stored.
+func (p *Pending) Extract(prefix string, limits ExtractLimits) (*Extraction, error) {
+	extracted := false
+	defer func() {
+		p.file.Close()
+		if !extracted {
+			p.drop()
+			return
+		}
+		os.Remove(p.file.Name())
+		if p.session != "" {
+			p.storage.closeSession(p.session, true)
+		}
+	}()
+
+	staging, err := os.MkdirTemp(p.storage.TempDir, "extract-*")
+	if err != nil {
+		return nil, fmt.Errorf("create staging dir: %w", err)
+	}
+	defer os.RemoveAll(staging)
+
+	x := &extractor{dir: staging, limits: limits}
+	magic := make([]byte, 4)
+	p.file.ReadAt(magic, 0)
+	archive := io.NewSectionReader(p.file, 0, p.size)
+	switch {
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")), bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		err = x.zip(archive, p.size)
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		err = x.tarGz(archive)
+	default:
+		err = fmt.Errorf("%w: not a zip or tar.gz file", ErrInvalidArchive)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if x.result.Files == 0 {
+		return nil, fmt.Errorf("%w: no files", ErrInvalidArchive)
+	}
+
+	if err := p.storage.replaceTree(prefix, staging); err != nil {
+		return nil, err
+	}
+	extracted = true
+	return &x.result, nil
+}
+
+// extractor unpacks archive entries below dir/files, with their metadata
+// below dir/meta.
+type extractor struct {
+	dir    string
+	limits ExtractLimits
+	result Extraction
+}
+
+func (x *extractor) zip(r io.ReaderAt, size int64) error {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+
+	for _, entry := range archive.File {
+		mode := entry.Mode()
+		if mode.IsDir() {
+			continue
+		}
+		if !mode.IsRegular() {
+			return fmt.Errorf("%w: %s is not a regular file", ErrInvalidArchive, entry.Name)
+		}
+
+		content, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrInvalidArchive, entry.Name, err)
+		}
+		err = x.add(entry.Name, content)
+		content.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (x *extractor) tarGz(r io.Reader) error {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+	}
+	defer gz.Close()
+
+	archive := tar.NewReader(gz)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidArchive, err)
+		}
+
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if err := x.add(header.Name, archive); err != nil {
+				return err
+			}
+		case tar.TypeDir, tar.TypeXGlobalHeader:
+		default:
+			// Links and devices could point outside the prefix
+			return fmt.Errorf("%w: %s is not a regular file", ErrInvalidArchive, header.Name)
+		}
+	}
+}
+
+// entryName returns where an archive entry may be stored, relative to the
+// prefix. Names that are absolute or climb out with ".." are refused.
+func entryName(name string) (string, bool) {
+	if name == "" || strings.Contains(name, "\\") || path.IsAbs(name) {
+		return "", false
+	}
+	name = path.Clean(name)
+	if name == "." || name == ".." || strings.HasPrefix(name, "../") {
+		return "", false
+	}
+	return name, true
+}
+
+// add writes one file of the archive, counting it against the limits by
+// what is actually unpacked rather than what the headers claim.
+func (x *extractor) add(name string, content io.Reader) error {
+	clean, ok := entryName(name)
+	if !ok {
+		return fmt.Errorf("%w: entry %q escapes the target directory", ErrInvalidArchive, name)
+	}
+
+	x.result.Files++
+	if x.result.Files > x.limits.MaxFiles {
+		return fmt.Errorf("%w: more than %d files", ErrExtractLimit, x.limits.MaxFiles)
+	}
+
+	dest := filepath.Join(x.dir, "files", filepath.FromSlash(clean))
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return fmt.Errorf("%w: %s clashes with another entry", ErrInvalidArchive, name)
+	}
+	file, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return fmt.Errorf("%w: %s clashes with another entry", ErrInvalidArchive, name)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	remaining := x.limits.MaxBytes - x.result.Size
+	size, err := io.Copy(io.MultiWriter(file, hash), io.LimitReader(content, remaining+1))
+	x.result.Size += size
+	if err != nil {
+		return fmt.Errorf("%w: %s: %v", ErrInvalidArchive, name, err)
+	}
+	if x.result.Size > x.limits.MaxBytes {
+		return fmt.Errorf("%w: more than %d bytes", ErrExtractLimit, x.limits.MaxBytes)
+	}
+
+	meta := &Meta{
+		Digest: "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Size:   size,
+	}
+	return writeMeta(filepath.Join(x.dir, "meta", filepath.FromSlash(clean)+".json"), meta)
+}
+
+// replaceTree moves the files and metadata unpacked in staging into place
+// under prefix. What was there before ends up in staging, to be removed
+// with it.
+func (s *Storage) replaceTree(prefix, staging string) error {
+	target := s.filePath(prefix)
+	metaTarget := filepath.Join(s.MetaDir, "files", filepath.FromSlash(prefix))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if info, err := os.Stat(target); err == nil && !info.IsDir() {
+		return fmt.Errorf("%w: %s", ErrExtractTarget, prefix)
+	}
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	if err := os.MkdirAll(filepath.Dir(metaTarget), 0755); err != nil {
+		return fmt.Errorf("create metadata dir: %w", err)
+	}
+
+	old := filepath.Join(staging, "old")
+	if err := os.Rename(target, old); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("move previous files aside: %w", err)
+	}
+	if err := os.Rename(filepath.Join(staging, "files"), target); err != nil {
+		os.Rename(old, target)
+		return fmt.Errorf("move files into place: %w", err)
+	}
+
+	// Metadata that is missing or stale is rebuilt from the files, so a
+	// failure past this point leaves the tree usable
+	os.Rename(metaTarget, filepath.Join(staging, "old-meta"))
+	if err := os.Rename(filepath.Join(staging, "meta"), metaTarget); err != nil {
+		return fmt.Errorf("move metadata into place: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,234 @@
+package storage
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"os"
+	"strings"
+	"testing"
+)
+
+type archiveEntry struct {
+	name string
+	data string
+	// link, when set, makes the entry a symlink to it
+	link string
+}
+
+func tarGz(t *testing.T, entries ...archiveEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, entry := range entries {
+		header := &tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.data)), Typeflag: tar.TypeReg}
+		if entry.link != "" {
+			header.Typeflag, header.Linkname, header.Size = tar.TypeSymlink, entry.link, 0
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write([]byte(entry.data))
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	gz.Close()
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, entries ...archiveEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate}
+		header.SetMode(0644)
+		data := entry.data
+		if entry.link != "" {
+			header.SetMode(os.ModeSymlink | 0777)
+			data = entry.link
+		}
+		w, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte(data))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// extract unpacks archive into prefix the way a finished upload does.
+func extract(t *testing.T, s *Storage, archive []byte, prefix string, limits ExtractLimits) (*Extraction, error) {
+	t.Helper()
+
+	pending, err := s.CreateFile("upload.bin")
+	if err != nil {
+		t.Fatalf("CreateFile: %v", err)
+	}
+	if _, err := pending.Write(archive); err != nil {
+		t.Fatal(err)
+	}
+	return pending.Extract(prefix, limits)
+}
+
+func TestExtract(t *testing.T) {
+	for name, archive := range map[string]func(*testing.T, ...archiveEntry) []byte{
+		"tar.gz": tarGz,
+		"zip":    zipArchive,
+	} {
+		t.Run(name, func(t *testing.T) {
+			s := New(t.TempDir())
+			result, err := extract(t, s, archive(t,
+				archiveEntry{name: "index.html", data: "<html>"},
+				archiveEntry{name: "css/site.css", data: "body{}"},
+				archiveEntry{name: "./js/../img/logo.svg", data: "<svg/>"},
+			), "site", DefaultExtractLimits)
+			if err != nil {
+				t.Fatalf("Extract: %v", err)
+			}
+			if result.Files != 3 || result.Size != 18 {
+				t.Fatalf("extracted %d files of %d bytes, want 3 files of 18 bytes", result.Files, result.Size)
+			}
+
+			for name, want := range map[string]string{
+				"site/index.html":   "<html>",
+				"site/css/site.css": "body{}",
+				"site/img/logo.svg": "<svg/>",
+			} {
+				if got := readStored(t, s, name); got != want {
+					t.Errorf("%s is %q, want %q", name, got, want)
+				}
+			}
+			if _, err := s.FileMeta("upload.bin"); err == nil {
+				t.Error("the archive itself was stored")
+			}
+		})
+	}
+}
+
+func TestExtractRejects(t *testing.T) {
+	limits := ExtractLimits{MaxFiles: 2, MaxBytes: 10}
+	tests := []struct {
+		name    string
+		archive func(t *testing.T) []byte
+		err     error
+	}{
+		{"parent in tar", func(t *testing.T) []byte {
+			return tarGz(t, archiveEntry{name: "../evil.txt", data: "x"})
+		}, ErrInvalidArchive},
+		{"nested parent in tar", func(t *testing.T) []byte {
+			return tarGz(t, archiveEntry{name: "a/../../evil.txt", data: "x"})
+		}, ErrInvalidArchive},
+		{"parent in zip", func(t *testing.T) []byte {
+			return zipArchive(t, archiveEntry{name: "../evil.txt", data: "x"})
+		}, ErrInvalidArchive},
+		{"absolute in tar", func(t *testing.T) []byte {
+			return tarGz(t, archiveEntry{name: "/etc/evil", data: "x"})
+		}, ErrInvalidArchive},
+		{"absolute in zip", func(t *testing.T) []byte {
+			return zipArchive(t, archiveEntry{name: "/etc/evil", data: "x"})
+		}, ErrInvalidArchive},
+		{"backslash in zip", func(t *testing.T) []byte {
+			return zipArchive(t, archiveEntry{name: `..\evil.txt`, data: "x"})
+		}, ErrInvalidArchive},
+		{"symlink in tar", func(t *testing.T) []byte {
+			return tarGz(t, archiveEntry{name: "link", link: "/etc/passwd"})
+		}, ErrInvalidArchive},
+		{"symlink in zip", func(t *testing.T) []byte {
+			return zipArchive(t, archiveEntry{name: "link", link: "/etc/passwd"})
+		}, ErrInvalidArchive},
+		{"duplicate entry", func(t *testing.T) []byte {
+			return tarGz(t, archiveEntry{name: "a.txt", data: "1"}, archiveEntry{name: "a.txt", data: "2"})
+		}, ErrInvalidArchive},
+		{"not an archive", func(t *testing.T) []byte {
+			return []byte("plain text")
+		}, ErrInvalidArchive},
+		{"empty archive", func(t *testing.T) []byte {
+			return tarGz(t)
+		}, ErrInvalidArchive},
+		{"too many files", func(t *testing.T) []byte {
+			return tarGz(t, archiveEntry{name: "a", data: "1"}, archiveEntry{name: "b", data: "2"}, archiveEntry{name: "c", data: "3"})
+		}, ErrExtractLimit},
+		{"too many bytes", func(t *testing.T) []byte {
+			return zipArchive(t, archiveEntry{name: "a", data: strings.Repeat("x", 11)})
+		}, ErrExtractLimit},
+		{"too many bytes in total", func(t *testing.T) []byte {
+			return tarGz(t, archiveEntry{name: "a", data: "123456"}, archiveEntry{name: "b", data: "123456"})
+		}, ErrExtractLimit},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			if err := s.SaveFile("site/index.html", strings.NewReader("old")); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err := extract(t, s, test.archive(t), "site", limits)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("Extract: got %v, want %v", err, test.err)
+			}
+
+			// Nothing changed, inside the prefix or out of it
+			files, err := s.ListFiles()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != 1 || readStored(t, s, "site/index.html") != "old" {
+				t.Fatalf("failed extraction changed the stored files: %v", files)
+			}
+			entries, err := os.ReadDir(s.TempDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(entries) != 0 {
+				t.Fatalf("failed extraction left %d entries in the temp dir", len(entries))
+			}
+		})
+	}
+}
+
+func TestExtractReplaces(t *testing.T) {
+	s := New(t.TempDir())
+	for _, name := range []string{"site/old.html", "site/sub/old.css", "other.txt"} {
+		if err := s.SaveFile(name, strings.NewReader("old")); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := extract(t, s, tarGz(t, archiveEntry{name: "new.html", data: "new"}), "site", DefaultExtractLimits); err != nil {
+		t.Fatalf("Extract: %v", err)
+	}
+
+	files, err := s.ListFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(files, ",") != "other.txt,site/new.html" {
+		t.Fatalf("files after extraction are %v", files)
+	}
+}
+
+func TestExtractOntoFile(t *testing.T) {
+	s := New(t.TempDir())
+	if err := s.SaveFile("site", strings.NewReader("a file")); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := extract(t, s, tarGz(t, archiveEntry{name: "index.html", data: "<html>"}), "site", DefaultExtractLimits)
+	if !errors.Is(err, ErrExtractTarget) {
+		t.Fatalf("Extract onto a file: %v", err)
+	}
+	if got := readStored(t, s, "site"); got != "a file" {
+		t.Fatalf("file is %q after a failed extraction", got)
+	}
+}
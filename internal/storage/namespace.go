@@ -0,0 +1,177 @@
+package storage
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Promotion records how an object arrived in its namespace.
+type Promotion struct {
+	From string    `json:"from"`
+	By   string    `json:"by"`
+	At   time.Time `json:"at"`
+}
+
+// ValidNamespace reports whether name can be used as a namespace: lower
+// case letters, digits, '.', '_' and '-', starting with a letter or digit.
+func ValidNamespace(name string) bool {
+	if name == "" || len(name) > 64 {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9':
+		case i > 0 && (c == '.' || c == '_' || c == '-'):
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// Namespace returns the storage of a namespace, kept below
+// <base>/namespaces/<name>. The empty name is the default namespace.
+func (s *Storage) Namespace(name string) (*Storage, error) {
+	if name == "" {
+		return s, nil
+	}
+	if !ValidNamespace(name) {
+		return nil, fmt.Errorf("invalid namespace %q", name)
+	}
+
+	s.nsMu.Lock()
+	defer s.nsMu.Unlock()
+
+	if ns, ok := s.namespaces[name]; ok {
+		return ns, nil
+	}
+	if s.namespaces == nil {
+		s.namespaces = make(map[string]*Storage)
+	}
+	ns := New(filepath.Join(s.basePath, "namespaces", name))
+	s.namespaces[name] = ns
+	return ns, nil
+}
+
+// Namespaces returns the names of the namespaces that hold data, not
+// counting the default one.
+func (s *Storage) Namespaces() []string {
+	entries, _ := os.ReadDir(filepath.Join(s.basePath, "namespaces"))
+
+	var names []string
+	for _, entry := range entries {
+		if entry.IsDir() && ValidNamespace(entry.Name()) {
+			names = append(names, entry.Name())
+		}
+	}
+	return names
+}
+
+// PromoteFile copies a file into another namespace, replacing the file of
+// the same name there. The copy shares storage with the original when the
+// filesystem supports hard links.
+func (s *Storage) PromoteFile(filename string, to *Storage, promotion *Promotion) error {
+	meta, err := s.FileMeta(filename)
+	if err != nil {
+		return err
+	}
+
+	to.mu.Lock()
+	defer to.mu.Unlock()
+
+	if err := to.linkOrCopy(s.filePath(filename), to.filePath(filename)); err != nil {
+		return err
+	}
+	meta.Promoted = promotion
+	return writeMeta(to.fileMetaPath(filename), meta)
+}
+
+// PromoteImage copies an image with all its platform builds and signatures
+// into another namespace, replacing the image of the same name there.
+func (s *Storage) PromoteImage(imageName string, to *Storage, promotion *Promotion) error {
+	index, err := s.readIndex(imageName)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{}
+	if _, err := os.Stat(s.imagePath(imageName)); err == nil {
+		keys = append(keys, imageName)
+	}
+	for _, variant := range index.Variants {
+		keys = append(keys, variantKey(imageName, variant.Platform))
+	}
+	if len(keys) == 0 {
+		return fmt.Errorf("image %s: %w", imageName, os.ErrNotExist)
+	}
+
+	to.mu.Lock()
+	defer to.mu.Unlock()
+
+	if err := to.deleteImage(imageName); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for _, key := range keys {
+		meta, err := s.ImageMeta(key)
+		if err != nil {
+			return err
+		}
+		if err := to.linkOrCopy(s.imagePath(key), to.imagePath(key)); err != nil {
+			return err
+		}
+		meta.Promoted = promotion
+		if err := writeMeta(to.imageMetaPath(key), meta); err != nil {
+			return err
+		}
+	}
+	return to.writeIndex(imageName, index)
+}
+
+// linkOrCopy places a copy of src at dst, hard linking when possible.
+// Stored objects are only ever replaced by rename, never rewritten, so
+// sharing the inode is safe.
+func (s *Storage) linkOrCopy(src, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+
+	tmp := filepath.Join(s.TempDir, "link-"+filepath.Base(dst))
+	os.Remove(tmp)
+	if err := os.Link(src, tmp); err != nil {
+		if err := copyFile(src, tmp); err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("copy %s: %w", filepath.Base(src), err)
+		}
+	}
+
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("move into place: %w", err)
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Sync(); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,242 @@
+package storage
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Variant is one platform specific build stored under an image name.
+type Variant struct {
+	Platform string    `json:"platform"`
+	Digest   string    `json:"digest"`
+	Size     int64     `json:"size"`
+	Pushed   time.Time `json:"pushed"`
+}
+
+// imageIndex lists the variants of a multi-platform image. It lives next
+// to the variant archives as <name>.index.json.
+type imageIndex struct {
+	Variants []Variant `json:"variants"`
+}
+
+// NormalizePlatform checks that platform looks like "os/arch[/variant]"
+// and returns it in lower case.
+func NormalizePlatform(platform string) (string, error) {
+	parts := strings.Split(strings.ToLower(platform), "/")
+	if len(parts) < 2 || len(parts) > 3 {
+		return "", fmt.Errorf("invalid platform %q, expected os/arch[/variant]", platform)
+	}
+	for _, part := range parts {
+		if part == "" || strings.Trim(part, "abcdefghijklmnopqrstuvwxyz0123456789") != "" {
+			return "", fmt.Errorf("invalid platform %q, expected os/arch[/variant]", platform)
+		}
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+func variantKey(imageName, platform string) string {
+	return imageName + "@" + strings.ReplaceAll(platform, "/", "_")
+}
+
+func (s *Storage) indexPath(imageName string) string {
+	return filepath.Join(s.ImagesDir, imageName+".index.json")
+}
+
+func (s *Storage) readIndex(imageName string) (*imageIndex, error) {
+	index := &imageIndex{}
+
+	data, err := os.ReadFile(s.indexPath(imageName))
+	if os.IsNotExist(err) {
+		return index, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, fmt.Errorf("parse image index: %w", err)
+	}
+	return index, nil
+}
+
+func (s *Storage) writeIndex(imageName string, index *imageIndex) error {
+	if len(index.Variants) == 0 {
+		err := os.Remove(s.indexPath(imageName))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	sort.Slice(index.Variants, func(i, j int) bool {
+		return index.Variants[i].Platform < index.Variants[j].Platform
+	})
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal image index: %w", err)
+	}
+
+	tmp := s.indexPath(imageName) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write image index: %w", err)
+	}
+	return os.Rename(tmp, s.indexPath(imageName))
+}
+
+// CreateImageVariant starts writing the platform specific build of an
+// image. Committing it adds the platform to the image index.
+func (s *Storage) CreateImageVariant(imageName, platform string) (*Pending, error) {
+	platform, err := NormalizePlatform(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	key := variantKey(imageName, platform)
+	pending, err := s.newPending(s.imagePath(key), s.imageMetaPath(key))
+	if err != nil {
+		return nil, err
+	}
+
+	pending.onCommit = func() error {
+		return s.addVariant(imageName, platform, &pending.Meta)
+	}
+
+	return pending, nil
+}
+
+// addVariant records a committed platform build in the image index.
+func (s *Storage) addVariant(imageName, platform string, meta *Meta) error {
+	index, err := s.readIndex(imageName)
+	if err != nil {
+		return err
+	}
+
+	variant := Variant{
+		Platform: platform,
+		Digest:   meta.Digest,
+		Size:     meta.Size,
+		Pushed:   time.Now().UTC(),
+	}
+	replaced := false
+	for i := range index.Variants {
+		if index.Variants[i].Platform == platform {
+			index.Variants[i] = variant
+			replaced = true
+		}
+	}
+	if !replaced {
+		index.Variants = append(index.Variants, variant)
+	}
+
+	return s.writeIndex(imageName, index)
+}
+
+// ImageVariants lists the platforms stored for an image.
+func (s *Storage) ImageVariants(imageName string) ([]Variant, error) {
+	index, err := s.readIndex(imageName)
+	if err != nil {
+		return nil, err
+	}
+	return index.Variants, nil
+}
+
+func matchVariant(variants []Variant, platform string) (Variant, bool) {
+	for _, variant := range variants {
+		if variant.Platform == platform {
+			return variant, true
+		}
+	}
+
+	// Fall back to os/arch when only one side names a variant
+	osArch := strings.Join(strings.SplitN(platform, "/", 3)[:2], "/")
+	for _, variant := range variants {
+		if variant.Platform == osArch || strings.HasPrefix(variant.Platform, osArch+"/") {
+			return variant, true
+		}
+	}
+	return Variant{}, false
+}
+
+// ResolveImage returns the key under which the build of imageName for
+// platform is stored. Images pushed without a platform are served to every
+// platform that has no build of its own. With an empty platform the image
+// must be unambiguous.
+func (s *Storage) ResolveImage(imageName, platform string) (string, error) {
+	variants, err := s.ImageVariants(imageName)
+	if err != nil {
+		return "", err
+	}
+
+	if platform != "" {
+		platform, err = NormalizePlatform(platform)
+		if err != nil {
+			return "", err
+		}
+		if variant, ok := matchVariant(variants, platform); ok {
+			return variantKey(imageName, variant.Platform), nil
+		}
+	}
+
+	if _, err := os.Stat(s.imagePath(imageName)); err == nil {
+		return imageName, nil
+	}
+
+	switch {
+	case len(variants) == 0:
+		return "", fmt.Errorf("image %s not found", imageName)
+	case platform == "" && len(variants) == 1:
+		return variantKey(imageName, variants[0].Platform), nil
+	}
+
+	var platforms []string
+	for _, variant := range variants {
+		platforms = append(platforms, variant.Platform)
+	}
+	if platform == "" {
+		return "", fmt.Errorf("image %s has several platforms (%s), pick one", imageName, strings.Join(platforms, ", "))
+	}
+	return "", fmt.Errorf("image %s has no %s build (available: %s)", imageName, platform, strings.Join(platforms, ", "))
+}
+
+// DeleteImageVariant removes one platform build of an image.
+func (s *Storage) DeleteImageVariant(imageName, platform string) error {
+	platform, err := NormalizePlatform(platform)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	index, err := s.readIndex(imageName)
+	if err != nil {
+		return err
+	}
+
+	found := false
+	variants := index.Variants[:0]
+	for _, variant := range index.Variants {
+		if variant.Platform == platform {
+			found = true
+			continue
+		}
+		variants = append(variants, variant)
+	}
+	if !found {
+		return fmt.Errorf("image %s has no %s build", imageName, platform)
+	}
+	index.Variants = variants
+
+	key := variantKey(imageName, platform)
+	os.Remove(s.imageMetaPath(key))
+	if err := os.Remove(s.imagePath(key)); err != nil {
+		return err
+	}
+	return s.writeIndex(imageName, index)
+}
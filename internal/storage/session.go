@@ -0,0 +1,403 @@
+package storage
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of object an upload session can produce
+const (
+	SessionFile  = "file"
+	SessionImage = "image"
+)
+
+var (
+	ErrSessionNotFound = errors.New("upload session not found")
+	ErrSessionBusy     = errors.New("upload session is receiving data")
+)
+
+// OffsetError rejects a chunk that does not start where the received data
+// ends.
+type OffsetError struct {
+	Offset int64
+}
+
+func (e *OffsetError) Error() string {
+	return fmt.Sprintf("upload continues at offset %d", e.Offset)
+}
+
+// CheckError rejects received data that failed the check FinishSession
+// ran over it. Any other error from FinishSession left the session in
+// place to be finished again.
+type CheckError struct {
+	Err error
+}
+
+func (e *CheckError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *CheckError) Unwrap() error {
+	return e.Err
+}
+
+// Session is a resumable upload. Chunks are appended to a data file in the
+// temp directory until the session is finished or expires.
+type Session struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Name     string    `json:"name"`
+	Platform string    `json:"platform,omitempty"`
+	Created  time.Time `json:"created"`
+	// Expires moves forward with every chunk received
+	Expires time.Time `json:"expires"`
+	// Offset is how many bytes were received so far
+	Offset int64 `json:"offset"`
+
+	ttl time.Duration
+}
+
+// sessions tracks which sessions are receiving a chunk, so two requests
+// never append to the same data file.
+var sessions = struct {
+	sync.Mutex
+	active map[string]bool
+}{active: make(map[string]bool)}
+
+func (s *Storage) sessionDir() string {
+	return filepath.Join(s.TempDir, "sessions")
+}
+
+func (s *Storage) sessionPath(id string) string {
+	return filepath.Join(s.sessionDir(), id+".json")
+}
+
+func (s *Storage) sessionDataPath(id string) string {
+	return filepath.Join(s.sessionDir(), id)
+}
+
+// CreateSession starts a resumable upload of a file or image. The session
+// is dropped when no data arrives for ttl.
+func (s *Storage) CreateSession(kind, name, platform string, ttl time.Duration) (*Session, error) {
+	if kind != SessionFile && kind != SessionImage {
+		return nil, fmt.Errorf("unknown upload kind %q", kind)
+	}
+	if name == "" {
+		return nil, errors.New("upload needs a name")
+	}
+	if platform != "" {
+		var err error
+		if platform, err = NormalizePlatform(platform); err != nil {
+			return nil, err
+		}
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generate session id: %w", err)
+	}
+
+	now := time.Now().UTC()
+	session := &Session{
+		ID:       hex.EncodeToString(id),
+		Kind:     kind,
+		Name:     name,
+		Platform: platform,
+		Created:  now,
+		Expires:  now.Add(ttl),
+	}
+
+	if err := os.MkdirAll(s.sessionDir(), 0755); err != nil {
+		return nil, fmt.Errorf("create session dir: %w", err)
+	}
+	if err := os.WriteFile(s.sessionDataPath(session.ID), nil, 0644); err != nil {
+		return nil, fmt.Errorf("create session data: %w", err)
+	}
+	if err := s.writeSession(session, ttl); err != nil {
+		os.Remove(s.sessionDataPath(session.ID))
+		return nil, err
+	}
+	return session, nil
+}
+
+// writeSession stores the session record. The TTL is kept so every chunk
+// can push the expiry forward by the same amount.
+func (s *Storage) writeSession(session *Session, ttl time.Duration) error {
+	record := struct {
+		*Session
+		TTL time.Duration `json:"ttl"`
+	}{session, ttl}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("marshal session: %w", err)
+	}
+
+	tmp := s.sessionPath(session.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write session: %w", err)
+	}
+	if err := os.Rename(tmp, s.sessionPath(session.ID)); err != nil {
+		return fmt.Errorf("write session: %w", err)
+	}
+	return nil
+}
+
+// GetSession returns a live session with its received offset.
+func (s *Storage) GetSession(id string) (*Session, error) {
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		return nil, ErrSessionNotFound
+	}
+
+	data, err := os.ReadFile(s.sessionPath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrSessionNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read session: %w", err)
+	}
+
+	session := &Session{}
+	record := struct {
+		*Session
+		TTL time.Duration `json:"ttl"`
+	}{Session: session}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return nil, fmt.Errorf("parse session: %w", err)
+	}
+	session.ttl = record.TTL
+
+	if time.Now().After(session.Expires) {
+		s.removeSession(id)
+		return nil, ErrSessionNotFound
+	}
+
+	info, err := os.Stat(s.sessionDataPath(id))
+	if err != nil {
+		return nil, ErrSessionNotFound
+	}
+	session.Offset = info.Size()
+	return session, nil
+}
+
+// WriteSession appends a chunk that starts at offset and returns the new
+// offset. Whatever arrives before the chunk is cut off stays received, so
+// the client can continue from there.
+func (s *Storage) WriteSession(id string, offset int64, r io.Reader) (int64, error) {
+	sessions.Lock()
+	if sessions.active[id] {
+		sessions.Unlock()
+		return 0, ErrSessionBusy
+	}
+	sessions.active[id] = true
+	sessions.Unlock()
+	defer func() {
+		sessions.Lock()
+		delete(sessions.active, id)
+		sessions.Unlock()
+	}()
+
+	session, err := s.GetSession(id)
+	if err != nil {
+		return 0, err
+	}
+	if offset != session.Offset {
+		return session.Offset, &OffsetError{Offset: session.Offset}
+	}
+
+	file, err := os.OpenFile(s.sessionDataPath(id), os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return offset, fmt.Errorf("open session data: %w", err)
+	}
+	n, copyErr := io.Copy(file, r)
+	if err := file.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	offset += n
+
+	session.Expires = time.Now().UTC().Add(session.ttl)
+	if err := s.writeSession(session, session.ttl); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return offset, copyErr
+}
+
+// FinishSession turns the received data into a Pending object for the
+// session's file or image, ready to be checked and committed. check, when
+// set, reads the whole content while it is hashed. The session is busy
+// until the Pending is committed or aborted, and only goes away once its
+// content is stored: after an Abort or a failed Commit it can be finished
+// again.
+func (s *Storage) FinishSession(id string, check func(r io.Reader) error) (*Pending, error) {
+	sessions.Lock()
+	if sessions.active[id] {
+		sessions.Unlock()
+		return nil, ErrSessionBusy
+	}
+	sessions.active[id] = true
+	sessions.Unlock()
+
+	pending, err := s.finishSession(id, check)
+	if err != nil {
+		s.closeSession(id, false)
+		return nil, err
+	}
+	return pending, nil
+}
+
+func (s *Storage) finishSession(id string, check func(r io.Reader) error) (*Pending, error) {
+	session, err := s.GetSession(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var path, metaPath string
+	switch session.Kind {
+	case SessionImage:
+		key := session.Name
+		if session.Platform != "" {
+			key = variantKey(session.Name, session.Platform)
+		}
+		path, metaPath = s.imagePath(key), s.imageMetaPath(key)
+	default:
+		path, metaPath = s.filePath(session.Name), s.fileMetaPath(session.Name)
+	}
+
+	file, err := os.OpenFile(s.sessionDataPath(id), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("open session data: %w", err)
+	}
+
+	hash := sha256.New()
+	data := &readRecorder{r: io.TeeReader(file, hash)}
+	var r io.Reader = data
+	if check != nil {
+		err = check(r)
+		// A read failure is not the data's fault, even if the check saw it
+		if err != nil && data.err == nil {
+			err = &CheckError{Err: err}
+		}
+		// Hash whatever the check left unread
+		if err == nil {
+			_, err = io.Copy(io.Discard, r)
+		}
+	} else {
+		_, err = io.Copy(io.Discard, r)
+	}
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	pending := &Pending{
+		storage:  s,
+		file:     file,
+		path:     path,
+		metaPath: metaPath,
+		hash:     hash,
+		size:     session.Offset,
+		session:  id,
+	}
+	if session.Kind == SessionImage && session.Platform != "" {
+		name, platform := session.Name, session.Platform
+		pending.onCommit = func() error {
+			return s.addVariant(name, platform, &pending.Meta)
+		}
+	}
+	return pending, nil
+}
+
+// closeSession ends the finish of session id. A session whose content was
+// stored is removed; any other stays to be finished again.
+func (s *Storage) closeSession(id string, stored bool) {
+	if stored {
+		s.removeSession(id)
+	}
+	sessions.Lock()
+	delete(sessions.active, id)
+	sessions.Unlock()
+}
+
+// readRecorder remembers the first read error other than EOF.
+type readRecorder struct {
+	r   io.Reader
+	err error
+}
+
+func (r *readRecorder) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if err != nil && err != io.EOF && r.err == nil {
+		r.err = err
+	}
+	return n, err
+}
+
+// DeleteSession cancels an upload and drops its data.
+func (s *Storage) DeleteSession(id string) error {
+	if _, err := s.GetSession(id); err != nil {
+		return err
+	}
+	s.removeSession(id)
+	return nil
+}
+
+func (s *Storage) removeSession(id string) {
+	os.Remove(s.sessionPath(id))
+	os.Remove(s.sessionDataPath(id))
+}
+
+// ExpireSessions drops expired sessions here and in every namespace, and
+// returns how many were removed.
+func (s *Storage) ExpireSessions() int {
+	removed := s.expireSessions()
+
+	for _, name := range s.Namespaces() {
+		if ns, err := s.Namespace(name); err == nil {
+			removed += ns.expireSessions()
+		}
+	}
+	return removed
+}
+
+func (s *Storage) expireSessions() int {
+	entries, err := os.ReadDir(s.sessionDir())
+	if err != nil {
+		return 0
+	}
+
+	removed := 0
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			// Data left behind by a session record that is gone
+			if _, err := os.Stat(s.sessionPath(entry.Name())); os.IsNotExist(err) && !strings.HasSuffix(entry.Name(), ".tmp") {
+				if info, err := entry.Info(); err == nil && time.Since(info.ModTime()) > 24*time.Hour {
+					os.Remove(s.sessionDataPath(entry.Name()))
+				}
+			}
+			continue
+		}
+
+		sessions.Lock()
+		busy := sessions.active[id]
+		sessions.Unlock()
+		if busy {
+			continue
+		}
+		if _, err := s.GetSession(id); err == ErrSessionNotFound {
+			s.removeSession(id)
+			removed++
+		}
+	}
+	return removed
+}
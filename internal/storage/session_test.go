@@ -0,0 +1,216 @@
+package storage
+
+import (
+	"errors"
+	"io"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSession creates a file upload session holding content.
+func testSession(t *testing.T, s *Storage, name, content string) *Session {
+	t.Helper()
+
+	session, err := s.CreateSession(SessionFile, name, "", time.Hour)
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	if _, err := s.WriteSession(session.ID, 0, strings.NewReader(content)); err != nil {
+		t.Fatalf("WriteSession: %v", err)
+	}
+	return session
+}
+
+func readStored(t *testing.T, s *Storage, name string) string {
+	t.Helper()
+
+	file, err := s.GetFile(name)
+	if err != nil {
+		t.Fatalf("GetFile: %v", err)
+	}
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriteSessionOffsets(t *testing.T) {
+	s := New(t.TempDir())
+	session := testSession(t, s, "a.txt", "hello ")
+
+	offset, err := s.WriteSession(session.ID, 0, strings.NewReader("again"))
+	var offsetErr *OffsetError
+	if !errors.As(err, &offsetErr) || offsetErr.Offset != 6 || offset != 6 {
+		t.Fatalf("chunk at the wrong offset: got %d, %v", offset, err)
+	}
+	if offset, err = s.WriteSession(session.ID, 6, strings.NewReader("world")); err != nil || offset != 11 {
+		t.Fatalf("WriteSession: got %d, %v", offset, err)
+	}
+
+	got, err := s.GetSession(session.ID)
+	if err != nil {
+		t.Fatalf("GetSession: %v", err)
+	}
+	if got.Offset != 11 {
+		t.Fatalf("session offset is %d, want 11", got.Offset)
+	}
+	if _, err := s.WriteSession("missing", 0, strings.NewReader("x")); err != ErrSessionNotFound {
+		t.Fatalf("chunk for a missing session: %v", err)
+	}
+}
+
+func TestFinishSessionCommit(t *testing.T) {
+	s := New(t.TempDir())
+	session := testSession(t, s, "a.txt", "hello")
+
+	pending, err := s.FinishSession(session.ID, nil)
+	if err != nil {
+		t.Fatalf("FinishSession: %v", err)
+	}
+	if _, err := s.WriteSession(session.ID, 5, strings.NewReader("x")); err != ErrSessionBusy {
+		t.Fatalf("chunk while finishing: %v", err)
+	}
+	if _, err := s.FinishSession(session.ID, nil); err != ErrSessionBusy {
+		t.Fatalf("second finish while finishing: %v", err)
+	}
+	if err := pending.Commit(); err != nil {
+		t.Fatalf("Commit: %v", err)
+	}
+
+	if got := readStored(t, s, "a.txt"); got != "hello" {
+		t.Fatalf("stored %q, want %q", got, "hello")
+	}
+	if _, err := s.GetSession(session.ID); err != ErrSessionNotFound {
+		t.Fatalf("session after commit: %v", err)
+	}
+	if _, err := os.Stat(s.sessionDataPath(session.ID)); !os.IsNotExist(err) {
+		t.Fatalf("session data left after commit: %v", err)
+	}
+}
+
+func TestFinishSessionKeptUntilStored(t *testing.T) {
+	tests := []struct {
+		name   string
+		finish func(s *Storage, id string) error
+	}{
+		{
+			name: "abort",
+			finish: func(s *Storage, id string) error {
+				pending, err := s.FinishSession(id, nil)
+				if err != nil {
+					return err
+				}
+				pending.Abort()
+				return nil
+			},
+		},
+		{
+			name: "failed condition",
+			finish: func(s *Storage, id string) error {
+				pending, err := s.FinishSession(id, nil)
+				if err != nil {
+					return err
+				}
+				pending.Condition = &Condition{Match: []string{"sha256:0000"}}
+				if err := pending.Commit(); !errors.Is(err, ErrPreconditionFailed) {
+					return errors.New("commit did not fail its condition")
+				}
+				return nil
+			},
+		},
+		{
+			name: "failed check",
+			finish: func(s *Storage, id string) error {
+				_, err := s.FinishSession(id, func(r io.Reader) error {
+					return errors.New("not valid")
+				})
+				var checkErr *CheckError
+				if !errors.As(err, &checkErr) {
+					return errors.New("check failure is not a CheckError")
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := New(t.TempDir())
+			session := testSession(t, s, "a.txt", "hello")
+
+			if err := test.finish(s, session.ID); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.FileMeta("a.txt"); err == nil {
+				t.Fatal("content stored")
+			}
+
+			// The session can still be finished, with its data intact
+			pending, err := s.FinishSession(session.ID, nil)
+			if err != nil {
+				t.Fatalf("finish again: %v", err)
+			}
+			if err := pending.Commit(); err != nil {
+				t.Fatalf("Commit: %v", err)
+			}
+			if got := readStored(t, s, "a.txt"); got != "hello" {
+				t.Fatalf("stored %q, want %q", got, "hello")
+			}
+		})
+	}
+}
+
+func TestDeleteSession(t *testing.T) {
+	s := New(t.TempDir())
+	session := testSession(t, s, "a.txt", "hello")
+
+	if err := s.DeleteSession(session.ID); err != nil {
+		t.Fatalf("DeleteSession: %v", err)
+	}
+	if _, err := s.FinishSession(session.ID, nil); err != ErrSessionNotFound {
+		t.Fatalf("finish of a cancelled session: %v", err)
+	}
+	if err := s.DeleteSession(session.ID); err != ErrSessionNotFound {
+		t.Fatalf("second DeleteSession: %v", err)
+	}
+}
+
+func TestExpireSessions(t *testing.T) {
+	s := New(t.TempDir())
+	expired, err := s.CreateSession(SessionFile, "old.txt", "", -time.Minute)
+	if err != nil {
+		t.Fatalf("CreateSession: %v", err)
+	}
+	live := testSession(t, s, "new.txt", "hello")
+
+	if removed := s.ExpireSessions(); removed != 1 {
+		t.Fatalf("ExpireSessions removed %d sessions, want 1", removed)
+	}
+	if _, err := s.GetSession(expired.ID); err != ErrSessionNotFound {
+		t.Fatalf("expired session: %v", err)
+	}
+	if _, err := s.GetSession(live.ID); err != nil {
+		t.Fatalf("live session: %v", err)
+	}
+}
+
+func TestCreateSessionRejects(t *testing.T) {
+	s := New(t.TempDir())
+	for _, test := range []struct {
+		kind, name string
+	}{
+		{"blob", "a.txt"},
+		{SessionFile, ""},
+	} {
+		if _, err := s.CreateSession(test.kind, test.name, "", time.Hour); err == nil {
+			t.Errorf("CreateSession(%q, %q) succeeded", test.kind, test.name)
+		}
+	}
+	if _, err := s.CreateSession(SessionImage, "app:1", "not/a/valid/platform/x", time.Hour); err == nil {
+		t.Error("CreateSession accepted a bad platform")
+	}
+}
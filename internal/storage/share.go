@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrShareNotFound = errors.New("share link not found or revoked")
+	ErrShareExpired  = errors.New("share link expired")
+	ErrShareUsedUp   = errors.New("share link reached its download limit")
+)
+
+// Share is a link that lets anyone holding it download one file until it
+// expires, runs out of downloads or is revoked.
+type Share struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires"`
+	// MaxDownloads of 0 means unlimited
+	MaxDownloads int    `json:"max_downloads,omitempty"`
+	Downloads    int    `json:"downloads"`
+	By           string `json:"by,omitempty"`
+}
+
+func (s *Storage) shareDir() string {
+	return filepath.Join(s.MetaDir, "shares")
+}
+
+func (s *Storage) sharePath(id string) string {
+	return filepath.Join(s.shareDir(), id+".json")
+}
+
+// ShareKey returns the key share links are signed with. It is created on
+// first use and kept next to the data, so links survive restarts.
+func (s *Storage) ShareKey() ([]byte, error) {
+	path := filepath.Join(s.MetaDir, "share.key")
+	if key, err := os.ReadFile(path); err == nil && len(key) > 0 {
+		return key, nil
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, fmt.Errorf("generate share key: %w", err)
+	}
+	if err := os.MkdirAll(s.MetaDir, 0755); err != nil {
+		return nil, fmt.Errorf("create metadata dir: %w", err)
+	}
+	if err := os.WriteFile(path, key, 0600); err != nil {
+		return nil, fmt.Errorf("write share key: %w", err)
+	}
+	return key, nil
+}
+
+// CreateShare records a share link for a file. maxDownloads of 0 allows
+// any number of downloads until the link expires.
+func (s *Storage) CreateShare(name string, ttl time.Duration, maxDownloads int, by string) (*Share, error) {
+	if _, err := os.Stat(s.filePath(name)); err != nil {
+		return nil, err
+	}
+
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("generate share id: %w", err)
+	}
+
+	now := time.Now().UTC()
+	share := &Share{
+		ID:           hex.EncodeToString(id),
+		Name:         name,
+		Created:      now,
+		Expires:      now.Add(ttl).Truncate(time.Second),
+		MaxDownloads: maxDownloads,
+		By:           by,
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.writeShare(share); err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+func (s *Storage) writeShare(share *Share) error {
+	data, err := json.Marshal(share)
+	if err != nil {
+		return fmt.Errorf("marshal share: %w", err)
+	}
+	if err := os.MkdirAll(s.shareDir(), 0755); err != nil {
+		return fmt.Errorf("create share dir: %w", err)
+	}
+
+	tmp := s.sharePath(share.ID) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write share: %w", err)
+	}
+	if err := os.Rename(tmp, s.sharePath(share.ID)); err != nil {
+		return fmt.Errorf("write share: %w", err)
+	}
+	return nil
+}
+
+// GetShare returns a share link. Expired links are removed.
+func (s *Storage) GetShare(id string) (*Share, error) {
+	if len(id) != 32 || strings.Trim(id, "0123456789abcdef") != "" {
+		return nil, ErrShareNotFound
+	}
+
+	data, err := os.ReadFile(s.sharePath(id))
+	if os.IsNotExist(err) {
+		return nil, ErrShareNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read share: %w", err)
+	}
+
+	share := &Share{}
+	if err := json.Unmarshal(data, share); err != nil {
+		return nil, fmt.Errorf("parse share: %w", err)
+	}
+	if time.Now().After(share.Expires) {
+		os.Remove(s.sharePath(id))
+		return nil, ErrShareExpired
+	}
+	return share, nil
+}
+
+// CheckShare returns the link id if it is for file name, without counting
+// a download or looking at the download limit.
+func (s *Storage) CheckShare(id, name string) (*Share, error) {
+	share, err := s.GetShare(id)
+	if err != nil {
+		return nil, err
+	}
+	if share.Name != name {
+		return nil, ErrShareNotFound
+	}
+	return share, nil
+}
+
+// UseShare counts a download through the link id of file name, refusing
+// it once the link is used up.
+func (s *Storage) UseShare(id, name string) (*Share, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	share, err := s.CheckShare(id, name)
+	if err != nil {
+		return nil, err
+	}
+	if share.MaxDownloads > 0 && share.Downloads >= share.MaxDownloads {
+		return nil, ErrShareUsedUp
+	}
+
+	share.Downloads++
+	if err := s.writeShare(share); err != nil {
+		return nil, err
+	}
+	return share, nil
+}
+
+// ListShares returns the live share links, oldest first.
+func (s *Storage) ListShares() ([]*Share, error) {
+	entries, err := os.ReadDir(s.shareDir())
+	if os.IsNotExist(err) {
+		return []*Share{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	shares := []*Share{}
+	for _, entry := range entries {
+		id, ok := strings.CutSuffix(entry.Name(), ".json")
+		if !ok {
+			continue
+		}
+		if share, err := s.GetShare(id); err == nil {
+			shares = append(shares, share)
+		}
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Created.Before(shares[j].Created) })
+	return shares, nil
+}
+
+// RevokeShare deletes a share link; downloads through it stop at once.
+func (s *Storage) RevokeShare(id string) error {
+	if _, err := s.GetShare(id); err != nil {
+		return err
+	}
+	return os.Remove(s.sharePath(id))
+}
@@ -1,98 +1,551 @@
 package storage
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/pkg/sign"
 )
 
 type Storage struct {
 	FilesDir  string
 	ImagesDir string
+	MetaDir   string
+	TempDir   string
+
+	mu sync.Mutex
+
+	basePath   string
+	nsMu       sync.Mutex
+	namespaces map[string]*Storage
+}
+
+// Meta is the sidecar record kept next to a stored object.
+type Meta struct {
+	Digest    string          `json:"digest"`
+	Size      int64           `json:"size"`
+	Signature *sign.Signature `json:"signature,omitempty"`
+	Promoted  *Promotion      `json:"promoted,omitempty"`
 }
 
 func New(basePath string) *Storage {
 	filesDir := filepath.Join(basePath, "files")
 	imagesDir := filepath.Join(basePath, "images")
-	
+	metaDir := filepath.Join(basePath, "meta")
+	tempDir := filepath.Join(basePath, "tmp")
+
 	os.MkdirAll(filesDir, 0755)
 	os.MkdirAll(imagesDir, 0755)
-	
+	os.MkdirAll(filepath.Join(metaDir, "images"), 0755)
+	os.MkdirAll(filepath.Join(metaDir, "files"), 0755)
+	os.MkdirAll(tempDir, 0755)
+
 	return &Storage{
 		FilesDir:  filesDir,
 		ImagesDir: imagesDir,
+		MetaDir:   metaDir,
+		TempDir:   tempDir,
+		basePath:  basePath,
+	}
+}
+
+// Pending is an object being written to a temporary file. Nothing is
+// visible to readers until Commit moves it into place.
+type Pending struct {
+	// Meta is stored alongside the object on Commit. Digest and Size are
+	// filled in from the written content.
+	Meta Meta
+	// Condition, when set, is checked against the stored object on Commit
+	Condition *Condition
+
+	storage  *Storage
+	file     *os.File
+	path     string
+	metaPath string
+	hash     hash.Hash
+	size     int64
+	// onCommit runs under the storage lock once the object is in place
+	onCommit func() error
+	// session is the upload session the content was received through. Its
+	// data outlives an Abort or a failed Commit, so the upload can be
+	// finished again, and the session goes once the content is stored.
+	session string
+}
+
+func (s *Storage) newPending(path, metaPath string) (*Pending, error) {
+	file, err := os.CreateTemp(s.TempDir, "upload-*")
+	if err != nil {
+		return nil, fmt.Errorf("create temp file: %w", err)
+	}
+
+	return &Pending{
+		storage:  s,
+		file:     file,
+		path:     path,
+		metaPath: metaPath,
+		hash:     sha256.New(),
+	}, nil
+}
+
+func (p *Pending) Write(b []byte) (int, error) {
+	n, err := p.file.Write(b)
+	p.hash.Write(b[:n])
+	p.size += int64(n)
+	return n, err
+}
+
+// Digest returns the digest of everything written so far.
+func (p *Pending) Digest() string {
+	return "sha256:" + hex.EncodeToString(p.hash.Sum(nil))
+}
+
+func (p *Pending) Size() int64 {
+	return p.size
+}
+
+func (p *Pending) Commit() error {
+	if err := p.file.Sync(); err != nil {
+		p.Abort()
+		return fmt.Errorf("sync temp file: %w", err)
+	}
+	if err := p.file.Close(); err != nil {
+		p.Abort()
+		return fmt.Errorf("close temp file: %w", err)
 	}
+
+	p.Meta.Digest = p.Digest()
+	p.Meta.Size = p.size
+
+	p.storage.mu.Lock()
+	defer p.storage.mu.Unlock()
+
+	if p.Condition != nil {
+		if err := p.storage.checkCondition(p.path, p.metaPath, p.Condition); err != nil {
+			p.drop()
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(p.path), 0755); err != nil {
+		p.drop()
+		return fmt.Errorf("create directory: %w", err)
+	}
+	if err := os.Rename(p.file.Name(), p.path); err != nil {
+		p.drop()
+		return fmt.Errorf("move into place: %w", err)
+	}
+	if p.session != "" {
+		p.storage.closeSession(p.session, true)
+	}
+
+	if err := writeMeta(p.metaPath, &p.Meta); err != nil {
+		return err
+	}
+	if p.onCommit != nil {
+		return p.onCommit()
+	}
+	return nil
+}
+
+// Abort discards the pending object. Content received through an upload
+// session stays with the session.
+func (p *Pending) Abort() {
+	p.file.Close()
+	p.drop()
+}
+
+// drop discards the content of a Pending that is not stored.
+func (p *Pending) drop() {
+	if p.session != "" {
+		p.storage.closeSession(p.session, false)
+		return
+	}
+	os.Remove(p.file.Name())
+}
+
+// ErrPreconditionFailed is returned when the stored object is not in the
+// state a Condition requires.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Condition makes a write depend on the object it replaces, like the
+// If-Match and If-None-Match headers, so that concurrent writers do not
+// silently overwrite each other. Entries are digests, or "*" for any
+// object at all.
+type Condition struct {
+	// Match requires the stored object to have one of these digests
+	Match []string
+	// NoneMatch requires the stored object to have none of them
+	NoneMatch []string
+}
+
+func conditionHas(list []string, digest string) bool {
+	for _, entry := range list {
+		if entry == "*" || entry == digest {
+			return true
+		}
+	}
+	return false
+}
+
+// check returns ErrPreconditionFailed unless meta, the metadata of the
+// stored object or nil when there is none, satisfies c.
+func (c *Condition) check(meta *Meta) error {
+	if len(c.Match) > 0 {
+		if meta == nil {
+			return fmt.Errorf("%w: nothing is stored yet", ErrPreconditionFailed)
+		}
+		if !conditionHas(c.Match, meta.Digest) {
+			return fmt.Errorf("%w: the stored version is %s", ErrPreconditionFailed, meta.Digest)
+		}
+	}
+	if meta != nil && conditionHas(c.NoneMatch, meta.Digest) {
+		return fmt.Errorf("%w: already stored as %s", ErrPreconditionFailed, meta.Digest)
+	}
+	return nil
+}
+
+func (s *Storage) checkCondition(path, metaPath string, condition *Condition) error {
+	meta, err := s.loadMeta(path, metaPath)
+	if os.IsNotExist(err) {
+		meta = nil
+	} else if err != nil {
+		return err
+	}
+	return condition.check(meta)
+}
+
+// CheckFile tells early whether a write of filename under condition can
+// succeed. Commit checks again, since the file may change in between.
+func (s *Storage) CheckFile(filename string, condition *Condition) error {
+	return s.checkCondition(s.filePath(filename), s.fileMetaPath(filename), condition)
+}
+
+func readMeta(metaPath string) (*Meta, error) {
+	data, err := os.ReadFile(metaPath)
+	if err != nil {
+		return nil, err
+	}
+
+	meta := &Meta{}
+	if err := json.Unmarshal(data, meta); err != nil {
+		return nil, fmt.Errorf("parse metadata: %w", err)
+	}
+	return meta, nil
+}
+
+func writeMeta(metaPath string, meta *Meta) error {
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return fmt.Errorf("marshal metadata: %w", err)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(metaPath), 0755); err != nil {
+		return fmt.Errorf("create metadata dir: %w", err)
+	}
+
+	tmp := metaPath + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	if err := os.Rename(tmp, metaPath); err != nil {
+		return fmt.Errorf("write metadata: %w", err)
+	}
+	return nil
+}
+
+// loadMeta returns the metadata for the object at path. Objects stored
+// before metadata existed, or whose metadata is stale, are hashed once and
+// the result is cached.
+func (s *Storage) loadMeta(path, metaPath string) (*Meta, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	meta, err := readMeta(metaPath)
+	if err == nil && meta.Size == info.Size() {
+		return meta, nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return nil, fmt.Errorf("hash object: %w", err)
+	}
+
+	meta = &Meta{
+		Digest: "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Size:   size,
+	}
+	if err := writeMeta(metaPath, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *Storage) filePath(filename string) string {
+	return filepath.Join(s.FilesDir, filename)
+}
+
+func (s *Storage) fileMetaPath(filename string) string {
+	return filepath.Join(s.MetaDir, "files", filename+".json")
+}
+
+// CreateFile starts writing a new version of a file. The previous version
+// stays in place until the returned Pending is committed.
+func (s *Storage) CreateFile(filename string) (*Pending, error) {
+	return s.newPending(s.filePath(filename), s.fileMetaPath(filename))
 }
 
 func (s *Storage) SaveFile(filename string, content io.Reader) error {
-	filePath := filepath.Join(s.FilesDir, filename)
-	
-	file, err := os.Create(filePath)
+	pending, err := s.CreateFile(filename)
 	if err != nil {
 		return fmt.Errorf("create file: %w", err)
 	}
-	defer file.Close()
-	
-	_, err = io.Copy(file, content)
+
+	_, err = io.Copy(pending, content)
 	if err != nil {
+		pending.Abort()
 		return fmt.Errorf("save file: %w", err)
 	}
-	
-	return nil
+
+	return pending.Commit()
 }
 
 func (s *Storage) GetFile(filename string) (*os.File, error) {
-	filePath := filepath.Join(s.FilesDir, filename)
-	return os.Open(filePath)
+	return os.Open(s.filePath(filename))
+}
+
+func (s *Storage) FileMeta(filename string) (*Meta, error) {
+	return s.loadMeta(s.filePath(filename), s.fileMetaPath(filename))
 }
 
 func (s *Storage) DeleteFile(filename string) error {
-	filePath := filepath.Join(s.FilesDir, filename)
-	return os.Remove(filePath)
+	os.Remove(s.fileMetaPath(filename))
+	if err := os.Remove(s.filePath(filename)); err != nil {
+		return err
+	}
+
+	// Drop the directories of a nested name once they are empty
+	removeEmptyDirs(filepath.Dir(s.filePath(filename)), s.FilesDir)
+	removeEmptyDirs(filepath.Dir(s.fileMetaPath(filename)), filepath.Join(s.MetaDir, "files"))
+	return nil
 }
 
-func (s *Storage) ListFiles() ([]string, error) {
-	entries, err := os.ReadDir(s.FilesDir)
+// ErrFileExists is returned when a file would replace another one without
+// being allowed to.
+var ErrFileExists = errors.New("file already exists")
+
+// CopyFile stores a copy of file src as dst, sharing storage with it when
+// the filesystem supports hard links. An existing dst is only replaced
+// when overwrite is set.
+func (s *Storage) CopyFile(src, dst string, overwrite bool) error {
+	meta, err := s.FileMeta(src)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	
-	var files []string
-	for _, entry := range entries {
-		if !entry.IsDir() {
-			files = append(files, entry.Name())
+	// A copy is a new object here, not the one that was promoted
+	meta.Promoted = nil
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkTarget(dst, overwrite); err != nil {
+		return err
+	}
+	if err := s.linkOrCopy(s.filePath(src), s.filePath(dst)); err != nil {
+		return err
+	}
+	return writeMeta(s.fileMetaPath(dst), meta)
+}
+
+// MoveFile renames file src to dst, along with its metadata. An existing
+// dst is only replaced when overwrite is set.
+func (s *Storage) MoveFile(src, dst string, overwrite bool) error {
+	if _, err := s.FileMeta(src); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.checkTarget(dst, overwrite); err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(s.filePath(dst)), 0755); err != nil {
+		return fmt.Errorf("create directory: %w", err)
+	}
+	if err := os.Rename(s.filePath(src), s.filePath(dst)); err != nil {
+		return fmt.Errorf("move file: %w", err)
+	}
+
+	// Metadata that failed to move is rebuilt on first use
+	os.Remove(s.fileMetaPath(dst))
+	if os.MkdirAll(filepath.Dir(s.fileMetaPath(dst)), 0755) == nil {
+		os.Rename(s.fileMetaPath(src), s.fileMetaPath(dst))
+	}
+	removeEmptyDirs(filepath.Dir(s.filePath(src)), s.FilesDir)
+	removeEmptyDirs(filepath.Dir(s.fileMetaPath(src)), filepath.Join(s.MetaDir, "files"))
+	return nil
+}
+
+// checkTarget refuses to put a file at name when a directory is there, or
+// another file unless overwrite is set. The caller holds s.mu.
+func (s *Storage) checkTarget(name string, overwrite bool) error {
+	info, err := os.Stat(s.filePath(name))
+	switch {
+	case os.IsNotExist(err):
+		return nil
+	case err != nil:
+		return err
+	case info.IsDir():
+		return fmt.Errorf("%s is a directory: %w", name, ErrFileExists)
+	case !overwrite:
+		return fmt.Errorf("%s: %w", name, ErrFileExists)
+	}
+	return nil
+}
+
+// removeEmptyDirs removes dir and its parents up to, not including, root
+// for as long as they are empty.
+func removeEmptyDirs(dir, root string) {
+	for dir != root && strings.HasPrefix(dir, root+string(filepath.Separator)) {
+		if os.Remove(dir) != nil {
+			return
 		}
+		dir = filepath.Dir(dir)
 	}
-	
+}
+
+// ListFiles returns the names of all files, with "/" separating the
+// directories of nested names.
+func (s *Storage) ListFiles() ([]string, error) {
+	files := []string{}
+	err := filepath.WalkDir(s.FilesDir, func(path string, entry os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		name, err := filepath.Rel(s.FilesDir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, filepath.ToSlash(name))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
 	return files, nil
 }
 
+type ImageInfo struct {
+	Name      string    `json:"name"`
+	Size      int64     `json:"size"`
+	ModTime   time.Time `json:"mod_time"`
+	Platforms []string  `json:"platforms,omitempty"`
+}
+
+func (s *Storage) imagePath(imageName string) string {
+	return filepath.Join(s.ImagesDir, imageName+".tar.gz")
+}
+
+func (s *Storage) imageMetaPath(imageName string) string {
+	return filepath.Join(s.MetaDir, "images", imageName+".json")
+}
+
+// CreateImage starts writing a new version of an image. The previous
+// version stays in place until the returned Pending is committed.
+func (s *Storage) CreateImage(imageName string) (*Pending, error) {
+	return s.newPending(s.imagePath(imageName), s.imageMetaPath(imageName))
+}
+
 func (s *Storage) SaveImage(imageName string, content io.Reader) error {
-	imagePath := filepath.Join(s.ImagesDir, imageName+".tar.gz")
-	
-	file, err := os.Create(imagePath)
+	pending, err := s.CreateImage(imageName)
 	if err != nil {
 		return fmt.Errorf("create image file: %w", err)
 	}
-	defer file.Close()
-	
-	_, err = io.Copy(file, content)
+
+	_, err = io.Copy(pending, content)
 	if err != nil {
+		pending.Abort()
 		return fmt.Errorf("save image: %w", err)
 	}
-	
-	return nil
+
+	return pending.Commit()
 }
 
 func (s *Storage) GetImage(imageName string) (*os.File, error) {
-	imagePath := filepath.Join(s.ImagesDir, imageName+".tar.gz")
-	return os.Open(imagePath)
+	return os.Open(s.imagePath(imageName))
 }
 
+func (s *Storage) ImageMeta(imageName string) (*Meta, error) {
+	return s.loadMeta(s.imagePath(imageName), s.imageMetaPath(imageName))
+}
+
+// SetImageSignature attaches sig to the current version of the image. It
+// fails if the image changed since the signature was made.
+func (s *Storage) SetImageSignature(imageName string, sig *sign.Signature) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	meta, err := s.loadMeta(s.imagePath(imageName), s.imageMetaPath(imageName))
+	if err != nil {
+		return err
+	}
+	if meta.Digest != sig.Digest {
+		return errors.New("image changed since it was signed")
+	}
+
+	meta.Signature = sig
+	return writeMeta(s.imageMetaPath(imageName), meta)
+}
+
+// DeleteImage removes an image together with all its platform builds.
 func (s *Storage) DeleteImage(imageName string) error {
-	imagePath := filepath.Join(s.ImagesDir, imageName+".tar.gz")
-	return os.Remove(imagePath)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.deleteImage(imageName)
+}
+
+func (s *Storage) deleteImage(imageName string) error {
+	index, err := s.readIndex(imageName)
+	if err != nil {
+		return err
+	}
+	for _, variant := range index.Variants {
+		key := variantKey(imageName, variant.Platform)
+		os.Remove(s.imageMetaPath(key))
+		os.Remove(s.imagePath(key))
+	}
+	os.Remove(s.indexPath(imageName))
+
+	os.Remove(s.imageMetaPath(imageName))
+	err = os.Remove(s.imagePath(imageName))
+	if os.IsNotExist(err) && len(index.Variants) > 0 {
+		return nil
+	}
+	return err
 }
 
 func (s *Storage) ListImages() ([]string, error) {
@@ -100,16 +553,67 @@ func (s *Storage) ListImages() ([]string, error) {
 	if err != nil {
 		return nil, err
 	}
-	
+
 	var images []string
+	seen := make(map[string]bool)
 	for _, entry := range entries {
-		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".gz" {
-			name := entry.Name()
-			if len(name) > 7 && name[len(name)-7:] == ".tar.gz" {
-				images = append(images, name[:len(name)-7])
+		name := entry.Name()
+		if entry.IsDir() {
+			continue
+		}
+
+		switch {
+		case strings.HasSuffix(name, ".index.json"):
+			name = strings.TrimSuffix(name, ".index.json")
+		case strings.HasSuffix(name, ".tar.gz") && len(name) > 7:
+			name = strings.TrimSuffix(name, ".tar.gz")
+			// Platform builds are listed through their index
+			if strings.Contains(name, "@") {
+				continue
+			}
+		default:
+			continue
+		}
+
+		if !seen[name] {
+			seen[name] = true
+			images = append(images, name)
+		}
+	}
+	sort.Strings(images)
+
+	return images, nil
+}
+
+// ListImageInfo lists images with their size and push time.
+func (s *Storage) ListImageInfo() ([]ImageInfo, error) {
+	names, err := s.ListImages()
+	if err != nil {
+		return nil, err
+	}
+
+	var images []ImageInfo
+	for _, name := range names {
+		image := ImageInfo{Name: name}
+		if info, err := os.Stat(s.imagePath(name)); err == nil {
+			image.Size = info.Size()
+			image.ModTime = info.ModTime()
+		}
+
+		variants, err := s.ImageVariants(name)
+		if err != nil {
+			continue
+		}
+		for _, variant := range variants {
+			image.Size += variant.Size
+			image.Platforms = append(image.Platforms, variant.Platform)
+			if variant.Pushed.After(image.ModTime) {
+				image.ModTime = variant.Pushed
 			}
 		}
+
+		images = append(images, image)
 	}
-	
+
 	return images, nil
-}
\ No newline at end of file
+}
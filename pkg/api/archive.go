@@ -0,0 +1,90 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/dollarkillerx/unregistry/pkg/progress"
+)
+
+// ArchiveFormat returns the archive format the server builds for a file
+// named like path: "zip" or "tar.gz".
+func ArchiveFormat(path string) (string, error) {
+	switch {
+	case strings.HasSuffix(path, ".zip"):
+		return "zip", nil
+	case strings.HasSuffix(path, ".tar.gz"), strings.HasSuffix(path, ".tgz"):
+		return "tar.gz", nil
+	}
+	return "", fmt.Errorf("cannot tell the archive format of %s: use .zip, .tar.gz or .tgz", path)
+}
+
+// StreamArchive downloads names, and every file under prefixes, as one
+// archive in format, written to w as the server builds it.
+func (c *Client) StreamArchive(ctx context.Context, names, prefixes []string, format string, w io.Writer, showProgress bool) error {
+	request, err := json.Marshal(map[string]interface{}{
+		"format":   format,
+		"names":    names,
+		"prefixes": prefixes,
+	})
+	if err != nil {
+		return fmt.Errorf("encode request: %w", err)
+	}
+
+	resp, err := c.doRequestContext(ctx, "POST", "/api/file/archive", bytes.NewReader(request), "application/json")
+	if err != nil {
+		return fmt.Errorf("archive request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("archive failed: %s", string(body))
+	}
+
+	var body io.Reader = resp.Body
+	if showProgress {
+		progressReader := progress.NewReader(resp.Body, -1, "Downloading archive")
+		defer progressReader.Close()
+		body = progressReader
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		return fmt.Errorf("download archive: %w", err)
+	}
+	return nil
+}
+
+// DownloadArchive saves the archive of names and prefixes at destPath, in
+// the format its extension names. A failed download leaves nothing behind.
+func (c *Client) DownloadArchive(names, prefixes []string, destPath string, showProgress bool) error {
+	format, err := ArchiveFormat(destPath)
+	if err != nil {
+		return err
+	}
+
+	part := destPath + ".part"
+	file, err := os.Create(part)
+	if err != nil {
+		return fmt.Errorf("create file: %w", err)
+	}
+
+	err = c.StreamArchive(context.Background(), names, prefixes, format, file, showProgress)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	if err := os.Rename(part, destPath); err != nil {
+		return fmt.Errorf("move download into place: %w", err)
+	}
+	return nil
+}
@@ -1,22 +1,42 @@
 package api
 
 import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
-	"mime/multipart"
 	"net/http"
+	"net/url"
 	"os"
 	"path/filepath"
-	"strconv"
+	"strings"
+	"time"
 
+	"github.com/dollarkillerx/unregistry/pkg/imgarchive"
 	"github.com/dollarkillerx/unregistry/pkg/progress"
+	"github.com/dollarkillerx/unregistry/pkg/sign"
 )
 
 type Client struct {
 	BaseURL string
 	Token   string
-	client  *http.Client
+	// Namespace is the server namespace requests operate in; empty is the
+	// default namespace.
+	Namespace string
+	// Logf receives notices such as resumed uploads; nil drops them.
+	Logf func(format string, args ...interface{})
+	// Parallel is how many ranges large downloads are fetched in at once;
+	// 0 or 1 downloads in a single stream.
+	Parallel int
+	// UploadStateDir, when set, records the session of every unfinished
+	// upload, so a later run making the same upload resumes it instead of
+	// starting over.
+	UploadStateDir string
+	client         *http.Client
 }
 
 func NewClient(baseURL, token string) *Client {
@@ -28,17 +48,37 @@ func NewClient(baseURL, token string) *Client {
 }
 
 func (c *Client) doRequest(method, url string, body io.Reader, contentType string) (*http.Response, error) {
-	req, err := http.NewRequest(method, c.BaseURL+url, body)
+	return c.doRequestContext(context.Background(), method, url, body, contentType)
+}
+
+func (c *Client) doRequestContext(ctx context.Context, method, url string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := c.newRequest(ctx, method, url, body, contentType)
 	if err != nil {
 		return nil, err
 	}
+	return c.client.Do(req)
+}
+
+// newRequest builds an authenticated API request for callers that need to
+// set more headers.
+func (c *Client) newRequest(ctx context.Context, method, url string, body io.Reader, contentType string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+url, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Namespace != "" {
+		query := req.URL.Query()
+		query.Set("namespace", c.Namespace)
+		req.URL.RawQuery = query.Encode()
+	}
 
 	req.Header.Set("Authorization", "Bearer "+c.Token)
 	if contentType != "" {
 		req.Header.Set("Content-Type", contentType)
 	}
 
-	return c.client.Do(req)
+	return req, nil
 }
 
 // File operations
@@ -47,6 +87,26 @@ func (c *Client) UploadFile(filePath string) error {
 }
 
 func (c *Client) UploadFileWithProgress(filePath string, showProgress bool) error {
+	return c.UploadFileAs(filePath, filepath.Base(filePath), showProgress)
+}
+
+// UploadFileAs uploads the local file at filePath under the server name
+// filename.
+func (c *Client) UploadFileAs(filePath, filename string, showProgress bool) error {
+	return c.uploadFile(filePath, filename, showProgress, finishOptions{})
+}
+
+// UploadArchiveExtract uploads the zip or tar.gz at filePath and has the
+// server unpack it into the directory prefix, replacing what was there.
+func (c *Client) UploadArchiveExtract(filePath, prefix string, showProgress bool) error {
+	prefix = strings.Trim(prefix, "/")
+	if prefix == "" {
+		return fmt.Errorf("extract needs a directory to unpack into")
+	}
+	return c.uploadFile(filePath, prefix, showProgress, finishOptions{extract: true})
+}
+
+func (c *Client) uploadFile(filePath, filename string, showProgress bool, opts finishOptions) error {
 	file, err := os.Open(filePath)
 	if err != nil {
 		return fmt.Errorf("open file: %w", err)
@@ -58,101 +118,112 @@ func (c *Client) UploadFileWithProgress(filePath string, showProgress bool) erro
 		return fmt.Errorf("get file info: %w", err)
 	}
 
-	// Create a pipe for streaming
-	pipeReader, pipeWriter := io.Pipe()
-	writer := multipart.NewWriter(pipeWriter)
-	contentType := writer.FormDataContentType()
+	var body io.Reader = file
+	if showProgress {
+		progressReader := progress.NewReader(file, fileInfo.Size(), "Uploading "+filename)
+		defer progressReader.Close()
+		body = progressReader
+	}
 
-	// Start a goroutine to write to the pipe
-	go func() {
-		defer pipeWriter.Close()
-		defer writer.Close()
+	return c.upload(context.Background(), "file", filename, "", body, fileInfo.Size(), nil, opts)
+}
 
-		part, err := writer.CreateFormFile("file", filepath.Base(filePath))
-		if err != nil {
-			pipeWriter.CloseWithError(err)
-			return
-		}
+func (c *Client) DownloadFile(filename, destPath string) error {
+	return c.DownloadFileWithProgress(filename, destPath, false)
+}
 
-		_, err = io.Copy(part, file)
-		if err != nil {
-			pipeWriter.CloseWithError(err)
-			return
-		}
-	}()
+func (c *Client) DownloadFileWithProgress(filename, destPath string, showProgress bool) error {
+	return c.DownloadFileVerified(filename, destPath, "", showProgress)
+}
 
-	var body io.Reader = pipeReader
-	if showProgress {
-		// Calculate the approximate size of the multipart request
-		// This is an estimation: file size + multipart overhead (roughly 200-300 bytes)
-		totalSize := fileInfo.Size() + 300
-		progressReader := progress.NewReader(pipeReader, totalSize, "Uploading "+filepath.Base(filePath))
-		defer progressReader.Close()
-		body = progressReader
+// DownloadFileVerified downloads a file and fails, leaving destPath alone,
+// unless its sha256 digest is expectSHA256 (bare hex or "sha256:<hex>").
+// An empty expectSHA256 only checks the digest the server sent.
+func (c *Client) DownloadFileVerified(filename, destPath, expectSHA256 string, showProgress bool) error {
+	if destPath == "" {
+		destPath = filename
 	}
 
-	resp, err := c.doRequest("POST", "/api/file/upload", body, contentType)
+	return c.download(context.Background(), "/api/file/download/"+filename, destPath, "Downloading "+filename, expectSHA256, showProgress)
+}
+
+// UploadFileStream uploads the content read from r as filename.
+func (c *Client) UploadFileStream(ctx context.Context, filename string, r io.Reader) error {
+	return c.upload(ctx, "file", filename, "", r, -1, nil, finishOptions{})
+}
+
+// StreamFile writes a file to w as it downloads, for pipes where nothing can
+// be held back. A digest mismatch, against the server's digest or
+// expectSHA256 when set, is only reported at the end, after the content
+// was written.
+func (c *Client) StreamFile(ctx context.Context, filename string, w io.Writer, expectSHA256 string) error {
+	if expectSHA256 != "" {
+		var err error
+		if expectSHA256, err = normalizeDigest(expectSHA256); err != nil {
+			return err
+		}
+	}
+
+	body, _, err := c.OpenFile(ctx, filename)
 	if err != nil {
-		return fmt.Errorf("upload request: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
+	defer body.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("upload failed: %s", string(respBody))
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(w, hash), body); err != nil {
+		return fmt.Errorf("download: %w", err)
 	}
+	return checkDigest("sha256:"+hex.EncodeToString(hash.Sum(nil)), "", expectSHA256)
+}
 
-	return nil
+// OpenFile starts downloading a file and returns the content stream and its
+// size (-1 when unknown). The caller must close the stream.
+func (c *Client) OpenFile(ctx context.Context, filename string) (io.ReadCloser, int64, error) {
+	return c.openStream(ctx, "/api/file/download/"+filename)
 }
 
-func (c *Client) DownloadFile(filename, destPath string) error {
-	return c.DownloadFileWithProgress(filename, destPath, false)
+type FileInfo struct {
+	Name     string     `json:"name"`
+	Digest   string     `json:"digest"`
+	Size     int64      `json:"size"`
+	Promoted *Promotion `json:"promoted"`
 }
 
-func (c *Client) DownloadFileWithProgress(filename, destPath string, showProgress bool) error {
-	resp, err := c.doRequest("GET", "/api/file/download/"+filename, nil, "")
+func (c *Client) GetFileInfo(filename string) (*FileInfo, error) {
+	resp, err := c.doRequest("GET", "/api/file/info/"+filename, nil, "")
 	if err != nil {
-		return fmt.Errorf("download request: %w", err)
+		return nil, fmt.Errorf("info request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("download failed: %s", string(body))
+		return nil, fmt.Errorf("info failed: %s", string(body))
 	}
 
-	if destPath == "" {
-		destPath = filename
-	}
-
-	file, err := os.Create(destPath)
-	if err != nil {
-		return fmt.Errorf("create destination file: %w", err)
-	}
-	defer file.Close()
-
-	if showProgress {
-		contentLength := resp.Header.Get("Content-Length")
-		if contentLength != "" {
-			size, _ := strconv.ParseInt(contentLength, 10, 64)
-			progressReader := progress.NewReader(resp.Body, size, "Downloading "+filename)
-			defer progressReader.Close()
-			_, err = io.Copy(file, progressReader)
-		} else {
-			_, err = io.Copy(file, resp.Body)
-		}
-	} else {
-		_, err = io.Copy(file, resp.Body)
-	}
+	info := &FileInfo{}
+	err = json.NewDecoder(resp.Body).Decode(info)
 	if err != nil {
-		return fmt.Errorf("save file: %w", err)
+		return nil, fmt.Errorf("decode response: %w", err)
 	}
 
-	return nil
+	return info, nil
 }
 
 func (c *Client) ListFiles() ([]string, error) {
-	resp, err := c.doRequest("GET", "/api/file/list", nil, "")
+	return c.ListFilesPrefix("")
+}
+
+// ListFilesPrefix lists the files whose names start with prefix, such as
+// "releases/1.2/".
+func (c *Client) ListFilesPrefix(prefix string) ([]string, error) {
+	path := "/api/file/list"
+	if prefix != "" {
+		path += "?prefix=" + url.QueryEscape(prefix)
+	}
+
+	resp, err := c.doRequest("GET", path, nil, "")
 	if err != nil {
 		return nil, fmt.Errorf("list request: %w", err)
 	}
@@ -175,6 +246,37 @@ func (c *Client) ListFiles() ([]string, error) {
 	return result.Files, nil
 }
 
+// ListFileInfo returns the digest and size of every file whose name starts
+// with prefix, keyed by name.
+func (c *Client) ListFileInfo(prefix string) (map[string]*FileInfo, error) {
+	query := url.Values{"meta": {"true"}}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+
+	resp, err := c.doRequest("GET", "/api/file/list?"+query.Encode(), nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("list request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list failed: %s", string(body))
+	}
+
+	var result struct {
+		Meta map[string]*FileInfo `json:"meta"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	for name, info := range result.Meta {
+		info.Name = name
+	}
+	return result.Meta, nil
+}
+
 func (c *Client) DeleteFile(filename string) error {
 	resp, err := c.doRequest("DELETE", "/api/file/"+filename, nil, "")
 	if err != nil {
@@ -190,12 +292,49 @@ func (c *Client) DeleteFile(filename string) error {
 	return nil
 }
 
+// CopyFile copies the file from to the name to on the server. An existing
+// file at to is only replaced when overwrite is set.
+func (c *Client) CopyFile(from, to string, overwrite bool) error {
+	return c.relocate("copy", from, to, overwrite)
+}
+
+// MoveFile renames the file from to to on the server. An existing file at
+// to is only replaced when overwrite is set.
+func (c *Client) MoveFile(from, to string, overwrite bool) error {
+	return c.relocate("move", from, to, overwrite)
+}
+
+func (c *Client) relocate(op, from, to string, overwrite bool) error {
+	query := url.Values{"from": {from}, "to": {to}}
+	if overwrite {
+		query.Set("overwrite", "true")
+	}
+
+	resp, err := c.doRequest("POST", "/api/file/"+op+"?"+query.Encode(), nil, "")
+	if err != nil {
+		return fmt.Errorf("%s request: %w", op, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s failed: %s", op, string(body))
+	}
+	return nil
+}
+
 // Image operations
 func (c *Client) UploadImage(imagePath string) error {
 	return c.UploadImageWithProgress(imagePath, false)
 }
 
 func (c *Client) UploadImageWithProgress(imagePath string, showProgress bool) error {
+	return c.UploadImageSigned(imagePath, nil, showProgress)
+}
+
+// UploadImageSigned uploads an image together with a signature over its
+// digest. A nil signature uploads the image unsigned.
+func (c *Client) UploadImageSigned(imagePath string, sig *sign.Signature, showProgress bool) error {
 	file, err := os.Open(imagePath)
 	if err != nil {
 		return fmt.Errorf("open image: %w", err)
@@ -207,113 +346,252 @@ func (c *Client) UploadImageWithProgress(imagePath string, showProgress bool) er
 		return fmt.Errorf("get image info: %w", err)
 	}
 
-	// Create a pipe for streaming
-	pipeReader, pipeWriter := io.Pipe()
-	writer := multipart.NewWriter(pipeWriter)
-	contentType := writer.FormDataContentType()
+	imageName := strings.TrimSuffix(filepath.Base(imagePath), ".tar.gz")
 
-	// Start a goroutine to write to the pipe
-	go func() {
-		defer pipeWriter.Close()
-		defer writer.Close()
+	var body io.Reader = file
+	if showProgress {
+		progressReader := progress.NewReader(file, fileInfo.Size(), "Uploading "+filepath.Base(imagePath))
+		defer progressReader.Close()
+		body = progressReader
+	}
 
-		part, err := writer.CreateFormFile("image", filepath.Base(imagePath))
-		if err != nil {
-			pipeWriter.CloseWithError(err)
-			return
-		}
+	return c.upload(context.Background(), "image", imageName, "", body, fileInfo.Size(), func(string) *sign.Signature {
+		return sig
+	}, finishOptions{})
+}
 
-		_, err = io.Copy(part, file)
-		if err != nil {
-			pipeWriter.CloseWithError(err)
-			return
+// UploadImageStream uploads a gzipped image archive read from r without
+// knowing its size up front. When key is set the image is signed with it;
+// the signature is sent after the archive because the digest is only known
+// once the whole stream has been read.
+func (c *Client) UploadImageStream(ctx context.Context, imageName, platform string, r io.Reader, key ed25519.PrivateKey, showProgress bool) error {
+	var signer func(digest string) *sign.Signature
+	if key != nil {
+		signer = func(digest string) *sign.Signature {
+			return sign.Sign(key, digest)
 		}
-	}()
+	}
+	return c.uploadImageStream(ctx, imageName, platform, r, signer, showProgress)
+}
+
+// UploadImageStreamWithSignature uploads a gzipped image archive together
+// with an existing signature over it, e.g. one carried over from another
+// server.
+func (c *Client) UploadImageStreamWithSignature(ctx context.Context, imageName, platform string, r io.Reader, sig *sign.Signature) error {
+	return c.uploadImageStream(ctx, imageName, platform, r, func(string) *sign.Signature {
+		return sig
+	}, false)
+}
 
-	var body io.Reader = pipeReader
+func (c *Client) uploadImageStream(ctx context.Context, imageName, platform string, r io.Reader, signer func(digest string) *sign.Signature, showProgress bool) error {
 	if showProgress {
-		// Calculate the approximate size of the multipart request
-		// This is an estimation: file size + multipart overhead (roughly 200-300 bytes)
-		totalSize := fileInfo.Size() + 300
-		progressReader := progress.NewReader(pipeReader, totalSize, "Uploading "+filepath.Base(imagePath))
+		progressReader := progress.NewReader(r, -1, "Uploading "+imageName)
 		defer progressReader.Close()
-		body = progressReader
+		r = progressReader
+	}
+
+	return c.upload(ctx, "image", imageName, platform, r, -1, signer, finishOptions{})
+}
+
+// OpenImage starts downloading an image and returns the gzipped archive
+// stream and its size (-1 when unknown). The server picks the build for
+// platform, falling back to an image pushed without one. The caller must
+// close the stream.
+func (c *Client) OpenImage(ctx context.Context, imageName, platform string) (io.ReadCloser, int64, error) {
+	return c.openStream(ctx, "/api/img/download/"+imageName+platformQuery(platform))
+}
+
+func (c *Client) DownloadImage(imageName, destPath string) error {
+	return c.DownloadImageWithProgress(imageName, destPath, false)
+}
+
+func (c *Client) DownloadImageWithProgress(imageName, destPath string, showProgress bool) error {
+	if destPath == "" {
+		destPath = imageName + ".tar.gz"
+	}
+
+	return c.download(context.Background(), "/api/img/download/"+imageName, destPath, "Downloading "+imageName, "", showProgress)
+}
+
+func (c *Client) ListImages() ([]string, error) {
+	resp, err := c.doRequest("GET", "/api/img/list", nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("list request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("list failed: %s", string(body))
+	}
+
+	var result struct {
+		Images []string `json:"images"`
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
 	}
 
-	resp, err := c.doRequest("POST", "/api/img/upload", body, contentType)
+	return result.Images, nil
+}
+
+func (c *Client) DeleteImage(imageName string) error {
+	resp, err := c.doRequest("DELETE", "/api/img/"+imageName, nil, "")
 	if err != nil {
-		return fmt.Errorf("upload request: %w", err)
+		return fmt.Errorf("delete request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("upload failed: %s", string(respBody))
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("delete failed: %s", string(body))
 	}
 
 	return nil
 }
 
-func (c *Client) DownloadImage(imageName, destPath string) error {
-	return c.DownloadImageWithProgress(imageName, destPath, false)
+func platformQuery(platform string) string {
+	if platform == "" {
+		return ""
+	}
+	return "?platform=" + url.QueryEscape(platform)
 }
 
-func (c *Client) DownloadImageWithProgress(imageName, destPath string, showProgress bool) error {
-	resp, err := c.doRequest("GET", "/api/img/download/"+imageName, nil, "")
+// ListImagePlatforms returns the stored images and, for multi-platform
+// images, the platforms each one is available for.
+func (c *Client) ListImagePlatforms() ([]string, map[string][]string, error) {
+	resp, err := c.doRequest("GET", "/api/img/list", nil, "")
 	if err != nil {
-		return fmt.Errorf("download request: %w", err)
+		return nil, nil, fmt.Errorf("list request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("download failed: %s", string(body))
+		return nil, nil, fmt.Errorf("list failed: %s", string(body))
 	}
 
-	if destPath == "" {
-		destPath = imageName + ".tar.gz"
+	var result struct {
+		Images    []string            `json:"images"`
+		Platforms map[string][]string `json:"platforms"`
 	}
 
-	file, err := os.Create(destPath)
+	err = json.NewDecoder(resp.Body).Decode(&result)
 	if err != nil {
-		return fmt.Errorf("create destination file: %w", err)
+		return nil, nil, fmt.Errorf("decode response: %w", err)
 	}
-	defer file.Close()
 
-	if showProgress {
-		contentLength := resp.Header.Get("Content-Length")
-		if contentLength != "" {
-			size, _ := strconv.ParseInt(contentLength, 10, 64)
-			progressReader := progress.NewReader(resp.Body, size, "Downloading "+imageName)
-			defer progressReader.Close()
-			_, err = io.Copy(file, progressReader)
-		} else {
-			_, err = io.Copy(file, resp.Body)
-		}
-	} else {
-		_, err = io.Copy(file, resp.Body)
+	return result.Images, result.Platforms, nil
+}
+
+// DeleteImageVariant deletes the build of an image for one platform.
+func (c *Client) DeleteImageVariant(imageName, platform string) error {
+	resp, err := c.doRequest("DELETE", "/api/img/"+imageName+platformQuery(platform), nil, "")
+	if err != nil {
+		return fmt.Errorf("delete request: %w", err)
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("delete failed: %s", string(body))
+	}
+
+	return nil
+}
+
+type ImageInfo struct {
+	Name   string `json:"name"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	Signed bool   `json:"signed"`
+}
+
+func (c *Client) GetImageInfo(imageName, platform string) (*ImageInfo, error) {
+	resp, err := c.doRequest("GET", "/api/img/digest/"+imageName+platformQuery(platform), nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("digest request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("digest failed: %s", string(body))
+	}
+
+	info := &ImageInfo{}
+	err = json.NewDecoder(resp.Body).Decode(info)
 	if err != nil {
-		return fmt.Errorf("save image: %w", err)
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	return info, nil
+}
+
+func (c *Client) GetImageSignature(imageName, platform string) (*sign.Signature, error) {
+	resp, err := c.doRequest("GET", "/api/img/signature/"+imageName+platformQuery(platform), nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("signature request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("get signature failed: %s", string(body))
+	}
+
+	sig := &sign.Signature{}
+	err = json.NewDecoder(resp.Body).Decode(sig)
+	if err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	return sig, nil
+}
+
+func (c *Client) PutImageSignature(imageName, platform string, sig *sign.Signature) error {
+	data, err := json.Marshal(sig)
+	if err != nil {
+		return fmt.Errorf("encode signature: %w", err)
+	}
+
+	resp, err := c.doRequest("PUT", "/api/img/signature/"+imageName+platformQuery(platform), bytes.NewReader(data), "application/json")
+	if err != nil {
+		return fmt.Errorf("signature request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("sign failed: %s", string(body))
 	}
 
 	return nil
 }
 
-func (c *Client) ListImages() ([]string, error) {
-	resp, err := c.doRequest("GET", "/api/img/list", nil, "")
+// PruneImages applies the server retention policy and returns the names of
+// the deleted images (or the images that would be deleted when dryRun is set).
+func (c *Client) PruneImages(dryRun bool) ([]string, error) {
+	url := "/api/img/prune"
+	if dryRun {
+		url += "?dry_run=true"
+	}
+
+	resp, err := c.doRequest("POST", url, nil, "")
 	if err != nil {
-		return nil, fmt.Errorf("list request: %w", err)
+		return nil, fmt.Errorf("prune request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return nil, fmt.Errorf("list failed: %s", string(body))
+		return nil, fmt.Errorf("prune failed: %s", string(body))
 	}
 
 	var result struct {
-		Images []string `json:"images"`
+		Deleted []string `json:"deleted"`
 	}
 
 	err = json.NewDecoder(resp.Body).Decode(&result)
@@ -321,20 +599,75 @@ func (c *Client) ListImages() ([]string, error) {
 		return nil, fmt.Errorf("decode response: %w", err)
 	}
 
-	return result.Images, nil
+	return result.Deleted, nil
 }
 
-func (c *Client) DeleteImage(imageName string) error {
-	resp, err := c.doRequest("DELETE", "/api/img/"+imageName, nil, "")
+// DiffImages asks the server how image b differs from image a.
+func (c *Client) DiffImages(a, b, platform string) (*imgarchive.Diff, error) {
+	query := url.Values{"a": {a}, "b": {b}}
+	if platform != "" {
+		query.Set("platform", platform)
+	}
+
+	resp, err := c.doRequest("GET", "/api/img/diff?"+query.Encode(), nil, "")
 	if err != nil {
-		return fmt.Errorf("delete request: %w", err)
+		return nil, fmt.Errorf("diff request: %w", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		body, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("delete failed: %s", string(body))
+		return nil, fmt.Errorf("diff failed: %s", string(body))
 	}
 
-	return nil
-}
\ No newline at end of file
+	diff := &imgarchive.Diff{}
+	err = json.NewDecoder(resp.Body).Decode(diff)
+	if err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	return diff, nil
+}
+
+// Promotion records who copied an object into its namespace.
+type Promotion struct {
+	From string    `json:"from"`
+	By   string    `json:"by"`
+	At   time.Time `json:"at"`
+}
+
+func (c *Client) promote(kind, name, from, to string) (*Promotion, error) {
+	query := url.Values{"name": {name}, "from": {from}, "to": {to}}
+
+	resp, err := c.doRequest("POST", "/api/"+kind+"/promote?"+query.Encode(), nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("promote request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("promote failed: %s", string(body))
+	}
+
+	var result struct {
+		Promoted *Promotion `json:"promoted"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+
+	return result.Promoted, nil
+}
+
+// PromoteImage copies an image with all its platform builds from one
+// namespace to another on the server.
+func (c *Client) PromoteImage(imageName, from, to string) (*Promotion, error) {
+	return c.promote("img", imageName, from, to)
+}
+
+// PromoteFile copies a file from one namespace to another on the server.
+func (c *Client) PromoteFile(filename, from, to string) (*Promotion, error) {
+	return c.promote("file", filename, from, to)
+}
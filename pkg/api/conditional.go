@@ -0,0 +1,146 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+)
+
+// ErrPreconditionFailed is returned by conditional uploads when the file on
+// the server is not in the state the UploadCondition requires.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// UploadCondition restricts an upload to a state of the file on the
+// server, so that concurrent writers cannot silently replace each other's
+// work. The zero value uploads unconditionally.
+type UploadCondition struct {
+	// NoClobber only creates the file, it never replaces one
+	NoClobber bool
+	// IfVersion only replaces the file while it has this sha256 digest
+	IfVersion string
+}
+
+func (cond UploadCondition) options() (finishOptions, error) {
+	opts := finishOptions{noClobber: cond.NoClobber}
+	if cond.IfVersion != "" {
+		var err error
+		if opts.ifVersion, err = normalizeDigest(cond.IfVersion); err != nil {
+			return opts, err
+		}
+	}
+	return opts, nil
+}
+
+// UploadFileConditional uploads the local file at filePath as filename,
+// failing with ErrPreconditionFailed unless the server's file satisfies
+// cond when the upload is committed.
+func (c *Client) UploadFileConditional(filePath, filename string, cond UploadCondition, showProgress bool) error {
+	opts, err := cond.options()
+	if err != nil {
+		return err
+	}
+	return c.uploadFile(filePath, filename, showProgress, opts)
+}
+
+// UploadFileStreamConditional uploads the content read from r as filename,
+// under cond like UploadFileConditional.
+func (c *Client) UploadFileStreamConditional(ctx context.Context, filename string, r io.Reader, cond UploadCondition) error {
+	opts, err := cond.options()
+	if err != nil {
+		return err
+	}
+	return c.upload(ctx, "file", filename, "", r, -1, nil, opts)
+}
+
+// remoteMatches asks whether the object at path has digest, with a
+// conditional HEAD request: the server answers 304 when its ETag matches.
+// A missing object does not match.
+func (c *Client) remoteMatches(ctx context.Context, path, digest string) (bool, error) {
+	req, err := c.newRequest(ctx, "HEAD", path, nil, "")
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("If-None-Match", `"`+digest+`"`)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("check request: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNotModified:
+		return true, nil
+	case http.StatusOK, http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("check failed: %s", resp.Status)
+	}
+}
+
+// UploadFileIfChanged uploads the local file at filePath as filename unless
+// the server already has the same content under that name, and reports
+// whether it uploaded.
+func (c *Client) UploadFileIfChanged(filePath, filename string, showProgress bool) (bool, error) {
+	return c.UploadFileIfChangedConditional(filePath, filename, UploadCondition{}, showProgress)
+}
+
+// UploadFileIfChangedConditional is UploadFileIfChanged with the upload
+// made under cond. Identical content is skipped even where cond would
+// refuse it, so pushing the same write-once file again is not an error.
+func (c *Client) UploadFileIfChangedConditional(filePath, filename string, cond UploadCondition, showProgress bool) (bool, error) {
+	if _, err := cond.options(); err != nil {
+		return false, err
+	}
+
+	digest, err := FileDigest(filePath)
+	if err != nil {
+		return false, fmt.Errorf("hash file: %w", err)
+	}
+
+	same, err := c.remoteMatches(context.Background(), "/api/file/download/"+filename, digest)
+	if err != nil {
+		return false, err
+	}
+	if same {
+		return false, nil
+	}
+	return true, c.UploadFileConditional(filePath, filename, cond, showProgress)
+}
+
+// DownloadFileIfChanged downloads a file like DownloadFileVerified, unless
+// destPath already holds the content the server has. It reports whether
+// it downloaded.
+func (c *Client) DownloadFileIfChanged(filename, destPath, expectSHA256 string, showProgress bool) (bool, error) {
+	if destPath == "" {
+		destPath = filename
+	}
+
+	if _, err := os.Stat(destPath); err == nil {
+		digest, err := FileDigest(destPath)
+		if err != nil {
+			return false, fmt.Errorf("hash %s: %w", destPath, err)
+		}
+
+		expected := digest
+		if expectSHA256 != "" {
+			if expected, err = normalizeDigest(expectSHA256); err != nil {
+				return false, err
+			}
+		}
+		if digest == expected {
+			same, err := c.remoteMatches(context.Background(), "/api/file/download/"+filename, digest)
+			if err != nil {
+				return false, err
+			}
+			if same {
+				return false, nil
+			}
+		}
+	}
+
+	return true, c.DownloadFileVerified(filename, destPath, expectSHA256, showProgress)
+}
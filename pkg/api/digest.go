@@ -0,0 +1,89 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// responseDigest returns the sha256 digest of the object a download response
+// carries, as "sha256:<hex>". It comes from the Digest header, or from the
+// ETag of servers that do not send one; "" means the digest is unknown.
+func responseDigest(header http.Header) string {
+	for _, value := range strings.Split(header.Get("Digest"), ",") {
+		algorithm, encoded, ok := strings.Cut(strings.TrimSpace(value), "=")
+		if !ok || !strings.EqualFold(algorithm, "sha-256") {
+			continue
+		}
+		if sum, err := base64.StdEncoding.DecodeString(encoded); err == nil && len(sum) == sha256.Size {
+			return "sha256:" + hex.EncodeToString(sum)
+		}
+	}
+
+	if etag := strings.Trim(header.Get("ETag"), `"`); strings.HasPrefix(etag, "sha256:") {
+		return etag
+	}
+	return ""
+}
+
+// normalizeDigest accepts a sha256 digest as bare hex or "sha256:<hex>".
+func normalizeDigest(digest string) (string, error) {
+	sum := strings.ToLower(strings.TrimPrefix(strings.TrimSpace(digest), "sha256:"))
+	if len(sum) != 2*sha256.Size || strings.Trim(sum, "0123456789abcdef") != "" {
+		return "", fmt.Errorf("invalid sha256 digest %q", digest)
+	}
+	return "sha256:" + sum, nil
+}
+
+// FileDigest returns the sha256 digest of the local file at path, as
+// "sha256:<hex>".
+func FileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return "sha256:" + hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// checkDigest compares the digest of downloaded content with what the
+// server announced and with what the caller expects; either may be empty.
+func checkDigest(got, server, expect string) error {
+	if server != "" && got != server {
+		return fmt.Errorf("download is corrupt: digest %s, expected %s", got, server)
+	}
+	if expect != "" && got != expect {
+		return fmt.Errorf("digest mismatch: got %s, expected %s", got, expect)
+	}
+	return nil
+}
+
+// verifyingReader hashes a download stream and turns its end into an
+// error when the content does not match the digest the server sent.
+type verifyingReader struct {
+	io.ReadCloser
+	hash   hash.Hash
+	digest string
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.ReadCloser.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if got := "sha256:" + hex.EncodeToString(v.hash.Sum(nil)); got != v.digest {
+			return n, fmt.Errorf("download is corrupt: digest %s, expected %s", got, v.digest)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,311 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/pkg/progress"
+)
+
+// retryDelay is how long to wait before retry attempt n (from 0) of an
+// interrupted transfer.
+func retryDelay(attempt int) time.Duration {
+	wait := time.Second << attempt
+	if wait > 30*time.Second || wait <= 0 {
+		wait = 30 * time.Second
+	}
+	return wait
+}
+
+// sleep waits d unless ctx ends first.
+func sleep(ctx context.Context, d time.Duration) error {
+	select {
+	case <-time.After(d):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// openRange requests path from offset on, only if the object still has
+// etag. It returns the body of a 206 response; any other answer means the
+// download cannot continue.
+func (c *Client) openRange(ctx context.Context, path, etag string, offset int64) (io.ReadCloser, error) {
+	req, err := c.newRequest(ctx, "GET", path, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	req.Header.Set("If-Range", etag)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusOK {
+			return nil, errors.New("the object changed on the server")
+		}
+		return nil, fmt.Errorf("resume failed: %s", resp.Status)
+	}
+	if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+		resp.Body.Close()
+		return nil, fmt.Errorf("resume failed: server sent range %q", resp.Header.Get("Content-Range"))
+	}
+	return resp.Body, nil
+}
+
+// resumingBody is a download stream that reconnects with a range request
+// when the connection drops, so readers see one uninterrupted body.
+type resumingBody struct {
+	ctx      context.Context
+	client   *Client
+	path     string
+	etag     string
+	body     io.ReadCloser
+	offset   int64
+	attempts int
+}
+
+// openStream starts downloading path. The returned stream resumes by
+// itself when the server sent an ETag to resume against, and fails at the
+// end when the content does not match the digest the server sent.
+func (c *Client) openStream(ctx context.Context, path string) (io.ReadCloser, int64, error) {
+	resp, err := c.doRequestContext(ctx, "GET", path, nil, "")
+	if err != nil {
+		return nil, 0, fmt.Errorf("download request: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, 0, fmt.Errorf("download failed: %s", string(body))
+	}
+
+	var body io.ReadCloser = resp.Body
+	if etag := resp.Header.Get("ETag"); etag != "" {
+		body = &resumingBody{ctx: ctx, client: c, path: path, etag: etag, body: resp.Body}
+	}
+	if digest := responseDigest(resp.Header); digest != "" {
+		body = &verifyingReader{ReadCloser: body, hash: sha256.New(), digest: digest}
+	}
+	return body, resp.ContentLength, nil
+}
+
+func (b *resumingBody) Read(p []byte) (int, error) {
+	for {
+		n, err := b.body.Read(p)
+		b.offset += int64(n)
+		if n > 0 || err == nil || err == io.EOF {
+			if err != nil && err != io.EOF {
+				// Report the data now; the error comes back on the next read
+				err = nil
+			}
+			return n, err
+		}
+
+		if b.attempts == uploadRetries || b.ctx.Err() != nil {
+			return 0, err
+		}
+		wait := retryDelay(b.attempts)
+		b.attempts++
+		b.client.logf("Download interrupted at %d bytes (%v), resuming in %s", b.offset, err, wait)
+		if err := sleep(b.ctx, wait); err != nil {
+			return 0, err
+		}
+
+		body, resumeErr := b.client.openRange(b.ctx, b.path, b.etag, b.offset)
+		if resumeErr != nil {
+			if isNetError(resumeErr) {
+				continue
+			}
+			return 0, fmt.Errorf("%w (%v)", err, resumeErr)
+		}
+		b.body.Close()
+		b.body = body
+	}
+}
+
+func (b *resumingBody) Close() error {
+	return b.body.Close()
+}
+
+// isNetError reports whether err came from the connection rather than the
+// server's answer.
+func isNetError(err error) bool {
+	var urlErr interface{ Timeout() bool }
+	return errors.As(err, &urlErr)
+}
+
+// download saves path at dest, in parallel ranges when c.Parallel asks
+// for it. The content only replaces dest once it matches the digest the
+// server sent and, when set, the sha256 digest expect.
+func (c *Client) download(ctx context.Context, path, dest, label, expect string, showProgress bool) error {
+	if expect != "" {
+		var err error
+		if expect, err = normalizeDigest(expect); err != nil {
+			return err
+		}
+	}
+
+	if c.Parallel > 1 {
+		return c.downloadParallel(ctx, path, dest, label, expect, showProgress)
+	}
+	return c.downloadStream(ctx, path, dest, label, expect, showProgress)
+}
+
+// downloadStream saves path at dest. The content goes to dest.part first
+// and the ETag of the version being fetched to dest.part.etag, so a
+// download that was cut off, in this run or an earlier one, continues
+// where it stopped as long as the server still has the same version.
+func (c *Client) downloadStream(ctx context.Context, path, dest, label, expect string, showProgress bool) error {
+	part := dest + ".part"
+	etagPath := part + ".etag"
+
+	var digest string
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		var err error
+		digest, retry, err = c.downloadPart(ctx, path, part, etagPath, label, expect, showProgress)
+		if err == nil {
+			break
+		}
+		if !retry || attempt == uploadRetries || ctx.Err() != nil {
+			return err
+		}
+
+		wait := retryDelay(attempt)
+		c.logf("Download interrupted (%v), resuming in %s", err, wait)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+
+	got, err := FileDigest(part)
+	if err != nil {
+		return fmt.Errorf("verify download: %w", err)
+	}
+	os.Remove(etagPath)
+	if err := checkDigest(got, digest, expect); err != nil {
+		os.Remove(part)
+		return err
+	}
+
+	if err := os.Rename(part, dest); err != nil {
+		return fmt.Errorf("move download into place: %w", err)
+	}
+	return nil
+}
+
+// downloadPart fetches what is missing from part. It returns the digest
+// the server sent for the object and reports whether a failure is worth
+// retrying.
+func (c *Client) downloadPart(ctx context.Context, path, part, etagPath, label, expect string, showProgress bool) (string, bool, error) {
+	var offset int64
+	etag, _ := os.ReadFile(etagPath)
+	if info, err := os.Stat(part); err == nil && len(etag) > 0 {
+		offset = info.Size()
+	}
+
+	req, err := c.newRequest(ctx, "GET", path, nil, "")
+	if err != nil {
+		return "", false, err
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(etag))
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", true, fmt.Errorf("download request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	digest := responseDigest(resp.Header)
+	if expect != "" && digest != "" && digest != expect && resp.StatusCode < http.StatusBadRequest {
+		return "", false, fmt.Errorf("digest mismatch: server has %s, expected %s", digest, expect)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		if !strings.HasPrefix(resp.Header.Get("Content-Range"), fmt.Sprintf("bytes %d-", offset)) {
+			return "", false, fmt.Errorf("download failed: server sent range %q", resp.Header.Get("Content-Range"))
+		}
+		flags |= os.O_APPEND
+	case http.StatusOK:
+		// A fresh start: nothing saved yet, or the object changed
+		offset = 0
+		flags |= os.O_TRUNC
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			if err := os.WriteFile(etagPath, []byte(etag), 0644); err != nil {
+				return "", false, fmt.Errorf("save download state: %w", err)
+			}
+		} else {
+			os.Remove(etagPath)
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		// The partial file is not a prefix of the object: start over
+		os.Remove(etagPath)
+		os.Remove(part)
+		return "", true, errors.New("partial download does not match the server")
+	default:
+		body, _ := io.ReadAll(resp.Body)
+		return "", false, fmt.Errorf("download failed: %s", string(body))
+	}
+
+	file, err := os.OpenFile(part, flags, 0644)
+	if err != nil {
+		return "", false, fmt.Errorf("create destination file: %w", err)
+	}
+	defer file.Close()
+
+	total := int64(-1)
+	if resp.ContentLength >= 0 {
+		total = offset + resp.ContentLength
+	}
+
+	var body io.Reader = resp.Body
+	if showProgress {
+		progressReader := progress.NewReaderFrom(resp.Body, offset, total, label)
+		defer progressReader.Close()
+		body = progressReader
+	}
+
+	out := &writeRecorder{w: file}
+	n, err := io.Copy(out, body)
+	if out.err != nil {
+		return "", false, fmt.Errorf("save file: %w", out.err)
+	}
+	if err != nil {
+		return "", true, fmt.Errorf("download: %w", err)
+	}
+	if total >= 0 && offset+n != total {
+		return "", true, fmt.Errorf("download: got %d of %d bytes", offset+n, total)
+	}
+	return digest, false, file.Close()
+}
+
+// writeRecorder remembers write errors, telling a full disk apart from a
+// dropped connection.
+type writeRecorder struct {
+	w   io.Writer
+	err error
+}
+
+func (w *writeRecorder) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	if err != nil {
+		w.err = err
+	}
+	return n, err
+}
@@ -0,0 +1,172 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/dollarkillerx/unregistry/pkg/progress"
+)
+
+// Objects smaller than this per segment are downloaded in one stream
+const minSegmentSize = 4 << 20
+
+// segment is one byte range of a parallel download.
+type segment struct {
+	start, end int64 // inclusive
+}
+
+// downloadParallel fetches path into dest in c.Parallel concurrent ranges
+// written straight into a preallocated file, then checks the whole file
+// against the digest the server sent. Objects that are too small, or
+// servers that cannot serve ranges, fall back to a single stream.
+func (c *Client) downloadParallel(ctx context.Context, path, dest, label, expect string, showProgress bool) error {
+	req, err := c.newRequest(ctx, "HEAD", path, nil, "")
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("download request: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download failed: %s", resp.Status)
+	}
+
+	size := resp.ContentLength
+	etag := resp.Header.Get("ETag")
+	digest := responseDigest(resp.Header)
+	if expect != "" && digest != "" && digest != expect {
+		return fmt.Errorf("digest mismatch: server has %s, expected %s", digest, expect)
+	}
+	parts := int64(c.Parallel)
+	if size/minSegmentSize < parts {
+		parts = size / minSegmentSize
+	}
+	if parts < 2 || resp.Header.Get("Accept-Ranges") != "bytes" || digest == "" {
+		return c.downloadStream(ctx, path, dest, label, expect, showProgress)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(dest), "."+filepath.Base(dest)+".*")
+	if err != nil {
+		return fmt.Errorf("create destination file: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("allocate destination file: %w", err)
+	}
+
+	// One bar for all segments; the bar itself is safe for concurrent use
+	var counter io.Writer = io.Discard
+	if showProgress {
+		bar := progress.NewWriter(io.Discard, size, label)
+		defer bar.Close()
+		counter = bar
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	step := (size + parts - 1) / parts
+	for start := int64(0); start < size; start += step {
+		seg := segment{start: start, end: min(start+step, size) - 1}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := c.downloadSegment(ctx, path, etag, seg, file, counter); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	got, err := FileDigest(file.Name())
+	if err != nil {
+		return fmt.Errorf("verify download: %w", err)
+	}
+	if err := checkDigest(got, digest, expect); err != nil {
+		return err
+	}
+
+	if err := os.Rename(file.Name(), dest); err != nil {
+		return fmt.Errorf("move download into place: %w", err)
+	}
+	return nil
+}
+
+// downloadSegment writes one range at its offset in file, continuing from
+// where it stopped when the connection drops.
+func (c *Client) downloadSegment(ctx context.Context, path, etag string, seg segment, file *os.File, counter io.Writer) error {
+	at := seg.start
+	for attempt := 0; ; attempt++ {
+		err := c.fetchRange(ctx, path, etag, at, seg.end, io.NewOffsetWriter(file, at), counter, &at)
+		if err == nil {
+			return nil
+		}
+		var status *statusError
+		if errors.As(err, &status) || attempt == uploadRetries || ctx.Err() != nil {
+			return err
+		}
+
+		wait := retryDelay(attempt)
+		c.logf("Download of bytes %d-%d interrupted at %d (%v), resuming in %s", seg.start, seg.end, at, err, wait)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// fetchRange copies bytes start..end (inclusive) to w, advancing *at as
+// data arrives.
+func (c *Client) fetchRange(ctx context.Context, path, etag string, start, end int64, w io.Writer, counter io.Writer, at *int64) error {
+	req, err := c.newRequest(ctx, "GET", path, nil, "")
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	req.Header.Set("If-Range", etag)
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return &statusError{status: resp.StatusCode, body: "the object changed on the server during the download", offset: -1}
+	default:
+		return readStatusError(resp)
+	}
+
+	n, err := io.Copy(io.MultiWriter(w, counter), io.LimitReader(resp.Body, end-start+1))
+	*at += n
+	if err != nil {
+		return err
+	}
+	if n != end-start+1 {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package api
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// uploadState is what UploadStateDir records about an unfinished upload:
+// enough to find its session again when the same upload is started later.
+type uploadState struct {
+	ID        string `json:"id"`
+	BaseURL   string `json:"base_url"`
+	Namespace string `json:"namespace,omitempty"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+	Platform  string `json:"platform,omitempty"`
+	// Size is the length of the content, or -1 for a stream
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+}
+
+// uploadStatePath names the state of one upload after everything that
+// identifies it, so uploading the same name with other content of another
+// size starts over.
+func (c *Client) uploadStatePath(kind, name, platform string, size int64) string {
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s\x00%s\x00%s\x00%s\x00%s\x00%d", c.BaseURL, c.Namespace, kind, name, platform, size)))
+	return filepath.Join(c.UploadStateDir, hex.EncodeToString(key[:16])+".json")
+}
+
+// savedUpload returns the session an earlier run left for the same upload,
+// when the server still has it. The digest checked on finish catches
+// content that changed since.
+func (c *Client) savedUpload(ctx context.Context, kind, name, platform string, size int64) *UploadSession {
+	if c.UploadStateDir == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.uploadStatePath(kind, name, platform, size))
+	if err != nil {
+		return nil
+	}
+	var state uploadState
+	if json.Unmarshal(data, &state) != nil || state.BaseURL != c.BaseURL || state.Namespace != c.Namespace ||
+		state.Kind != kind || state.Name != name || state.Platform != platform || state.Size != size {
+		c.forgetUpload(kind, name, platform, size)
+		return nil
+	}
+
+	session, err := c.GetUpload(ctx, state.ID)
+	var status *statusError
+	if errors.As(err, &status) && status.status == http.StatusNotFound {
+		// Expired or finished
+		c.forgetUpload(kind, name, platform, size)
+		return nil
+	}
+	if err != nil || session.Kind != kind || session.Name != name || session.Platform != platform || (size >= 0 && session.Offset > size) {
+		return nil
+	}
+	return session
+}
+
+// saveUpload records session so a later run can resume it. Failing to do
+// so only costs that, and is not an error.
+func (c *Client) saveUpload(session *UploadSession, size int64) {
+	if c.UploadStateDir == "" {
+		return
+	}
+
+	state := uploadState{
+		ID:        session.ID,
+		BaseURL:   c.BaseURL,
+		Namespace: c.Namespace,
+		Kind:      session.Kind,
+		Name:      session.Name,
+		Platform:  session.Platform,
+		Size:      size,
+		Created:   time.Now().UTC(),
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.MkdirAll(c.UploadStateDir, 0700)
+	}
+	if err == nil {
+		path := c.uploadStatePath(session.Kind, session.Name, session.Platform, size)
+		if err = os.WriteFile(path+".tmp", data, 0600); err == nil {
+			err = os.Rename(path+".tmp", path)
+		}
+	}
+	if err != nil {
+		c.logf("Cannot record the upload for resuming later: %v", err)
+	}
+}
+
+// forgetUpload drops the record of a finished or abandoned upload.
+func (c *Client) forgetUpload(kind, name, platform string, size int64) {
+	if c.UploadStateDir != "" {
+		os.Remove(c.uploadStatePath(kind, name, platform, size))
+	}
+}
@@ -0,0 +1,179 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/internal/handler"
+	"github.com/dollarkillerx/unregistry/internal/storage"
+	"github.com/dollarkillerx/unregistry/pkg/auth"
+	"github.com/dollarkillerx/unregistry/pkg/sign"
+	"github.com/gorilla/mux"
+)
+
+// testServer serves the upload routes of a fresh data directory.
+func testServer(t *testing.T) (string, *storage.Storage) {
+	t.Helper()
+
+	store := storage.New(t.TempDir())
+	uploads := handler.NewUploadHandler(store, &sign.Policy{}, time.Hour, storage.DefaultExtractLimits)
+
+	r := mux.NewRouter()
+	a := r.PathPrefix("/api").Subrouter()
+	a.Use(auth.AuthMiddleware("test-token"))
+	a.HandleFunc("/upload", uploads.Create).Methods("POST")
+	a.HandleFunc("/upload/{id}", uploads.Status).Methods("GET")
+	a.HandleFunc("/upload/{id}", uploads.Chunk).Methods("PUT")
+	a.HandleFunc("/upload/{id}", uploads.Cancel).Methods("DELETE")
+	a.HandleFunc("/upload/{id}/finish", uploads.Finish).Methods("POST")
+
+	server := httptest.NewServer(r)
+	t.Cleanup(server.Close)
+	return server.URL, store
+}
+
+// interruptedUpload leaves the state a run killed after sending the first
+// sent bytes of content, size bytes or -1 for a stream, behind in dir, and
+// returns its session.
+func interruptedUpload(t *testing.T, baseURL, dir, name string, content []byte, sent int, size int64) *UploadSession {
+	t.Helper()
+
+	c := NewClient(baseURL, "test-token")
+	c.UploadStateDir = dir
+	ctx := context.Background()
+
+	session, err := c.CreateUpload(ctx, "file", name, "")
+	if err != nil {
+		t.Fatalf("CreateUpload: %v", err)
+	}
+	c.saveUpload(session, size)
+	if err := c.sendChunk(ctx, session.ID, 0, content[:sent]); err != nil {
+		t.Fatalf("sendChunk: %v", err)
+	}
+	return session
+}
+
+func stateFiles(t *testing.T, dir string) int {
+	t.Helper()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		t.Fatal(err)
+	}
+	return len(entries)
+}
+
+func TestUploadResumesAcrossClients(t *testing.T) {
+	baseURL, store := testServer(t)
+	dir := t.TempDir()
+	content := []byte("the content of a file that was half uploaded")
+	session := interruptedUpload(t, baseURL, dir, "a.txt", content, 10, int64(len(content)))
+
+	var logs []string
+	c := NewClient(baseURL, "test-token")
+	c.UploadStateDir = dir
+	c.Logf = func(format string, args ...interface{}) {
+		logs = append(logs, fmt.Sprintf(format, args...))
+	}
+	if err := c.upload(context.Background(), "file", "a.txt", "", bytes.NewReader(content), int64(len(content)), nil, finishOptions{}); err != nil {
+		t.Fatalf("upload: %v", err)
+	}
+
+	if len(logs) == 0 || !strings.Contains(logs[0], "Resuming") {
+		t.Fatalf("upload did not resume the earlier session, logged %q", logs)
+	}
+	file, err := store.GetFile("a.txt")
+	if err != nil {
+		t.Fatalf("GetFile: %v", err)
+	}
+	defer file.Close()
+	stored, _ := io.ReadAll(file)
+	if !bytes.Equal(stored, content) {
+		t.Fatalf("stored %q, want %q", stored, content)
+	}
+	if _, err := store.GetSession(session.ID); err != storage.ErrSessionNotFound {
+		t.Fatalf("session after the upload: %v", err)
+	}
+	if n := stateFiles(t, dir); n != 0 {
+		t.Fatalf("%d upload state files left after the upload", n)
+	}
+}
+
+func TestUploadResumeChangedContent(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		// size is -1 for a stream
+		size int64
+	}{
+		{"same size", "THE CONTENT of a file", 21},
+		{"different stream", "THE CONTENT of a file", -1},
+		{"shorter stream", "the", -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			baseURL, store := testServer(t)
+			dir := t.TempDir()
+			content := []byte(test.content)
+			earlier := []byte("the content of a file")
+			session := interruptedUpload(t, baseURL, dir, "a.txt", earlier, 10, test.size)
+
+			c := NewClient(baseURL, "test-token")
+			c.UploadStateDir = dir
+			err := c.upload(context.Background(), "file", "a.txt", "", bytes.NewReader(content), test.size, nil, finishOptions{})
+			if err == nil {
+				t.Fatal("upload of changed content over an earlier session succeeded")
+			}
+
+			if _, err := store.FileMeta("a.txt"); err == nil {
+				t.Fatal("changed content stored")
+			}
+			if _, err := store.GetSession(session.ID); err != storage.ErrSessionNotFound {
+				t.Fatalf("abandoned session: %v", err)
+			}
+			if n := stateFiles(t, dir); n != 0 {
+				t.Fatalf("%d upload state files left after the failed upload", n)
+			}
+
+			// The next run starts over
+			if err := c.upload(context.Background(), "file", "a.txt", "", bytes.NewReader(content), test.size, nil, finishOptions{}); err != nil {
+				t.Fatalf("upload after starting over: %v", err)
+			}
+		})
+	}
+}
+
+func TestSavedUploadGone(t *testing.T) {
+	baseURL, store := testServer(t)
+	dir := t.TempDir()
+	content := []byte("content")
+	session := interruptedUpload(t, baseURL, dir, "a.txt", content, 3, int64(len(content)))
+	if err := store.DeleteSession(session.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	c := NewClient(baseURL, "test-token")
+	c.UploadStateDir = dir
+	if got := c.savedUpload(context.Background(), "file", "a.txt", "", int64(len(content))); got != nil {
+		t.Fatalf("resumed session %s, which the server dropped", got.ID)
+	}
+	if n := stateFiles(t, dir); n != 0 {
+		t.Fatalf("%d upload state files left for a dropped session", n)
+	}
+
+	var status *statusError
+	_, err := c.GetUpload(context.Background(), session.ID)
+	if !errors.As(err, &status) || status.status != http.StatusNotFound {
+		t.Fatalf("GetUpload of a dropped session: %v", err)
+	}
+}
@@ -0,0 +1,400 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/pkg/sign"
+)
+
+// Uploads are sent in chunks through a resumable session. Only the chunk in
+// flight is kept in memory, so streams that cannot be replayed, like a
+// running docker save, still resume after a dropped connection.
+const (
+	uploadChunkSize = 8 << 20
+	uploadRetries   = 8
+)
+
+// UploadSession is a resumable upload on the server.
+type UploadSession struct {
+	ID       string    `json:"id"`
+	Kind     string    `json:"kind"`
+	Name     string    `json:"name"`
+	Platform string    `json:"platform,omitempty"`
+	Expires  time.Time `json:"expires"`
+	Offset   int64     `json:"offset"`
+}
+
+// statusError is a response the server sent on purpose. Retrying the same
+// request will not help, unlike a dropped connection.
+type statusError struct {
+	status int
+	body   string
+	// offset the server expects next, sent with a 409
+	offset int64
+}
+
+func (e *statusError) Error() string {
+	return strings.TrimSpace(e.body)
+}
+
+// Is makes a 412 answer match ErrPreconditionFailed.
+func (e *statusError) Is(target error) bool {
+	return target == ErrPreconditionFailed && e.status == http.StatusPreconditionFailed
+}
+
+func readStatusError(resp *http.Response) *statusError {
+	body, _ := io.ReadAll(resp.Body)
+	err := &statusError{status: resp.StatusCode, body: string(body), offset: -1}
+
+	var conflict struct {
+		Error  string `json:"error"`
+		Offset *int64 `json:"offset"`
+	}
+	if resp.StatusCode == http.StatusConflict && json.Unmarshal(body, &conflict) == nil && conflict.Offset != nil {
+		err.body, err.offset = conflict.Error, *conflict.Offset
+	}
+	return err
+}
+
+// CreateUpload starts a resumable upload of kind "file" or "image".
+func (c *Client) CreateUpload(ctx context.Context, kind, name, platform string) (*UploadSession, error) {
+	return c.createUpload(ctx, kind, name, platform, finishOptions{})
+}
+
+// createUpload starts a session. The server checks the conditions of opts
+// right away, so an upload that cannot succeed is not sent.
+func (c *Client) createUpload(ctx context.Context, kind, name, platform string, opts finishOptions) (*UploadSession, error) {
+	query := url.Values{"kind": {kind}, "name": {name}}
+	if platform != "" {
+		query.Set("platform", platform)
+	}
+
+	req, err := c.newRequest(ctx, "POST", "/api/upload?"+query.Encode(), nil, "")
+	if err != nil {
+		return nil, err
+	}
+	opts.setHeaders(req.Header)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upload request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return nil, fmt.Errorf("upload failed: %w", readStatusError(resp))
+	}
+
+	session := &UploadSession{}
+	if err := json.NewDecoder(resp.Body).Decode(session); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return session, nil
+}
+
+// GetUpload returns a session with the number of bytes the server holds.
+func (c *Client) GetUpload(ctx context.Context, id string) (*UploadSession, error) {
+	resp, err := c.doRequestContext(ctx, "GET", "/api/upload/"+id, nil, "")
+	if err != nil {
+		return nil, fmt.Errorf("upload status request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, readStatusError(resp)
+	}
+
+	session := &UploadSession{}
+	if err := json.NewDecoder(resp.Body).Decode(session); err != nil {
+		return nil, fmt.Errorf("decode response: %w", err)
+	}
+	return session, nil
+}
+
+// CancelUpload drops a session and everything it received.
+func (c *Client) CancelUpload(ctx context.Context, id string) error {
+	resp, err := c.doRequestContext(ctx, "DELETE", "/api/upload/"+id, nil, "")
+	if err != nil {
+		return fmt.Errorf("cancel upload request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cancel upload failed: %s", readStatusError(resp))
+	}
+	return nil
+}
+
+// putChunk sends data to be stored at offset and returns the offset the
+// server reached.
+func (c *Client) putChunk(ctx context.Context, id string, offset int64, data []byte) (int64, error) {
+	resp, err := c.doRequestContext(ctx, "PUT", fmt.Sprintf("/api/upload/%s?offset=%d", id, offset), bytes.NewReader(data), "application/octet-stream")
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, readStatusError(resp)
+	}
+
+	var result struct {
+		Offset int64 `json:"offset"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, err
+	}
+	return result.Offset, nil
+}
+
+// sendChunk stores chunk at offset. When the connection fails part way the
+// server keeps what it received; sendChunk asks how much that was and
+// sends the rest, backing off between attempts.
+func (c *Client) sendChunk(ctx context.Context, id string, offset int64, chunk []byte) error {
+	end := offset + int64(len(chunk))
+	at := offset
+
+	for attempt := 0; ; attempt++ {
+		reached, err := c.putChunk(ctx, id, at, chunk[at-offset:])
+		if err == nil && reached == end {
+			return nil
+		}
+
+		var status *statusError
+		switch {
+		case err == nil:
+			err = fmt.Errorf("server stored %d of %d bytes", reached-offset, len(chunk))
+		case errors.As(err, &status) && status.offset >= 0:
+			// The server has a different view of where the upload is
+			if status.offset < offset || status.offset > end {
+				return fmt.Errorf("upload failed: server is at offset %d, outside the chunk being sent", status.offset)
+			}
+			at = status.offset
+			if at == end {
+				return nil
+			}
+			continue
+		case errors.As(err, &status) && status.status < http.StatusInternalServerError && status.status != http.StatusConflict:
+			// A conflict without an offset means the server is still
+			// reading the broken request; anything else is final
+			return fmt.Errorf("upload failed: %s", status)
+		}
+
+		if attempt == uploadRetries || ctx.Err() != nil {
+			return fmt.Errorf("upload failed after %d attempts: %w", attempt+1, err)
+		}
+
+		wait := retryDelay(attempt)
+		c.logf("Upload interrupted at %d bytes (%v), resuming in %s", at, err, wait)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+
+		session, err := c.GetUpload(ctx, id)
+		if err != nil {
+			// Still unreachable; the next PUT finds the offset out
+			continue
+		}
+		if session.Offset < offset || session.Offset > end {
+			return fmt.Errorf("upload failed: server is at offset %d, outside the chunk being sent", session.Offset)
+		}
+		at = session.Offset
+		if at == end {
+			return nil
+		}
+	}
+}
+
+// finishOptions change how the server commits a finished upload.
+type finishOptions struct {
+	// extract expands the upload, a zip or tar.gz, into the directory the
+	// upload is named after
+	extract bool
+	// noClobber only lets the upload create the file, not replace it
+	noClobber bool
+	// ifVersion only lets the upload replace the file with this digest
+	ifVersion string
+}
+
+func (o finishOptions) setHeaders(header http.Header) {
+	if o.noClobber {
+		header.Set("If-None-Match", "*")
+	}
+	if o.ifVersion != "" {
+		header.Set("If-Match", `"`+o.ifVersion+`"`)
+	}
+}
+
+// finishUpload commits a session after the server checked it against digest.
+// A finish whose answer was lost may have committed the upload already, so
+// a retry that finds the session gone checks what the server stored.
+func (c *Client) finishUpload(ctx context.Context, session *UploadSession, digest string, sig *sign.Signature, opts finishOptions) error {
+	form := url.Values{}
+	if sig != nil {
+		data, err := json.Marshal(sig)
+		if err != nil {
+			return err
+		}
+		form.Set("signature", string(data))
+	}
+
+	path := "/api/upload/" + session.ID + "/finish?digest=" + url.QueryEscape(digest)
+	if opts.extract {
+		path += "&extract=true"
+	}
+	for attempt := 0; ; attempt++ {
+		req, err := c.newRequest(ctx, "POST", path, strings.NewReader(form.Encode()), "application/x-www-form-urlencoded")
+		if err != nil {
+			return err
+		}
+		opts.setHeaders(req.Header)
+		resp, err := c.client.Do(req)
+		if err == nil {
+			if resp.StatusCode == http.StatusOK {
+				resp.Body.Close()
+				return nil
+			}
+			status := readStatusError(resp)
+			resp.Body.Close()
+			switch {
+			case status.status == http.StatusNotFound && attempt > 0:
+				return c.confirmUpload(ctx, session, digest, opts, status)
+			case status.status < http.StatusInternalServerError && status.status != http.StatusConflict:
+				// A conflict means an earlier attempt is still being
+				// finished; anything else is final
+				return fmt.Errorf("upload failed: %w", status)
+			}
+			err = status
+		}
+
+		if attempt == uploadRetries || ctx.Err() != nil {
+			return fmt.Errorf("finish upload: %w", err)
+		}
+		wait := retryDelay(attempt)
+		c.logf("Finishing upload failed (%v), retrying in %s", err, wait)
+		if err := sleep(ctx, wait); err != nil {
+			return err
+		}
+	}
+}
+
+// confirmUpload decides a finish retried after its session disappeared:
+// it succeeded if the server now stores content with digest, and fails
+// with notFound otherwise.
+func (c *Client) confirmUpload(ctx context.Context, session *UploadSession, digest string, opts finishOptions, notFound error) error {
+	if opts.extract {
+		// The archive itself is never stored, so there is nothing to compare
+		return fmt.Errorf("upload failed: %w (an earlier attempt may have extracted it)", notFound)
+	}
+
+	path := "/api/file/download/" + session.Name
+	if session.Kind == "image" {
+		path = "/api/img/download/" + session.Name + platformQuery(session.Platform)
+	}
+	same, err := c.remoteMatches(ctx, path, digest)
+	if err != nil {
+		return fmt.Errorf("finish upload: %w", err)
+	}
+	if !same {
+		return fmt.Errorf("upload failed: %w", notFound)
+	}
+	return nil
+}
+
+// upload sends everything read from r, size bytes or -1 when unknown,
+// through a resumable session and commits it under name. signer, when set,
+// signs the digest of the content once it is known. With UploadStateDir
+// set, an upload that an earlier run left unfinished is resumed: the part
+// the server holds is read from r and hashed but not sent again.
+func (c *Client) upload(ctx context.Context, kind, name, platform string, r io.Reader, size int64, signer func(digest string) *sign.Signature, opts finishOptions) error {
+	session := c.savedUpload(ctx, kind, name, platform, size)
+	resumed := session != nil
+	if resumed {
+		c.logf("Resuming the upload of %s at %d bytes", name, session.Offset)
+	} else {
+		var err error
+		session, err = c.createUpload(ctx, kind, name, platform, opts)
+		if err != nil {
+			return err
+		}
+		c.saveUpload(session, size)
+	}
+	// abandon gives up on a session that cannot be finished
+	abandon := func() {
+		c.CancelUpload(context.Background(), session.ID)
+		c.forgetUpload(kind, name, platform, size)
+	}
+
+	hash := sha256.New()
+	offset, err := io.CopyN(hash, r, session.Offset)
+	if err != nil {
+		abandon()
+		if err == io.EOF {
+			return fmt.Errorf("upload failed: the content is shorter than the %d bytes uploaded by an earlier run; run the upload again to start over", session.Offset)
+		}
+		return err
+	}
+
+	chunk := make([]byte, uploadChunkSize)
+	for {
+		n, readErr := io.ReadFull(r, chunk)
+		if readErr != nil && readErr != io.EOF && readErr != io.ErrUnexpectedEOF {
+			abandon()
+			return readErr
+		}
+		if n > 0 {
+			hash.Write(chunk[:n])
+			if err := c.sendChunk(ctx, session.ID, offset, chunk[:n]); err != nil {
+				// Otherwise keep the session to resume: it may have failed
+				// because the server is unreachable
+				var status *statusError
+				if errors.As(err, &status) && status.status == http.StatusNotFound {
+					c.forgetUpload(kind, name, platform, size)
+				}
+				return err
+			}
+			offset += int64(n)
+		}
+		if readErr != nil {
+			break
+		}
+	}
+
+	digest := "sha256:" + hex.EncodeToString(hash.Sum(nil))
+	var sig *sign.Signature
+	if signer != nil {
+		sig = signer(digest)
+	}
+	err = c.finishUpload(ctx, session, digest, sig, opts)
+	var status *statusError
+	switch {
+	case err == nil:
+		c.forgetUpload(kind, name, platform, size)
+	case errors.As(err, &status) && status.status == http.StatusUnprocessableEntity:
+		// The content is not what it should be, or changed since an
+		// earlier run sent part of it: resuming would fail the same way
+		abandon()
+		if resumed {
+			err = fmt.Errorf("%w (the upload resumed an earlier run that is now dropped; run it again to start over)", err)
+		}
+	case errors.As(err, &status) && status.status == http.StatusNotFound:
+		c.forgetUpload(kind, name, platform, size)
+	}
+	return err
+}
+
+func (c *Client) logf(format string, args ...interface{}) {
+	if c.Logf != nil {
+		c.Logf(format, args...)
+	}
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExtractOntoFileFails(t *testing.T) {
+	baseURL, store := testServer(t)
+	if err := store.SaveFile("site", strings.NewReader("a file")); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	tw.WriteHeader(&tar.Header{Name: "index.html", Mode: 0644, Size: 6})
+	tw.Write([]byte("<html>"))
+	tw.Close()
+	gz.Close()
+	archive := filepath.Join(t.TempDir(), "site.tar.gz")
+	if err := os.WriteFile(archive, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var logs int
+	c := NewClient(baseURL, "test-token")
+	c.UploadStateDir = t.TempDir()
+	c.Logf = func(format string, args ...interface{}) { logs++ }
+
+	err := c.UploadArchiveExtract(archive, "site", false)
+	if err == nil {
+		t.Fatal("extraction onto a file succeeded")
+	}
+	if !strings.Contains(err.Error(), "extraction target is a file") {
+		t.Fatalf("extraction onto a file failed with %q", err)
+	}
+	if logs != 0 {
+		t.Fatalf("the client retried a final answer %d times", logs)
+	}
+
+	// Once the file is out of the way the same push finishes the session
+	if err := store.DeleteFile("site"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.UploadArchiveExtract(archive, "site", false); err != nil {
+		t.Fatalf("extraction after moving the file away: %v", err)
+	}
+	if logs != 1 {
+		t.Fatalf("the second push did not resume the session, logged %d notices", logs)
+	}
+}
@@ -1,12 +1,85 @@
 package auth
 
 import (
+	"context"
+	"encoding/json"
+	"fmt"
 	"net/http"
+	"os"
 	"strings"
 )
 
-// AuthMiddleware validates bearer token from Authorization header
-func AuthMiddleware(token string) func(http.Handler) http.Handler {
+// AdminName identifies callers using the master token.
+const AdminName = "admin"
+
+// Token is an additional API token limited to some namespaces.
+type Token struct {
+	Name       string   `json:"name"`
+	Token      string   `json:"token"`
+	Namespaces []string `json:"namespaces"`
+}
+
+// Identity is the authenticated caller of a request.
+type Identity struct {
+	Name string
+	// Namespaces the caller may use; nil means every namespace.
+	Namespaces []string
+}
+
+// Allows reports whether the caller may read and write namespace. Scoped
+// tokens never reach the default ("") namespace.
+func (id *Identity) Allows(namespace string) bool {
+	if id == nil {
+		return false
+	}
+	if id.Namespaces == nil {
+		return true
+	}
+	for _, allowed := range id.Namespaces {
+		if allowed == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+type contextKey struct{}
+
+// FromContext returns the identity AuthMiddleware attached to the request.
+func FromContext(ctx context.Context) *Identity {
+	id, _ := ctx.Value(contextKey{}).(*Identity)
+	return id
+}
+
+// LoadTokens reads scoped tokens from a JSON file:
+// {"tokens": [{"name": "ci-prod", "token": "...", "namespaces": ["prod"]}]}
+func LoadTokens(path string) ([]Token, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read tokens: %w", err)
+	}
+
+	var file struct {
+		Tokens []Token `json:"tokens"`
+	}
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("parse tokens: %w", err)
+	}
+
+	for _, token := range file.Tokens {
+		if token.Name == "" || token.Token == "" {
+			return nil, fmt.Errorf("tokens need a name and a token")
+		}
+		if len(token.Namespaces) == 0 {
+			return nil, fmt.Errorf("token %s has no namespaces", token.Name)
+		}
+	}
+	return file.Tokens, nil
+}
+
+// AuthMiddleware validates bearer token from Authorization header. The
+// master token grants every namespace, scoped tokens only their own.
+func AuthMiddleware(token string, scoped ...Token) func(http.Handler) http.Handler {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			authHeader := r.Header.Get("Authorization")
@@ -21,12 +94,21 @@ func AuthMiddleware(token string) func(http.Handler) http.Handler {
 				return
 			}
 
-			if parts[1] != token {
+			var id *Identity
+			if parts[1] == token {
+				id = &Identity{Name: AdminName}
+			}
+			for _, t := range scoped {
+				if parts[1] == t.Token {
+					id = &Identity{Name: t.Name, Namespaces: t.Namespaces}
+				}
+			}
+			if id == nil {
 				http.Error(w, "Invalid token", http.StatusUnauthorized)
 				return
 			}
 
-			next.ServeHTTP(w, r)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), contextKey{}, id)))
 		})
 	}
-}
\ No newline at end of file
+}
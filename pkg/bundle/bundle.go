@@ -0,0 +1,219 @@
+package bundle
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/dollarkillerx/unregistry/pkg/sign"
+)
+
+// ManifestName is the first entry of every bundle.
+const ManifestName = "bundle.json"
+
+const (
+	KindImage = "image"
+	KindFile  = "file"
+)
+
+// Entry is an image build or a file carried by a bundle.
+type Entry struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Platform string `json:"platform,omitempty"`
+	// Path is where the content is stored inside the bundle.
+	Path      string          `json:"path"`
+	Digest    string          `json:"digest"`
+	Size      int64           `json:"size"`
+	Signature *sign.Signature `json:"signature,omitempty"`
+}
+
+// Manifest describes the content of a bundle. Every entry is checked
+// against its digest when the bundle is written and read.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Entries []Entry   `json:"entries"`
+}
+
+// EntryPath returns the path an entry is stored under inside a bundle.
+func EntryPath(kind, name, platform string) string {
+	if platform != "" {
+		name += "@" + strings.ReplaceAll(platform, "/", "_")
+	}
+	return path.Join(kind+"s", name)
+}
+
+// Writer writes a bundle as a tar stream: the manifest followed by the
+// content of its entries, in order.
+type Writer struct {
+	tw      *tar.Writer
+	entries []Entry
+}
+
+func NewWriter(w io.Writer, manifest *Manifest) (*Writer, error) {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	tw := tar.NewWriter(w)
+	err = tw.WriteHeader(&tar.Header{
+		Name:    ManifestName,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: manifest.Created,
+	})
+	if err == nil {
+		_, err = tw.Write(data)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("write manifest: %w", err)
+	}
+
+	return &Writer{tw: tw, entries: manifest.Entries}, nil
+}
+
+// Add writes the content of the next manifest entry, failing if it does not
+// match the size and digest recorded in the manifest.
+func (w *Writer) Add(r io.Reader) error {
+	if len(w.entries) == 0 {
+		return errors.New("all manifest entries are written")
+	}
+	entry := w.entries[0]
+	w.entries = w.entries[1:]
+
+	err := w.tw.WriteHeader(&tar.Header{
+		Name:    entry.Path,
+		Mode:    0644,
+		Size:    entry.Size,
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return fmt.Errorf("write %s: %w", entry.Path, err)
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(w.tw, io.TeeReader(io.LimitReader(r, entry.Size), hash))
+	if err != nil {
+		return fmt.Errorf("write %s: %w", entry.Path, err)
+	}
+	if n != entry.Size {
+		return fmt.Errorf("%s %s: got %d bytes, expected %d", entry.Kind, entry.Name, n, entry.Size)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != entry.Digest {
+		return fmt.Errorf("%s %s: digest %s, expected %s", entry.Kind, entry.Name, digest, entry.Digest)
+	}
+	return nil
+}
+
+// Close finishes the bundle. Every manifest entry must have been added.
+func (w *Writer) Close() error {
+	if len(w.entries) > 0 {
+		return fmt.Errorf("%d manifest entries were not written", len(w.entries))
+	}
+	return w.tw.Close()
+}
+
+// Reader reads the entries of a bundle in manifest order.
+type Reader struct {
+	Manifest *Manifest
+
+	tr   *tar.Reader
+	next int
+}
+
+func NewReader(r io.Reader) (*Reader, error) {
+	tr := tar.NewReader(r)
+
+	hdr, err := tr.Next()
+	if err != nil {
+		return nil, fmt.Errorf("read bundle: %w", err)
+	}
+	if hdr.Name != ManifestName {
+		return nil, fmt.Errorf("not a bundle: first entry is %s, expected %s", hdr.Name, ManifestName)
+	}
+
+	manifest := &Manifest{}
+	if err := json.NewDecoder(tr).Decode(manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	if manifest.Version != 1 {
+		return nil, fmt.Errorf("unsupported bundle version %d", manifest.Version)
+	}
+
+	return &Reader{Manifest: manifest, tr: tr}, nil
+}
+
+// Next returns the next entry and its content. The content reader fails
+// at the end of the entry if the content does not match the manifest.
+// Next returns io.EOF after the last entry.
+func (r *Reader) Next() (*Entry, io.Reader, error) {
+	if r.next == len(r.Manifest.Entries) {
+		return nil, nil, io.EOF
+	}
+	entry := &r.Manifest.Entries[r.next]
+	r.next++
+
+	hdr, err := r.tr.Next()
+	if err == io.EOF {
+		return nil, nil, fmt.Errorf("bundle is truncated: %s %s is missing", entry.Kind, entry.Name)
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("read bundle: %w", err)
+	}
+	if hdr.Name != entry.Path {
+		return nil, nil, fmt.Errorf("bundle entry %s, expected %s", hdr.Name, entry.Path)
+	}
+	if hdr.Size != entry.Size {
+		return nil, nil, fmt.Errorf("%s %s: %d bytes, expected %d", entry.Kind, entry.Name, hdr.Size, entry.Size)
+	}
+
+	return entry, &verifyingReader{r: r.tr, entry: entry, hash: sha256.New()}, nil
+}
+
+// Verify reads a whole bundle and checks every entry against the manifest.
+func Verify(r io.Reader) (*Manifest, error) {
+	br, err := NewReader(r)
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		_, content, err := br.Next()
+		if err == io.EOF {
+			return br.Manifest, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if _, err := io.Copy(io.Discard, content); err != nil {
+			return nil, err
+		}
+	}
+}
+
+type verifyingReader struct {
+	r     io.Reader
+	entry *Entry
+	hash  hash.Hash
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hash.Write(p[:n])
+	if err == io.EOF {
+		if digest := "sha256:" + hex.EncodeToString(v.hash.Sum(nil)); digest != v.entry.Digest {
+			return n, fmt.Errorf("%s %s: digest %s, expected %s", v.entry.Kind, v.entry.Name, digest, v.entry.Digest)
+		}
+	}
+	return n, err
+}
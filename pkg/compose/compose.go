@@ -0,0 +1,76 @@
+package compose
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Service is the part of a compose service this package reads.
+type Service struct {
+	Image string      `yaml:"image"`
+	Build interface{} `yaml:"build"`
+}
+
+type File struct {
+	Services map[string]Service `yaml:"services"`
+}
+
+// Load parses a compose file, substituting ${VAR}, ${VAR:-default} and
+// ${VAR-default} from the environment like docker compose does.
+func Load(path string) (*File, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read compose file: %w", err)
+	}
+
+	file := &File{}
+	if err := yaml.Unmarshal([]byte(interpolate(string(data))), file); err != nil {
+		return nil, fmt.Errorf("parse compose file: %w", err)
+	}
+	if len(file.Services) == 0 {
+		return nil, fmt.Errorf("%s defines no services", path)
+	}
+	return file, nil
+}
+
+// Images returns the distinct images referenced by the services, sorted.
+// Services that are only built locally (build without image) are skipped.
+func (f *File) Images() []string {
+	seen := make(map[string]bool)
+	var images []string
+	for _, service := range f.Services {
+		if service.Image == "" || seen[service.Image] {
+			continue
+		}
+		seen[service.Image] = true
+		images = append(images, service.Image)
+	}
+	sort.Strings(images)
+	return images
+}
+
+func interpolate(s string) string {
+	return os.Expand(s, func(name string) string {
+		if name == "$" {
+			// "$$" is an escaped dollar sign
+			return "$"
+		}
+		if key, def, ok := strings.Cut(name, ":-"); ok {
+			if value := os.Getenv(key); value != "" {
+				return value
+			}
+			return def
+		}
+		if key, def, ok := strings.Cut(name, "-"); ok {
+			if value, set := os.LookupEnv(key); set {
+				return value
+			}
+			return def
+		}
+		return os.Getenv(name)
+	})
+}
@@ -10,6 +10,11 @@ import (
 type Config struct {
 	Token   string `json:"token"`
 	BaseURL string `json:"base_url"`
+	// Runtime is the container runtime used by img push/pull
+	// (docker, podman, nerdctl or file); RuntimeDir is the tarball
+	// directory of the file runtime.
+	Runtime    string `json:"runtime,omitempty"`
+	RuntimeDir string `json:"runtime_dir,omitempty"`
 }
 
 func GetConfigPath() (string, error) {
@@ -26,6 +31,16 @@ func GetConfigPath() (string, error) {
 	return filepath.Join(configDir, "config.json"), nil
 }
 
+// GetUploadStateDir returns where unfinished uploads are recorded so a
+// later run can resume them, next to the config file.
+func GetUploadStateDir() (string, error) {
+	configPath, err := GetConfigPath()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(configPath), "uploads"), nil
+}
+
 func LoadConfig() (*Config, error) {
 	configPath, err := GetConfigPath()
 	if err != nil {
@@ -70,4 +85,4 @@ func (c *Config) Save() error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
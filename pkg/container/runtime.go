@@ -0,0 +1,140 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// ImageRuntime moves images between a local container runtime and
+// docker-save tar archives.
+type ImageRuntime interface {
+	Name() string
+	// Save writes the image as a docker-save tar archive to w.
+	Save(ctx context.Context, image string, w io.Writer) error
+	// Load imports the tar archive read from r as image.
+	Load(ctx context.Context, image string, r io.Reader) error
+}
+
+// New returns the runtime called name: docker, podman, nerdctl or file.
+// dir is only used by the file runtime and defaults to the current directory.
+func New(name, dir string) (ImageRuntime, error) {
+	switch name {
+	case "", "docker":
+		return &CLI{Binary: "docker"}, nil
+	case "podman", "nerdctl":
+		return &CLI{Binary: name}, nil
+	case "file":
+		if dir == "" {
+			dir = "."
+		}
+		return &File{Dir: dir}, nil
+	default:
+		return nil, fmt.Errorf("unknown runtime %q (want docker, podman, nerdctl or file)", name)
+	}
+}
+
+// CLI drives a docker compatible command line tool through its save and
+// load subcommands.
+type CLI struct {
+	Binary string
+}
+
+func (c *CLI) Name() string {
+	return c.Binary
+}
+
+func (c *CLI) Save(ctx context.Context, image string, w io.Writer) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Binary, "save", image)
+	cmd.Stdout = w
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return commandError(c.Binary+" save", err, &stderr)
+	}
+	return nil
+}
+
+func (c *CLI) Load(ctx context.Context, image string, r io.Reader) error {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, c.Binary, "load")
+	cmd.Stdin = r
+	cmd.Stdout = io.Discard
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		return commandError(c.Binary+" load", err, &stderr)
+	}
+	return nil
+}
+
+func commandError(command string, err error, stderr *bytes.Buffer) error {
+	if msg := strings.TrimSpace(stderr.String()); msg != "" {
+		return fmt.Errorf("%s: %w: %s", command, err, msg)
+	}
+	return fmt.Errorf("%s: %w", command, err)
+}
+
+// File keeps images as plain tarballs in Dir, named after the image
+// (e.g. "library_nginx:latest.tar"). It needs no daemon.
+type File struct {
+	Dir string
+}
+
+func (f *File) Name() string {
+	return "file"
+}
+
+func (f *File) path(image string) string {
+	return filepath.Join(f.Dir, strings.ReplaceAll(image, "/", "_")+".tar")
+}
+
+func (f *File) Save(ctx context.Context, image string, w io.Writer) error {
+	file, err := os.Open(f.path(image))
+	if err != nil {
+		return fmt.Errorf("open image tarball: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := io.Copy(w, file); err != nil {
+		return fmt.Errorf("read image tarball: %w", err)
+	}
+	return nil
+}
+
+// Load writes the tarball next to its final name and renames it into
+// place once complete, so a failed or interrupted stream never leaves a
+// truncated tarball that looks like an image.
+func (f *File) Load(ctx context.Context, image string, r io.Reader) error {
+	target := f.path(image)
+	file, err := os.CreateTemp(filepath.Dir(target), filepath.Base(target)+".*.part")
+	if err != nil {
+		return fmt.Errorf("create image tarball: %w", err)
+	}
+	defer os.Remove(file.Name())
+	defer file.Close()
+
+	// CreateTemp makes the file private; tarballs are as readable as before
+	if err := file.Chmod(0644); err != nil {
+		return fmt.Errorf("create image tarball: %w", err)
+	}
+	if _, err := io.Copy(file, r); err != nil {
+		return fmt.Errorf("write image tarball: %w", err)
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("write image tarball: %w", err)
+	}
+	if err := os.Rename(file.Name(), target); err != nil {
+		return fmt.Errorf("write image tarball: %w", err)
+	}
+	return nil
+}
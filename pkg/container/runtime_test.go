@@ -0,0 +1,87 @@
+package container
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileSaveLoad(t *testing.T) {
+	rt := &File{Dir: t.TempDir()}
+	ctx := context.Background()
+
+	if err := rt.Load(ctx, "library/nginx:latest", bytes.NewReader([]byte("tarball"))); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(rt.Dir, "library_nginx:latest.tar")); err != nil {
+		t.Fatalf("tarball not stored under its image name: %v", err)
+	}
+
+	var saved bytes.Buffer
+	if err := rt.Save(ctx, "library/nginx:latest", &saved); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if saved.String() != "tarball" {
+		t.Fatalf("Save returned %q, want %q", saved.String(), "tarball")
+	}
+}
+
+// failingReader returns data and then fails, like a save stream that dies
+// part way.
+type failingReader struct {
+	data []byte
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, errors.New("stream broke")
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestFileLoadFailureKeepsPrevious(t *testing.T) {
+	rt := &File{Dir: t.TempDir()}
+	ctx := context.Background()
+
+	if err := rt.Load(ctx, "app:1", bytes.NewReader([]byte("complete"))); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	if err := rt.Load(ctx, "app:1", &failingReader{data: []byte("trunc")}); err == nil {
+		t.Fatal("Load of a broken stream succeeded")
+	}
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := rt.Load(cancelled, "app:1", bytes.NewReader([]byte("late"))); err == nil {
+		t.Fatal("Load with a cancelled context succeeded")
+	}
+
+	data, err := os.ReadFile(filepath.Join(rt.Dir, "app:1.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "complete" {
+		t.Fatalf("tarball is %q after failed loads, want the previous one", data)
+	}
+
+	entries, err := os.ReadDir(rt.Dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("failed loads left %d files behind", len(entries)-1)
+	}
+}
+
+func TestFileSaveMissing(t *testing.T) {
+	rt := &File{Dir: t.TempDir()}
+	if err := rt.Save(context.Background(), "missing:1", io.Discard); err == nil {
+		t.Fatal("Save of a missing image succeeded")
+	}
+}
@@ -0,0 +1,386 @@
+package imgarchive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Manifests, indexes and configs are small JSON documents that are parsed
+// after an archive is scanned. Read keeps those up to maxKeep in memory,
+// and no more than maxKeepTotal for the whole archive, so many entries or
+// many concurrent uploads cannot pile up memory. Layers are never kept.
+const (
+	maxKeep      = 4 << 20
+	maxKeepTotal = 8 << 20
+)
+
+// ManifestEntry is one image in a docker-save manifest.json.
+type ManifestEntry struct {
+	Config   string   `json:"Config"`
+	RepoTags []string `json:"RepoTags"`
+	Layers   []string `json:"Layers"`
+}
+
+// Config is the part of an image config this package reads.
+type Config struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+	Config       struct {
+		Env          []string            `json:"Env"`
+		Entrypoint   []string            `json:"Entrypoint"`
+		Cmd          []string            `json:"Cmd"`
+		WorkingDir   string              `json:"WorkingDir"`
+		User         string              `json:"User"`
+		Labels       map[string]string   `json:"Labels"`
+		ExposedPorts map[string]struct{} `json:"ExposedPorts"`
+	} `json:"config"`
+	RootFS struct {
+		Type    string   `json:"type"`
+		DiffIDs []string `json:"diff_ids"`
+	} `json:"rootfs"`
+}
+
+// File is a regular file found in an archive.
+type File struct {
+	Size int64
+	// Digest is the sha256 of the file as stored.
+	Digest string
+	// DiffID is the sha256 of the decompressed file. It equals Digest for
+	// uncompressed files and is empty when the compression is not gzip.
+	DiffID     string
+	Compressed bool
+	// Err records a gzip stream that could not be decompressed.
+	Err error
+
+	// path is where the content lives, relative to the extraction
+	// directory; symlinked entries share the File of their target.
+	path string
+	data []byte
+}
+
+// Archive describes the contents of a docker-save tar archive.
+type Archive struct {
+	Manifest []ManifestEntry
+	Index    *Index
+	Files    map[string]*File
+
+	// dir is where ReadTo extracted the files
+	dir string
+	// kept is how much file content Read holds in memory
+	kept int64
+}
+
+// Read scans a docker-save tar stream in a single pass, hashing every file.
+func Read(r io.Reader) (*Archive, error) {
+	return ReadTo(r, "")
+}
+
+// ReadTo is Read that also extracts the regular files below dir.
+func ReadTo(r io.Reader, dir string) (*Archive, error) {
+	a := &Archive{Files: make(map[string]*File), dir: dir}
+	links := make(map[string]string)
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %w", err)
+		}
+
+		name := path.Clean(strings.TrimPrefix(hdr.Name, "./"))
+		if !filepath.IsLocal(name) {
+			return nil, fmt.Errorf("archive entry %q escapes the archive", hdr.Name)
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			// Extracted files are read back from disk instead
+			keep := dir == "" && metadataName(name) && hdr.Size <= maxKeep && a.kept+hdr.Size <= maxKeepTotal
+			f, err := readEntry(tr, hdr.Size, dir, name, keep)
+			if err != nil {
+				return nil, fmt.Errorf("read %s: %w", name, err)
+			}
+			a.Files[name] = f
+			a.kept += int64(len(f.data))
+		case tar.TypeSymlink, tar.TypeLink:
+			// docker save links layers shared between images
+			target := hdr.Linkname
+			if hdr.Typeflag == tar.TypeSymlink {
+				target = path.Join(path.Dir(name), target)
+			}
+			links[name] = path.Clean(strings.TrimPrefix(target, "./"))
+		}
+	}
+
+	for name, target := range links {
+		f, ok := a.Files[target]
+		if !ok {
+			return nil, fmt.Errorf("archive entry %s links to missing %s", name, target)
+		}
+		a.Files[name] = f
+	}
+
+	if _, ok := a.Files["manifest.json"]; ok {
+		data, err := a.Data("manifest.json")
+		if err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &a.Manifest); err != nil {
+			return nil, fmt.Errorf("parse manifest.json: %w", err)
+		}
+		if a.Manifest == nil {
+			a.Manifest = []ManifestEntry{}
+		}
+	}
+	if _, ok := a.Files["index.json"]; ok {
+		if data, err := a.Data("index.json"); err == nil {
+			a.Index = &Index{}
+			if err := json.Unmarshal(data, a.Index); err != nil {
+				return nil, fmt.Errorf("parse index.json: %w", err)
+			}
+		}
+	}
+
+	return a, nil
+}
+
+// metadataName reports whether an entry may be a manifest, index or config:
+// legacy configs are "<hex>.json", OCI ones are blobs like the layers.
+func metadataName(name string) bool {
+	return strings.HasSuffix(name, ".json") || strings.HasPrefix(name, "blobs/")
+}
+
+// readEntry hashes one file of the archive, extracting it below dir when
+// set. keep holds the content in memory if it turns out to be JSON.
+func readEntry(r io.Reader, size int64, dir, name string, keep bool) (*File, error) {
+	f := &File{path: name}
+
+	digest := sha256.New()
+	writers := []io.Writer{digest}
+
+	if dir != "" {
+		target := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return nil, err
+		}
+		out, err := os.Create(target)
+		if err != nil {
+			return nil, err
+		}
+		defer out.Close()
+		writers = append(writers, out)
+	}
+
+	br := bufio.NewReaderSize(r, 64<<10)
+	magic, _ := br.Peek(4)
+
+	var kept *bytes.Buffer
+	if keep && len(magic) > 0 && (magic[0] == '{' || magic[0] == '[') {
+		kept = &bytes.Buffer{}
+		writers = append(writers, kept)
+	}
+
+	// Hash the decompressed stream alongside, so layer diff IDs can be
+	// checked without a second pass
+	var diff hash.Hash
+	var pw *io.PipeWriter
+	var done chan error
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		f.Compressed = true
+		diff = sha256.New()
+		var pr *io.PipeReader
+		pr, pw = io.Pipe()
+		done = make(chan error, 1)
+		go func() {
+			zr, err := gzip.NewReader(pr)
+			if err == nil {
+				_, err = io.Copy(diff, zr)
+			}
+			io.Copy(io.Discard, pr)
+			done <- err
+		}()
+		writers = append(writers, pw)
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		// zstd: stored as is, diff ID unknown
+		f.Compressed = true
+	}
+
+	n, err := io.Copy(io.MultiWriter(writers...), br)
+	if pw != nil {
+		pw.CloseWithError(err)
+		if gzErr := <-done; gzErr != nil && err == nil {
+			f.Err = fmt.Errorf("corrupt gzip stream: %w", gzErr)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	f.Size = n
+	f.Digest = "sha256:" + hex.EncodeToString(digest.Sum(nil))
+	switch {
+	case diff != nil && f.Err == nil:
+		f.DiffID = "sha256:" + hex.EncodeToString(diff.Sum(nil))
+	case !f.Compressed:
+		f.DiffID = f.Digest
+	}
+	if kept != nil {
+		f.data = kept.Bytes()
+	}
+	return f, nil
+}
+
+// ValidateStream checks a gzipped docker-save archive as it streams by: the
+// gzip framing and checksum, and everything Validate checks.
+func ValidateStream(r io.Reader) error {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("not a gzip stream: %w", err)
+	}
+
+	a, err := Read(zr)
+	if err != nil {
+		return err
+	}
+	// The tar end marker may leave padding and the gzip trailer unread
+	if _, err := io.Copy(io.Discard, zr); err != nil {
+		return fmt.Errorf("corrupt gzip stream: %w", err)
+	}
+	return a.Validate()
+}
+
+// Data returns the content of a small JSON file, kept in memory by Read or
+// extracted by ReadTo.
+func (a *Archive) Data(name string) ([]byte, error) {
+	f, ok := a.Files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is missing from the archive", name)
+	}
+	if f.Size > maxKeep {
+		return nil, fmt.Errorf("%s is too large", name)
+	}
+	if a.dir != "" {
+		return os.ReadFile(filepath.Join(a.dir, filepath.FromSlash(f.path)))
+	}
+	if f.data == nil {
+		return nil, fmt.Errorf("%s is not JSON or the archive holds too much metadata", name)
+	}
+	return f.data, nil
+}
+
+// Open returns the content of a file, either extracted by ReadTo or kept
+// in memory by Read.
+func (a *Archive) Open(name string) (io.ReadCloser, error) {
+	f, ok := a.Files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is missing from the archive", name)
+	}
+	if a.dir != "" {
+		return os.Open(filepath.Join(a.dir, filepath.FromSlash(f.path)))
+	}
+	if f.data == nil {
+		return nil, fmt.Errorf("%s was not kept in memory", name)
+	}
+	return io.NopCloser(bytes.NewReader(f.data)), nil
+}
+
+// Config parses the image config stored at name.
+func (a *Archive) Config(name string) (*Config, error) {
+	data, err := a.Data(name)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s: %w", name, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that the archive is a loadable image: manifest.json
+// lists at least one image, every config and layer it references is
+// present, and every digest that can be checked matches.
+func (a *Archive) Validate() error {
+	if a.Manifest == nil {
+		return errors.New("archive has no manifest.json")
+	}
+	if len(a.Manifest) == 0 {
+		return errors.New("manifest.json lists no images")
+	}
+
+	for i, entry := range a.Manifest {
+		if entry.Config == "" {
+			return fmt.Errorf("image %d: manifest.json has no config", i)
+		}
+		cfgFile, ok := a.Files[entry.Config]
+		if !ok {
+			return fmt.Errorf("image %d: config %s is missing", i, entry.Config)
+		}
+		if err := checkBlobName(entry.Config, cfgFile); err != nil {
+			return fmt.Errorf("image %d: %w", i, err)
+		}
+
+		cfg, err := a.Config(entry.Config)
+		if err != nil {
+			return fmt.Errorf("image %d: %w", i, err)
+		}
+		if len(cfg.RootFS.DiffIDs) != len(entry.Layers) {
+			return fmt.Errorf("image %d: manifest lists %d layers, config lists %d", i, len(entry.Layers), len(cfg.RootFS.DiffIDs))
+		}
+
+		for j, layer := range entry.Layers {
+			f, ok := a.Files[layer]
+			if !ok {
+				return fmt.Errorf("image %d: layer %s is missing", i, layer)
+			}
+			if f.Err != nil {
+				return fmt.Errorf("image %d: layer %s: %w", i, layer, f.Err)
+			}
+			if err := checkBlobName(layer, f); err != nil {
+				return fmt.Errorf("image %d: %w", i, err)
+			}
+			if f.DiffID != "" && f.DiffID != cfg.RootFS.DiffIDs[j] {
+				return fmt.Errorf("image %d: layer %s has digest %s, config expects %s", i, layer, f.DiffID, cfg.RootFS.DiffIDs[j])
+			}
+		}
+	}
+	return nil
+}
+
+// checkBlobName verifies files whose name is their digest: OCI style
+// "blobs/sha256/<hex>" and legacy "<hex>.json" configs.
+func checkBlobName(name string, f *File) error {
+	var want string
+	switch {
+	case strings.HasPrefix(name, "blobs/sha256/"):
+		want = strings.TrimPrefix(name, "blobs/sha256/")
+	case len(name) == 64+len(".json") && strings.HasSuffix(name, ".json"):
+		want = strings.TrimSuffix(name, ".json")
+	default:
+		return nil
+	}
+
+	if f.Digest != "sha256:"+want {
+		return fmt.Errorf("%s has digest %s", name, f.Digest)
+	}
+	return nil
+}
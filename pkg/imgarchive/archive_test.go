@@ -0,0 +1,127 @@
+package imgarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+type tarEntry struct {
+	name string
+	data []byte
+}
+
+func writeTar(t *testing.T, entries []tarEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, entry := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: entry.name, Mode: 0644, Size: int64(len(entry.data))}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(entry.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testImage returns the entries of a docker-save archive with one layer,
+// with extra entries placed before manifest.json.
+func testImage(t *testing.T, extra ...tarEntry) []tarEntry {
+	t.Helper()
+
+	layer := writeTar(t, []tarEntry{{"hello.txt", []byte("hello\n")}})
+	diffID := sha256.Sum256(layer)
+	config, _ := json.Marshal(map[string]interface{}{
+		"os":     "linux",
+		"rootfs": map[string]interface{}{"type": "layers", "diff_ids": []string{"sha256:" + hex.EncodeToString(diffID[:])}},
+	})
+	configSum := sha256.Sum256(config)
+	configName := hex.EncodeToString(configSum[:]) + ".json"
+	manifest, _ := json.Marshal([]ManifestEntry{{Config: configName, Layers: []string{"layer/layer.tar"}}})
+
+	entries := []tarEntry{{configName, config}, {"layer/layer.tar", layer}}
+	entries = append(entries, extra...)
+	return append(entries, tarEntry{"manifest.json", manifest})
+}
+
+func TestReadKeepsOnlyMetadata(t *testing.T) {
+	a, err := Read(bytes.NewReader(writeTar(t, testImage(t))))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if err := a.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+
+	if a.Files["layer/layer.tar"].data != nil {
+		t.Error("layer kept in memory")
+	}
+	if a.Files["manifest.json"].data == nil || a.Files[a.Manifest[0].Config].data == nil {
+		t.Error("manifest or config not kept in memory")
+	}
+}
+
+func TestReadBoundsMemory(t *testing.T) {
+	// JSON entries up to the per-file limit, more of them than the archive
+	// may keep in total
+	var extra []tarEntry
+	padding := bytes.Repeat([]byte(" "), maxKeep-2)
+	for i := 0; i < 2*maxKeepTotal/maxKeep+1; i++ {
+		extra = append(extra, tarEntry{fmt.Sprintf("extra/%d.json", i), append(append([]byte("{"), padding...), '}')})
+	}
+
+	a, err := Read(bytes.NewReader(writeTar(t, testImage(t, extra...))))
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	if a.kept > maxKeepTotal {
+		t.Fatalf("kept %d bytes in memory, limit is %d", a.kept, maxKeepTotal)
+	}
+	dropped := 0
+	for _, entry := range extra {
+		if a.Files[entry.name].data == nil {
+			dropped++
+		}
+	}
+	if dropped == 0 {
+		t.Fatal("every JSON entry was kept in memory")
+	}
+}
+
+func TestReadToKeepsNothing(t *testing.T) {
+	a, err := ReadTo(bytes.NewReader(writeTar(t, testImage(t))), t.TempDir())
+	if err != nil {
+		t.Fatalf("ReadTo: %v", err)
+	}
+	if a.kept != 0 {
+		t.Fatalf("ReadTo kept %d bytes in memory", a.kept)
+	}
+	if err := a.Validate(); err != nil {
+		t.Fatalf("Validate: %v", err)
+	}
+}
+
+func TestValidateStream(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(writeTar(t, testImage(t)))
+	gz.Close()
+
+	if err := ValidateStream(&buf); err != nil {
+		t.Fatalf("ValidateStream: %v", err)
+	}
+	if err := ValidateStream(bytes.NewReader([]byte("not an image"))); err == nil {
+		t.Fatal("ValidateStream accepted garbage")
+	}
+}
@@ -0,0 +1,312 @@
+package imgarchive
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Whiteout markers in layer tars (see the OCI image spec)
+const (
+	whiteoutPrefix = ".wh."
+	whiteoutOpaque = ".wh..wh..opq"
+)
+
+// Entry is a path in an image's flattened filesystem.
+type Entry struct {
+	Mode     int64  `json:"mode"`
+	Size     int64  `json:"size"`
+	Digest   string `json:"digest,omitempty"`
+	Linkname string `json:"linkname,omitempty"`
+	Type     byte   `json:"type"`
+}
+
+// Snapshot is what an image diff compares: the config, the layer diff IDs
+// and the filesystem left after applying every layer.
+type Snapshot struct {
+	Config *Config
+	Layers []string
+	Files  map[string]Entry
+}
+
+// LoadSnapshot reads a gzipped docker-save archive, extracting it below dir
+// so its layers can be replayed in order.
+func LoadSnapshot(r io.Reader, dir string) (*Snapshot, error) {
+	zr, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("decompress image: %w", err)
+	}
+	defer zr.Close()
+
+	a, err := ReadTo(zr, dir)
+	if err != nil {
+		return nil, err
+	}
+	if err := a.Validate(); err != nil {
+		return nil, err
+	}
+
+	entry := a.Manifest[0]
+	cfg, err := a.Config(entry.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	snap := &Snapshot{
+		Config: cfg,
+		Layers: cfg.RootFS.DiffIDs,
+		Files:  make(map[string]Entry),
+	}
+	for _, layer := range entry.Layers {
+		if err := snap.apply(filepath.Join(dir, filepath.FromSlash(a.Files[layer].path))); err != nil {
+			return nil, fmt.Errorf("layer %s: %w", layer, err)
+		}
+	}
+	return snap, nil
+}
+
+// apply replays one layer tar on top of the filesystem.
+func (s *Snapshot) apply(layerPath string) error {
+	file, err := os.Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	br := bufio.NewReader(file)
+	var r io.Reader = br
+	magic, _ := br.Peek(4)
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	case bytes.HasPrefix(magic, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return errors.New("zstd layers are not supported")
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		name := path.Clean("/" + strings.TrimPrefix(hdr.Name, "./"))
+		dir, base := path.Split(name)
+
+		switch {
+		case base == whiteoutOpaque:
+			s.removeBelow(path.Clean(dir))
+			continue
+		case strings.HasPrefix(base, whiteoutPrefix):
+			s.remove(path.Join(dir, strings.TrimPrefix(base, whiteoutPrefix)))
+			continue
+		}
+
+		entry := Entry{
+			Mode:     hdr.Mode & 07777,
+			Size:     hdr.Size,
+			Linkname: hdr.Linkname,
+			Type:     hdr.Typeflag,
+		}
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			hash := sha256.New()
+			if _, err := io.Copy(hash, tr); err != nil {
+				return err
+			}
+			entry.Digest = "sha256:" + hex.EncodeToString(hash.Sum(nil))
+		case tar.TypeLink:
+			// A hard link has the content of its target
+			target := path.Clean("/" + strings.TrimPrefix(hdr.Linkname, "./"))
+			if linked, ok := s.Files[target]; ok {
+				entry.Size = linked.Size
+				entry.Digest = linked.Digest
+			}
+		}
+
+		// A non-directory replaces whatever was at its path
+		if hdr.Typeflag != tar.TypeDir {
+			s.remove(name)
+		}
+		s.Files[name] = entry
+	}
+}
+
+// remove deletes name and, when it is a directory, its contents.
+func (s *Snapshot) remove(name string) {
+	if entry, ok := s.Files[name]; ok {
+		delete(s.Files, name)
+		if entry.Type == tar.TypeDir {
+			s.removeBelow(name)
+		}
+	}
+}
+
+// removeBelow deletes everything under dir, keeping dir itself.
+func (s *Snapshot) removeBelow(dir string) {
+	prefix := strings.TrimSuffix(dir, "/") + "/"
+	for name := range s.Files {
+		if strings.HasPrefix(name, prefix) {
+			delete(s.Files, name)
+		}
+	}
+}
+
+// Change is a config field whose value differs between two images.
+type Change struct {
+	Field string `json:"field"`
+	Old   string `json:"old,omitempty"`
+	New   string `json:"new,omitempty"`
+}
+
+// Diff describes how image B differs from image A.
+type Diff struct {
+	Config        []Change `json:"config"`
+	LayersAdded   []string `json:"layers_added"`
+	LayersRemoved []string `json:"layers_removed"`
+	FilesAdded    []string `json:"files_added"`
+	FilesRemoved  []string `json:"files_removed"`
+	FilesModified []string `json:"files_modified"`
+}
+
+// Empty reports whether the images are equivalent.
+func (d *Diff) Empty() bool {
+	return len(d.Config) == 0 && len(d.LayersAdded) == 0 && len(d.LayersRemoved) == 0 &&
+		len(d.FilesAdded) == 0 && len(d.FilesRemoved) == 0 && len(d.FilesModified) == 0
+}
+
+// Compare diffs two snapshots.
+func Compare(a, b *Snapshot) *Diff {
+	d := &Diff{
+		Config:        compareConfig(a.Config, b.Config),
+		LayersAdded:   missing(b.Layers, a.Layers),
+		LayersRemoved: missing(a.Layers, b.Layers),
+		FilesAdded:    []string{},
+		FilesRemoved:  []string{},
+		FilesModified: []string{},
+	}
+
+	for name, old := range a.Files {
+		entry, ok := b.Files[name]
+		switch {
+		case !ok:
+			d.FilesRemoved = append(d.FilesRemoved, name)
+		case entry != old:
+			d.FilesModified = append(d.FilesModified, name)
+		}
+	}
+	for name := range b.Files {
+		if _, ok := a.Files[name]; !ok {
+			d.FilesAdded = append(d.FilesAdded, name)
+		}
+	}
+	sort.Strings(d.FilesAdded)
+	sort.Strings(d.FilesRemoved)
+	sort.Strings(d.FilesModified)
+
+	return d
+}
+
+// missing returns the items of list that are not in other, in order.
+func missing(list, other []string) []string {
+	seen := make(map[string]bool, len(other))
+	for _, item := range other {
+		seen[item] = true
+	}
+	result := []string{}
+	for _, item := range list {
+		if !seen[item] {
+			result = append(result, item)
+		}
+	}
+	return result
+}
+
+func compareConfig(a, b *Config) []Change {
+	changes := []Change{}
+	add := func(field, before, after string) {
+		if before != after {
+			changes = append(changes, Change{Field: field, Old: before, New: after})
+		}
+	}
+
+	add("os", a.OS, b.OS)
+	add("architecture", a.Architecture, b.Architecture)
+	add("variant", a.Variant, b.Variant)
+	add("entrypoint", jsonString(a.Config.Entrypoint), jsonString(b.Config.Entrypoint))
+	add("cmd", jsonString(a.Config.Cmd), jsonString(b.Config.Cmd))
+	add("working_dir", a.Config.WorkingDir, b.Config.WorkingDir)
+	add("user", a.Config.User, b.Config.User)
+
+	compareMaps("env", envMap(a.Config.Env), envMap(b.Config.Env), add)
+	compareMaps("labels", a.Config.Labels, b.Config.Labels, add)
+	compareMaps("exposed_ports", keySet(a.Config.ExposedPorts), keySet(b.Config.ExposedPorts), add)
+
+	return changes
+}
+
+// compareMaps reports changed keys as "field.key", in key order.
+func compareMaps(field string, a, b map[string]string, add func(field, before, after string)) {
+	keys := make(map[string]bool)
+	for key := range a {
+		keys[key] = true
+	}
+	for key := range b {
+		keys[key] = true
+	}
+
+	sorted := make([]string, 0, len(keys))
+	for key := range keys {
+		sorted = append(sorted, key)
+	}
+	sort.Strings(sorted)
+
+	for _, key := range sorted {
+		add(field+"."+key, a[key], b[key])
+	}
+}
+
+func envMap(env []string) map[string]string {
+	m := make(map[string]string, len(env))
+	for _, item := range env {
+		key, value, _ := strings.Cut(item, "=")
+		m[key] = value
+	}
+	return m
+}
+
+func keySet(set map[string]struct{}) map[string]string {
+	m := make(map[string]string, len(set))
+	for key := range set {
+		m[key] = "exposed"
+	}
+	return m
+}
+
+func jsonString(v []string) string {
+	if v == nil {
+		return ""
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
@@ -0,0 +1,480 @@
+package imgarchive
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	MediaTypeOCIIndex     = "application/vnd.oci.image.index.v1+json"
+	MediaTypeOCIManifest  = "application/vnd.oci.image.manifest.v1+json"
+	MediaTypeOCIConfig    = "application/vnd.oci.image.config.v1+json"
+	MediaTypeOCILayer     = "application/vnd.oci.image.layer.v1.tar"
+	MediaTypeOCILayerGzip = "application/vnd.oci.image.layer.v1.tar+gzip"
+	MediaTypeOCILayerZstd = "application/vnd.oci.image.layer.v1.tar+zstd"
+
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayerGzip    = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+
+	AnnotationRefName       = "org.opencontainers.image.ref.name"
+	AnnotationContainerdRef = "io.containerd.image.name"
+)
+
+type Platform struct {
+	Architecture string `json:"architecture"`
+	OS           string `json:"os"`
+	Variant      string `json:"variant,omitempty"`
+}
+
+func (p *Platform) String() string {
+	if p == nil {
+		return ""
+	}
+	if p.Variant != "" {
+		return p.OS + "/" + p.Architecture + "/" + p.Variant
+	}
+	return p.OS + "/" + p.Architecture
+}
+
+// SelectPlatform picks the manifest for platform ("os/arch[/variant]") from
+// an index. With an empty platform the index must hold a single image.
+// Attestation manifests (platform unknown/unknown) are ignored.
+func SelectPlatform(manifests []Descriptor, platform string) (Descriptor, error) {
+	var images []Descriptor
+	var available []string
+	for _, desc := range manifests {
+		if desc.Platform != nil && desc.Platform.OS == "unknown" {
+			continue
+		}
+		images = append(images, desc)
+		available = append(available, desc.Platform.String())
+	}
+
+	if platform == "" {
+		if len(images) == 1 {
+			return images[0], nil
+		}
+		return Descriptor{}, fmt.Errorf("index holds several platforms (%s), pick one", strings.Join(available, ", "))
+	}
+
+	for _, desc := range images {
+		if desc.Platform.String() == platform {
+			return desc, nil
+		}
+	}
+	// Match on os/arch alone when only one side names a variant
+	if parts := strings.SplitN(platform, "/", 3); len(parts) >= 2 {
+		for _, desc := range images {
+			if desc.Platform != nil && desc.Platform.OS == parts[0] && desc.Platform.Architecture == parts[1] {
+				return desc, nil
+			}
+		}
+	}
+	return Descriptor{}, fmt.Errorf("no %s image in index (available: %s)", platform, strings.Join(available, ", "))
+}
+
+type Descriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Platform    *Platform         `json:"platform,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type Index struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Manifests     []Descriptor `json:"manifests"`
+}
+
+type Manifest struct {
+	SchemaVersion int          `json:"schemaVersion"`
+	MediaType     string       `json:"mediaType,omitempty"`
+	Config        Descriptor   `json:"config"`
+	Layers        []Descriptor `json:"layers"`
+}
+
+type layoutFile struct {
+	ImageLayoutVersion string `json:"imageLayoutVersion"`
+}
+
+// IsIndex reports whether the media type is a multi-manifest index.
+func IsIndex(mediaType string) bool {
+	return mediaType == MediaTypeOCIIndex || mediaType == MediaTypeDockerManifestList
+}
+
+// LayerMediaType returns the OCI media type for a layer file.
+func LayerMediaType(f *File) string {
+	switch {
+	case !f.Compressed:
+		return MediaTypeOCILayer
+	case f.DiffID == "":
+		return MediaTypeOCILayerZstd
+	default:
+		return MediaTypeOCILayerGzip
+	}
+}
+
+func blobPath(digest string) (string, error) {
+	hexDigest, ok := strings.CutPrefix(digest, "sha256:")
+	if !ok || len(hexDigest) != 64 {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	if _, err := hex.DecodeString(hexDigest); err != nil {
+		return "", fmt.Errorf("unsupported digest %q", digest)
+	}
+	return path.Join("blobs", "sha256", hexDigest), nil
+}
+
+func readLayoutJSON(dir, name string, v interface{}) error {
+	data, err := os.ReadFile(filepath.Join(dir, filepath.FromSlash(name)))
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("parse %s: %w", name, err)
+	}
+	return nil
+}
+
+func readBlobJSON(dir string, desc Descriptor, v interface{}) error {
+	name, err := blobPath(desc.Digest)
+	if err != nil {
+		return err
+	}
+	return readLayoutJSON(dir, name, v)
+}
+
+// refMatches reports whether the descriptor is annotated with ref, either
+// as the full reference or as just its tag.
+func refMatches(desc Descriptor, ref string) bool {
+	if ref == "" {
+		return false
+	}
+
+	tag := ref
+	if i := strings.LastIndex(ref, ":"); i > strings.LastIndex(ref, "/") {
+		tag = ref[i+1:]
+	}
+	for _, key := range []string{AnnotationRefName, AnnotationContainerdRef} {
+		if value := desc.Annotations[key]; value == ref || value == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadOCILayout validates the OCI image layout in dir and returns the
+// manifest for ref (any single image when the layout holds only one).
+// Multi-platform images are resolved to the build for platform.
+func LoadOCILayout(dir, ref, platform string) (Descriptor, *Manifest, error) {
+	layout := &layoutFile{}
+	if err := readLayoutJSON(dir, "oci-layout", layout); err != nil {
+		return Descriptor{}, nil, fmt.Errorf("not an OCI image layout: %w", err)
+	}
+	if layout.ImageLayoutVersion == "" {
+		return Descriptor{}, nil, errors.New("oci-layout has no imageLayoutVersion")
+	}
+
+	index := &Index{}
+	if err := readLayoutJSON(dir, "index.json", index); err != nil {
+		return Descriptor{}, nil, err
+	}
+
+	var candidates []Descriptor
+	for _, desc := range index.Manifests {
+		if refMatches(desc, ref) {
+			candidates = []Descriptor{desc}
+			break
+		}
+		candidates = append(candidates, desc)
+	}
+	if len(candidates) == 0 {
+		return Descriptor{}, nil, errors.New("index.json lists no images")
+	}
+	if len(candidates) > 1 {
+		return Descriptor{}, nil, fmt.Errorf("layout holds %d images and none is tagged %q", len(candidates), ref)
+	}
+
+	desc := candidates[0]
+	if IsIndex(desc.MediaType) {
+		nested := &Index{}
+		if err := readBlobJSON(dir, desc, nested); err != nil {
+			return Descriptor{}, nil, fmt.Errorf("read index: %w", err)
+		}
+		var err error
+		if desc, err = SelectPlatform(nested.Manifests, platform); err != nil {
+			return Descriptor{}, nil, err
+		}
+	}
+
+	manifest := &Manifest{}
+	if err := readBlobJSON(dir, desc, manifest); err != nil {
+		return Descriptor{}, nil, fmt.Errorf("read manifest: %w", err)
+	}
+
+	for _, blob := range append([]Descriptor{desc, manifest.Config}, manifest.Layers...) {
+		name, err := blobPath(blob.Digest)
+		if err != nil {
+			return Descriptor{}, nil, err
+		}
+		info, err := os.Stat(filepath.Join(dir, filepath.FromSlash(name)))
+		if err != nil {
+			return Descriptor{}, nil, fmt.Errorf("blob %s is missing", blob.Digest)
+		}
+		if info.Size() != blob.Size {
+			return Descriptor{}, nil, fmt.Errorf("blob %s has size %d, expected %d", blob.Digest, info.Size(), blob.Size)
+		}
+	}
+
+	return desc, manifest, nil
+}
+
+// FromOCILayout writes the image ref from the OCI layout in dir to w as a
+// docker-save archive that also remains a valid OCI layout. Blob digests
+// are verified while they are copied.
+func FromOCILayout(dir, ref, platform string, w io.Writer) error {
+	desc, manifest, err := LoadOCILayout(dir, ref, platform)
+	if err != nil {
+		return err
+	}
+
+	return WriteArchive(w, ref, desc, manifest, func(blob Descriptor) (io.ReadCloser, error) {
+		name, err := blobPath(blob.Digest)
+		if err != nil {
+			return nil, err
+		}
+		return os.Open(filepath.Join(dir, filepath.FromSlash(name)))
+	})
+}
+
+// BlobOpener returns the content of a blob.
+type BlobOpener func(blob Descriptor) (io.ReadCloser, error)
+
+// WriteArchive writes the image described by manifest, itself stored as
+// the blob desc, to w as a docker-save archive that also is a valid OCI
+// layout. Blob digests are verified while they are copied.
+func WriteArchive(w io.Writer, ref string, desc Descriptor, manifest *Manifest, open BlobOpener) error {
+	tw := tar.NewWriter(w)
+
+	if err := writeTarFile(tw, "oci-layout", []byte(`{"imageLayoutVersion":"1.0.0"}`)); err != nil {
+		return err
+	}
+
+	entry := ManifestEntry{}
+	for i, blob := range append([]Descriptor{desc, manifest.Config}, manifest.Layers...) {
+		name, err := blobPath(blob.Digest)
+		if err != nil {
+			return err
+		}
+		if err := copyBlob(tw, name, blob, open); err != nil {
+			return err
+		}
+		switch {
+		case i == 1:
+			entry.Config = name
+		case i > 1:
+			entry.Layers = append(entry.Layers, name)
+		}
+	}
+
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+	if ref != "" {
+		entry.RepoTags = []string{ref}
+		desc.Annotations = map[string]string{AnnotationRefName: ref, AnnotationContainerdRef: ref}
+	}
+	index.Manifests = []Descriptor{desc}
+
+	if err := writeTarJSON(tw, "index.json", index); err != nil {
+		return err
+	}
+	if err := writeTarJSON(tw, "manifest.json", []ManifestEntry{entry}); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+func copyBlob(tw *tar.Writer, name string, blob Descriptor, open BlobOpener) error {
+	file, err := open(blob)
+	if err != nil {
+		return fmt.Errorf("open blob %s: %w", blob.Digest, err)
+	}
+	defer file.Close()
+
+	err = tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     blob.Size,
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+
+	hash := sha256.New()
+	n, err := io.Copy(tw, io.TeeReader(io.LimitReader(file, blob.Size), hash))
+	if err != nil {
+		return fmt.Errorf("copy blob %s: %w", blob.Digest, err)
+	}
+	if n != blob.Size {
+		return fmt.Errorf("blob %s has size %d, expected %d", blob.Digest, n, blob.Size)
+	}
+	if digest := "sha256:" + hex.EncodeToString(hash.Sum(nil)); digest != blob.Digest {
+		return fmt.Errorf("blob %s has digest %s", blob.Digest, digest)
+	}
+	return nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(data)),
+		ModTime:  time.Unix(0, 0),
+		Typeflag: tar.TypeReg,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+func writeTarJSON(tw *tar.Writer, name string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("marshal %s: %w", name, err)
+	}
+	return writeTarFile(tw, name, data)
+}
+
+// ToOCILayout extracts the docker-save archive read from r into dir as an
+// OCI image layout. Archives written by docker 25+ already are layouts;
+// older ones are converted by moving every config and layer to its blob
+// path and writing OCI manifests for them.
+func ToOCILayout(r io.Reader, dir string) error {
+	a, err := ReadTo(r, dir)
+	if err != nil {
+		return err
+	}
+	if err := a.Validate(); err != nil {
+		return fmt.Errorf("invalid image archive: %w", err)
+	}
+
+	if _, ok := a.Files["oci-layout"]; ok && a.Index != nil {
+		return nil
+	}
+
+	index := Index{SchemaVersion: 2, MediaType: MediaTypeOCIIndex}
+	for i, entry := range a.Manifest {
+		cfgFile := a.Files[entry.Config]
+		manifest := Manifest{
+			SchemaVersion: 2,
+			MediaType:     MediaTypeOCIManifest,
+			Config:        Descriptor{MediaType: MediaTypeOCIConfig, Digest: cfgFile.Digest, Size: cfgFile.Size},
+		}
+		if entry.Config, err = moveBlob(dir, cfgFile); err != nil {
+			return err
+		}
+
+		for j, layer := range entry.Layers {
+			f := a.Files[layer]
+			manifest.Layers = append(manifest.Layers, Descriptor{MediaType: LayerMediaType(f), Digest: f.Digest, Size: f.Size})
+			if entry.Layers[j], err = moveBlob(dir, f); err != nil {
+				return err
+			}
+		}
+		a.Manifest[i] = entry
+
+		desc, err := writeBlobJSON(dir, MediaTypeOCIManifest, manifest)
+		if err != nil {
+			return err
+		}
+		if len(entry.RepoTags) == 0 {
+			index.Manifests = append(index.Manifests, desc)
+		}
+		for _, tag := range entry.RepoTags {
+			tagged := desc
+			tagged.Annotations = map[string]string{AnnotationRefName: tag, AnnotationContainerdRef: tag}
+			index.Manifests = append(index.Manifests, tagged)
+		}
+	}
+
+	// Drop what is left of the legacy layout
+	for name := range a.Files {
+		if name == "manifest.json" || strings.HasPrefix(name, "blobs/") {
+			continue
+		}
+		top := strings.SplitN(name, "/", 2)[0]
+		if err := os.RemoveAll(filepath.Join(dir, top)); err != nil {
+			return err
+		}
+	}
+
+	if err := writeJSONFile(filepath.Join(dir, "manifest.json"), a.Manifest); err != nil {
+		return err
+	}
+	if err := writeJSONFile(filepath.Join(dir, "index.json"), index); err != nil {
+		return err
+	}
+	return writeJSONFile(filepath.Join(dir, "oci-layout"), layoutFile{ImageLayoutVersion: "1.0.0"})
+}
+
+// moveBlob moves an extracted file to its blob path and returns that path.
+func moveBlob(dir string, f *File) (string, error) {
+	name, err := blobPath(f.Digest)
+	if err != nil {
+		return "", err
+	}
+	if f.path == name {
+		return name, nil
+	}
+
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", err
+	}
+	if err := os.Rename(filepath.Join(dir, filepath.FromSlash(f.path)), target); err != nil {
+		return "", fmt.Errorf("move %s: %w", f.path, err)
+	}
+	f.path = name
+	return name, nil
+}
+
+func writeBlobJSON(dir, mediaType string, v interface{}) (Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return Descriptor{}, err
+	}
+
+	sum := sha256.Sum256(data)
+	desc := Descriptor{MediaType: mediaType, Digest: "sha256:" + hex.EncodeToString(sum[:]), Size: int64(len(data))}
+	name, _ := blobPath(desc.Digest)
+
+	target := filepath.Join(dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return Descriptor{}, err
+	}
+	return desc, os.WriteFile(target, data, 0644)
+}
+
+func writeJSONFile(target string, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(target, data, 0644)
+}
@@ -1,6 +1,7 @@
 package progress
 
 import (
+	"fmt"
 	"io"
 
 	"github.com/schollz/progressbar/v3"
@@ -27,13 +28,21 @@ func NewReader(r io.Reader, total int64, description string) *Reader {
 			BarEnd:        "]",
 		}),
 	)
-	
+
 	return &Reader{
 		Reader: r,
 		bar:    bar,
 	}
 }
 
+// NewReaderFrom starts the bar at done bytes, for transfers resuming
+// part way.
+func NewReaderFrom(r io.Reader, done, total int64, description string) *Reader {
+	reader := NewReader(r, total, description)
+	reader.bar.Set64(done)
+	return reader
+}
+
 func (r *Reader) Read(p []byte) (int, error) {
 	n, err := r.Reader.Read(p)
 	if n > 0 {
@@ -74,7 +83,7 @@ func NewWriter(w io.Writer, total int64, description string) *Writer {
 			BarEnd:        "]",
 		}),
 	)
-	
+
 	return &Writer{
 		Writer: w,
 		bar:    bar,
@@ -95,4 +104,18 @@ func (w *Writer) Close() error {
 		return closer.Close()
 	}
 	return nil
-}
\ No newline at end of file
+}
+
+// FormatBytes renders a byte count for humans, e.g. "12.3 MB".
+func FormatBytes(n int64) string {
+	const unit = 1000
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", float64(n)/float64(div), "kMGTPE"[exp])
+}
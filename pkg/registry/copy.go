@@ -0,0 +1,188 @@
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/dollarkillerx/unregistry/pkg/imgarchive"
+)
+
+// Image is a single-platform image resolved in a registry.
+type Image struct {
+	Descriptor imgarchive.Descriptor
+	Manifest   *imgarchive.Manifest
+	// Platform is the build picked from a multi-platform index; empty when
+	// the reference named a single image.
+	Platform string
+
+	data []byte
+}
+
+// Resolve fetches the manifest of ref, picking the build for platform when
+// ref is a multi-platform index.
+func (c *Client) Resolve(ctx context.Context, ref *Reference, platform string) (*Image, error) {
+	data, desc, err := c.GetManifest(ctx, ref, ref.Reference)
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{}
+	if imgarchive.IsIndex(desc.MediaType) {
+		var index imgarchive.Index
+		if err := json.Unmarshal(data, &index); err != nil {
+			return nil, fmt.Errorf("parse index: %w", err)
+		}
+		picked, err := imgarchive.SelectPlatform(index.Manifests, platform)
+		if err != nil {
+			return nil, err
+		}
+		if data, desc, err = c.GetManifest(ctx, ref, picked.Digest); err != nil {
+			return nil, err
+		}
+		img.Platform = picked.Platform.String()
+	}
+
+	img.Manifest = &imgarchive.Manifest{}
+	if err := json.Unmarshal(data, img.Manifest); err != nil {
+		return nil, fmt.Errorf("parse manifest: %w", err)
+	}
+	if img.Manifest.SchemaVersion != 2 || img.Manifest.Config.Digest == "" {
+		return nil, fmt.Errorf("unsupported manifest %s (%s)", desc.Digest, desc.MediaType)
+	}
+	img.Descriptor = desc
+	img.data = data
+	return img, nil
+}
+
+// WriteArchive streams img from the registry to w as a docker-save archive
+// tagged ref. Blobs are fetched one at a time and verified as they are
+// written.
+func (c *Client) WriteArchive(ctx context.Context, ref *Reference, img *Image, tag string, w io.Writer) error {
+	return imgarchive.WriteArchive(w, tag, img.Descriptor, img.Manifest, func(blob imgarchive.Descriptor) (io.ReadCloser, error) {
+		if blob.Digest == img.Descriptor.Digest {
+			return io.NopCloser(bytes.NewReader(img.data)), nil
+		}
+		return c.GetBlob(ctx, ref, blob.Digest)
+	})
+}
+
+// PushArchive uploads the docker-save archive read from r to ref and
+// returns the manifest digest. The archive is extracted below dir first;
+// uncompressed layers are gzipped there since registries expect
+// compressed layers. Blobs the repository already holds are skipped.
+func (c *Client) PushArchive(ctx context.Context, ref *Reference, r io.Reader, dir string) (string, error) {
+	a, err := imgarchive.ReadTo(r, dir)
+	if err != nil {
+		return "", err
+	}
+	if err := a.Validate(); err != nil {
+		return "", err
+	}
+	if len(a.Manifest) != 1 {
+		return "", fmt.Errorf("archive holds %d images, expected 1", len(a.Manifest))
+	}
+	entry := a.Manifest[0]
+
+	cfg := a.Files[entry.Config]
+	manifest := imgarchive.Manifest{
+		SchemaVersion: 2,
+		MediaType:     imgarchive.MediaTypeOCIManifest,
+		Config:        imgarchive.Descriptor{MediaType: imgarchive.MediaTypeOCIConfig, Digest: cfg.Digest, Size: cfg.Size},
+	}
+	open := map[string]func() (io.ReadCloser, error){
+		cfg.Digest: func() (io.ReadCloser, error) { return a.Open(entry.Config) },
+	}
+
+	for i, layer := range entry.Layers {
+		f := a.Files[layer]
+		desc := imgarchive.Descriptor{MediaType: imgarchive.LayerMediaType(f), Digest: f.Digest, Size: f.Size}
+		name := layer
+		opener := func() (io.ReadCloser, error) { return a.Open(name) }
+
+		if !f.Compressed {
+			compressed := filepath.Join(dir, fmt.Sprintf("layer-%d.tar.gz", i))
+			if desc, err = compressLayer(a, layer, compressed); err != nil {
+				return "", fmt.Errorf("compress layer %s: %w", layer, err)
+			}
+			opener = func() (io.ReadCloser, error) { return os.Open(compressed) }
+		}
+		manifest.Layers = append(manifest.Layers, desc)
+		open[desc.Digest] = opener
+	}
+
+	for _, blob := range append([]imgarchive.Descriptor{manifest.Config}, manifest.Layers...) {
+		exists, err := c.BlobExists(ctx, ref, blob.Digest)
+		if err != nil {
+			return "", err
+		}
+		if exists {
+			continue
+		}
+
+		content, err := open[blob.Digest]()
+		if err != nil {
+			return "", err
+		}
+		err = c.PushBlob(ctx, ref, blob, content)
+		content.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return "", fmt.Errorf("marshal manifest: %w", err)
+	}
+	return c.PutManifest(ctx, ref, ref.Reference, manifest.MediaType, data)
+}
+
+// compressLayer gzips an uncompressed layer into target.
+func compressLayer(a *imgarchive.Archive, layer, target string) (imgarchive.Descriptor, error) {
+	in, err := a.Open(layer)
+	if err != nil {
+		return imgarchive.Descriptor{}, err
+	}
+	defer in.Close()
+
+	out, err := os.Create(target)
+	if err != nil {
+		return imgarchive.Descriptor{}, err
+	}
+	defer out.Close()
+
+	hash := sha256.New()
+	counter := &countingWriter{w: io.MultiWriter(out, hash)}
+	zw := gzip.NewWriter(counter)
+	if _, err := io.Copy(zw, in); err != nil {
+		return imgarchive.Descriptor{}, err
+	}
+	if err := zw.Close(); err != nil {
+		return imgarchive.Descriptor{}, err
+	}
+
+	return imgarchive.Descriptor{
+		MediaType: imgarchive.MediaTypeOCILayerGzip,
+		Digest:    "sha256:" + hex.EncodeToString(hash.Sum(nil)),
+		Size:      counter.n,
+	}, out.Close()
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,419 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dollarkillerx/unregistry/pkg/imgarchive"
+)
+
+// Docker Hub is addressed as docker.io in references but served elsewhere
+const (
+	dockerHub     = "docker.io"
+	dockerHubHost = "registry-1.docker.io"
+)
+
+// manifestTypes are the manifest media types the client understands.
+var manifestTypes = []string{
+	imgarchive.MediaTypeOCIIndex,
+	imgarchive.MediaTypeOCIManifest,
+	imgarchive.MediaTypeDockerManifestList,
+	imgarchive.MediaTypeDockerManifest,
+}
+
+// Reference names an image in a registry, e.g. localhost:5000/team/api:1.4.
+type Reference struct {
+	Host       string
+	Repository string
+	// Tag or digest (sha256:...)
+	Reference string
+}
+
+// ParseReference parses a docker-style image reference. Without a host the
+// image lives on Docker Hub, without a tag it is :latest.
+func ParseReference(ref string) (*Reference, error) {
+	r := &Reference{Host: dockerHub}
+
+	name := ref
+	if first, rest, ok := strings.Cut(ref, "/"); ok &&
+		(strings.ContainsAny(first, ".:") || first == "localhost") {
+		r.Host, name = first, rest
+	}
+
+	if repo, digest, ok := strings.Cut(name, "@"); ok {
+		name, r.Reference = repo, digest
+	} else if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") {
+		name, r.Reference = name[:i], name[i+1:]
+	} else {
+		r.Reference = "latest"
+	}
+
+	if name == "" || r.Reference == "" || name != strings.ToLower(name) {
+		return nil, fmt.Errorf("invalid image reference %q", ref)
+	}
+	if r.Host == dockerHub && !strings.Contains(name, "/") {
+		name = "library/" + name
+	}
+	r.Repository = name
+	return r, nil
+}
+
+func (r *Reference) String() string {
+	return r.Host + "/" + r.name()
+}
+
+// name is the reference without its host.
+func (r *Reference) name() string {
+	if strings.HasPrefix(r.Reference, "sha256:") {
+		return r.Repository + "@" + r.Reference
+	}
+	return r.Repository + ":" + r.Reference
+}
+
+// Client speaks the registry v2 HTTP API. It answers bearer token and basic
+// auth challenges with Username and Password, or anonymously without them.
+type Client struct {
+	Username string
+	Password string
+	// Insecure uses plain HTTP; localhost registries always do.
+	Insecure bool
+
+	client *http.Client
+	token  string
+	basic  bool
+}
+
+func NewClient(username, password string, insecure bool) *Client {
+	return &Client{
+		Username: username,
+		Password: password,
+		Insecure: insecure,
+		client:   &http.Client{},
+	}
+}
+
+func (c *Client) url(ref *Reference, kind, name string) string {
+	scheme := "https"
+	host, _, _ := strings.Cut(ref.Host, ":")
+	if c.Insecure || host == "localhost" || host == "127.0.0.1" {
+		scheme = "http"
+	}
+	if ref.Host == dockerHub {
+		host = dockerHubHost
+	} else {
+		host = ref.Host
+	}
+	return fmt.Sprintf("%s://%s/v2/%s/%s/%s", scheme, host, ref.Repository, kind, name)
+}
+
+func (c *Client) authorize(req *http.Request) {
+	switch {
+	case c.token != "":
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	case c.basic && c.Username != "":
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+}
+
+// do sends a request, logging in and retrying once when the registry
+// challenges it. Requests with a body can only be retried when the body
+// can be replayed.
+func (c *Client) do(req *http.Request) (*http.Response, error) {
+	c.authorize(req)
+	resp, err := c.client.Do(req)
+	if err != nil || resp.StatusCode != http.StatusUnauthorized {
+		return resp, err
+	}
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+
+	if req.Body != nil && req.GetBody == nil {
+		return nil, fmt.Errorf("registry requires authentication")
+	}
+	if err := c.login(req.Context(), challenge); err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	c.authorize(retry)
+	return c.client.Do(retry)
+}
+
+// login answers a WWW-Authenticate challenge.
+func (c *Client) login(ctx context.Context, challenge string) error {
+	scheme, params := parseChallenge(challenge)
+	switch strings.ToLower(scheme) {
+	case "basic":
+		if c.Username == "" {
+			return fmt.Errorf("registry requires a username and password")
+		}
+		c.basic = true
+		c.token = ""
+		return nil
+	case "bearer":
+	default:
+		return fmt.Errorf("unsupported registry authentication %q", challenge)
+	}
+
+	tokenURL, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("invalid registry challenge %q", challenge)
+	}
+	query := tokenURL.Query()
+	if service := params["service"]; service != "" {
+		query.Set("service", service)
+	}
+	if scope := params["scope"]; scope != "" {
+		query.Set("scope", scope)
+	}
+	tokenURL.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", tokenURL.String(), nil)
+	if err != nil {
+		return err
+	}
+	if c.Username != "" {
+		req.SetBasicAuth(c.Username, c.Password)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("get registry token: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("get registry token: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+
+	var result struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("decode registry token: %w", err)
+	}
+	c.token = result.Token
+	if c.token == "" {
+		c.token = result.AccessToken
+	}
+	if c.token == "" {
+		return fmt.Errorf("registry returned no token")
+	}
+	return nil
+}
+
+// parseChallenge splits `Bearer realm="...",scope="a,b"` into its scheme
+// and parameters. Quoted values may contain commas.
+func parseChallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := make(map[string]string)
+
+	for rest != "" {
+		rest = strings.TrimLeft(rest, " ,")
+		key, value, ok := strings.Cut(rest, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+
+		if strings.HasPrefix(value, `"`) {
+			end := strings.Index(value[1:], `"`)
+			if end < 0 {
+				params[key] = value[1:]
+				break
+			}
+			params[key] = value[1 : end+1]
+			rest = value[end+2:]
+		} else {
+			params[key], rest, _ = strings.Cut(value, ",")
+		}
+	}
+	return scheme, params
+}
+
+// responseError turns a failed registry response into an error, using the
+// registry's error list when it sent one.
+func responseError(action string, resp *http.Response) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+
+	var result struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if json.Unmarshal(body, &result) == nil && len(result.Errors) > 0 {
+		messages := make([]string, len(result.Errors))
+		for i, e := range result.Errors {
+			messages[i] = e.Code + ": " + e.Message
+		}
+		return fmt.Errorf("%s: %s", action, strings.Join(messages, "; "))
+	}
+	return fmt.Errorf("%s: %s", action, resp.Status)
+}
+
+// GetManifest fetches a manifest or index by tag or digest and checks it
+// against the digest it is addressed by.
+func (c *Client) GetManifest(ctx context.Context, ref *Reference, reference string) ([]byte, imgarchive.Descriptor, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url(ref, "manifests", reference), nil)
+	if err != nil {
+		return nil, imgarchive.Descriptor{}, err
+	}
+	req.Header.Set("Accept", strings.Join(manifestTypes, ", "))
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, imgarchive.Descriptor{}, fmt.Errorf("get manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, imgarchive.Descriptor{}, responseError("get manifest "+(&Reference{Repository: ref.Repository, Reference: reference}).name(), resp)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, 4*1024*1024))
+	if err != nil {
+		return nil, imgarchive.Descriptor{}, fmt.Errorf("read manifest: %w", err)
+	}
+	sum := sha256.Sum256(data)
+	desc := imgarchive.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    "sha256:" + hex.EncodeToString(sum[:]),
+		Size:      int64(len(data)),
+	}
+	if strings.HasPrefix(reference, "sha256:") && desc.Digest != reference {
+		return nil, imgarchive.Descriptor{}, fmt.Errorf("manifest %s has digest %s", reference, desc.Digest)
+	}
+
+	// Registries may send a generic content type; the manifest knows better
+	var probe struct {
+		MediaType string `json:"mediaType"`
+	}
+	if json.Unmarshal(data, &probe) == nil && probe.MediaType != "" {
+		desc.MediaType = probe.MediaType
+	}
+	return data, desc, nil
+}
+
+// PutManifest uploads a manifest under a tag or digest and returns its digest.
+func (c *Client) PutManifest(ctx context.Context, ref *Reference, reference, mediaType string, data []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", c.url(ref, "manifests", reference), bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+
+	resp, err := c.do(req)
+	if err != nil {
+		return "", fmt.Errorf("put manifest: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusOK {
+		return "", responseError("put manifest", resp)
+	}
+
+	sum := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(sum[:]), nil
+}
+
+// GetBlob opens a blob. The caller verifies its digest.
+func (c *Client) GetBlob(ctx context.Context, ref *Reference, digest string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.url(ref, "blobs", digest), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return nil, fmt.Errorf("get blob: %w", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, responseError("get blob "+digest, resp)
+	}
+	return resp.Body, nil
+}
+
+// BlobExists reports whether the repository already holds a blob.
+func (c *Client) BlobExists(ctx context.Context, ref *Reference, digest string) (bool, error) {
+	req, err := http.NewRequestWithContext(ctx, "HEAD", c.url(ref, "blobs", digest), nil)
+	if err != nil {
+		return false, err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return false, fmt.Errorf("check blob: %w", err)
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return true, nil
+	case http.StatusNotFound:
+		return false, nil
+	default:
+		return false, fmt.Errorf("check blob %s: %s", digest, resp.Status)
+	}
+}
+
+// PushBlob uploads a blob of known size and digest in a single request.
+func (c *Client) PushBlob(ctx context.Context, ref *Reference, blob imgarchive.Descriptor, r io.Reader) error {
+	// Starting the upload also settles authentication before the body is sent
+	req, err := http.NewRequestWithContext(ctx, "POST", c.url(ref, "blobs", "uploads/"), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.do(req)
+	if err != nil {
+		return fmt.Errorf("start upload: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return responseError("start upload", resp)
+	}
+
+	location, err := req.URL.Parse(resp.Header.Get("Location"))
+	if err != nil || resp.Header.Get("Location") == "" {
+		return fmt.Errorf("start upload: registry returned no upload location")
+	}
+	query := location.Query()
+	query.Set("digest", blob.Digest)
+	location.RawQuery = query.Encode()
+
+	req, err = http.NewRequestWithContext(ctx, "PUT", location.String(), r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = blob.Size
+	req.Header.Set("Content-Type", "application/octet-stream")
+
+	c.authorize(req)
+	resp, err = c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("upload blob: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated {
+		return responseError("upload blob "+blob.Digest, resp)
+	}
+	return nil
+}
@@ -0,0 +1,210 @@
+package sign
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+)
+
+// Signature is a detached ed25519 signature over an image digest.
+type Signature struct {
+	Digest    string `json:"digest"`
+	KeyID     string `json:"key_id"`
+	PublicKey string `json:"public_key"`
+	Signature string `json:"signature"`
+}
+
+// GenerateKey writes a new PEM encoded ed25519 key pair to privPath and pubPath.
+func GenerateKey(privPath, pubPath string) error {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate key: %w", err)
+	}
+
+	privDER, err := x509.MarshalPKCS8PrivateKey(priv)
+	if err != nil {
+		return fmt.Errorf("marshal private key: %w", err)
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return fmt.Errorf("marshal public key: %w", err)
+	}
+
+	err = os.WriteFile(privPath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privDER}), 0600)
+	if err != nil {
+		return fmt.Errorf("write private key: %w", err)
+	}
+	err = os.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+	if err != nil {
+		return fmt.Errorf("write public key: %w", err)
+	}
+
+	return nil
+}
+
+func LoadPrivateKey(keyPath string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(keyPath, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse private key: %w", err)
+	}
+
+	priv, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 private key", keyPath)
+	}
+	return priv, nil
+}
+
+func LoadPublicKey(keyPath string) (ed25519.PublicKey, error) {
+	der, err := readPEM(keyPath, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("parse public key: %w", err)
+	}
+
+	pub, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ed25519 public key", keyPath)
+	}
+	return pub, nil
+}
+
+func readPEM(keyPath, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(keyPath)
+	if err != nil {
+		return nil, fmt.Errorf("read key: %w", err)
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not contain a PEM %s block", keyPath, blockType)
+	}
+	return block.Bytes, nil
+}
+
+// KeyID returns a short fingerprint used to tell keys apart.
+func KeyID(pub ed25519.PublicKey) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Sign signs the digest string (e.g. "sha256:...") with priv.
+func Sign(priv ed25519.PrivateKey, digest string) *Signature {
+	pub := priv.Public().(ed25519.PublicKey)
+	return &Signature{
+		Digest:    digest,
+		KeyID:     KeyID(pub),
+		PublicKey: base64.StdEncoding.EncodeToString(pub),
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(priv, []byte(digest))),
+	}
+}
+
+// Verify checks that sig was made by pub over digest.
+func Verify(pub ed25519.PublicKey, digest string, sig *Signature) error {
+	if sig == nil {
+		return errors.New("image is not signed")
+	}
+	if sig.Digest != digest {
+		return fmt.Errorf("signature covers %s, image digest is %s", sig.Digest, digest)
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(sig.Signature)
+	if err != nil {
+		return fmt.Errorf("decode signature: %w", err)
+	}
+	if !ed25519.Verify(pub, []byte(digest), raw) {
+		return fmt.Errorf("invalid signature for key %s", KeyID(pub))
+	}
+	return nil
+}
+
+// Key returns the public key embedded in the signature.
+func (s *Signature) Key() (ed25519.PublicKey, error) {
+	raw, err := base64.StdEncoding.DecodeString(s.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+	if len(raw) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid public key size")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// Policy decides which repositories need signed pushes and which keys are trusted.
+type Policy struct {
+	Keys  []ed25519.PublicKey
+	Repos []string
+}
+
+// LoadPolicy reads the trusted public keys and keeps the repository patterns
+// (path.Match globs such as "prod-*").
+func LoadPolicy(keyPaths, repos []string) (*Policy, error) {
+	policy := &Policy{Repos: repos}
+	for _, keyPath := range keyPaths {
+		pub, err := LoadPublicKey(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		policy.Keys = append(policy.Keys, pub)
+	}
+
+	if len(policy.Repos) > 0 && len(policy.Keys) == 0 {
+		return nil, errors.New("signed repositories configured without trusted keys")
+	}
+	return policy, nil
+}
+
+// Required reports whether pushes to the image need a signature.
+func (p *Policy) Required(imageName string) bool {
+	if p == nil {
+		return false
+	}
+
+	repo := imageName
+	if i := strings.LastIndex(repo, ":"); i > strings.LastIndex(repo, "/") {
+		repo = repo[:i]
+	}
+	for _, pattern := range p.Repos {
+		if ok, _ := path.Match(pattern, repo); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Trusted verifies sig over digest. When trusted keys are configured the
+// signing key must be one of them.
+func (p *Policy) Trusted(digest string, sig *Signature) error {
+	pub, err := sig.Key()
+	if err != nil {
+		return err
+	}
+
+	if p == nil || len(p.Keys) == 0 {
+		return Verify(pub, digest, sig)
+	}
+	for _, key := range p.Keys {
+		if key.Equal(pub) {
+			return Verify(key, digest, sig)
+		}
+	}
+	return fmt.Errorf("key %s is not trusted", KeyID(pub))
+}